@@ -1,8 +1,13 @@
 package fuse
 
 import (
+	"io"
 	"log"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/binzume/cfs/volume"
 
@@ -14,6 +19,7 @@ import (
 type fuseFs struct {
 	pathfs.FileSystem
 	v volume.FS
+	l volume.VolumeLinker // nil: symlinks are shown as regular files
 }
 
 type fuseFile struct {
@@ -21,21 +27,42 @@ type fuseFile struct {
 	path  string
 	v     volume.FS
 	fstat *volume.FileInfo
+	lock  sync.Mutex
+	r     volume.FileReadCloser // kept open for read-ahead
 }
 
 func (t *fuseFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	f, err := t.v.Stat(name)
+	var f *volume.FileInfo
+	var err error
+	if t.l != nil {
+		f, err = t.l.Lstat(name)
+	} else {
+		f, err = t.v.Stat(name)
+	}
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuse.ToStatus(err)
 	}
 
+	if f.Mode()&os.ModeSymlink != 0 {
+		return &fuse.Attr{
+			Mode:  fuse.S_IFLNK | 0777,
+			Size:  uint64(f.Size()),
+			Ctime: uint64(f.CreatedTime.Unix()),
+			Mtime: uint64(f.UpdatedTime.Unix()),
+			Atime: uint64(f.UpdatedTime.Unix()),
+		}, fuse.OK
+	}
 	if f.IsDir() {
 		return &fuse.Attr{
 			Mode: fuse.S_IFDIR | 0755,
 		}, fuse.OK
 	}
+	perm := uint32(f.Mode().Perm())
+	if perm == 0 {
+		perm = 0644
+	}
 	return &fuse.Attr{
-		Mode:  fuse.S_IFREG | 0644,
+		Mode:  fuse.S_IFREG | perm,
 		Size:  uint64(f.Size()),
 		Ctime: uint64(f.CreatedTime.Unix()),
 		Mtime: uint64(f.UpdatedTime.Unix()),
@@ -46,12 +73,18 @@ func (t *fuseFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.S
 func (t *fuseFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
 	files, err := t.v.ReadDir(name)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuse.ToStatus(err)
 	}
 
 	result := []fuse.DirEntry{}
 	for _, f := range files {
-		result = append(result, fuse.DirEntry{Name: f.Name(), Mode: fuse.S_IFREG})
+		mode := uint32(fuse.S_IFREG)
+		if f.IsDir() {
+			mode = fuse.S_IFDIR
+		} else if f.Mode()&os.ModeSymlink != 0 && t.l != nil {
+			mode = fuse.S_IFLNK
+		}
+		result = append(result, fuse.DirEntry{Name: f.Name(), Mode: mode})
 	}
 
 	return result, fuse.OK
@@ -60,7 +93,7 @@ func (t *fuseFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry,
 func (t *fuseFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	f, err := t.v.Stat(name)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuse.ToStatus(err)
 	}
 	if flags&fuse.O_ANYWRITE != 0 {
 		return nil, fuse.EPERM
@@ -69,42 +102,109 @@ func (t *fuseFs) Open(name string, flags uint32, context *fuse.Context) (file no
 	return &fuseFile{File: nodefs.NewDefaultFile(), fstat: f, v: t.v, path: name}, fuse.OK
 }
 
+func (t *fuseFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if t.l == nil {
+		return "", fuse.ENOSYS
+	}
+	target, err := t.l.Readlink(name)
+	return target, fuse.ToStatus(err)
+}
+
+func (t *fuseFs) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if t.l == nil {
+		return fuse.ENOSYS
+	}
+	return fuse.ToStatus(t.l.Symlink(value, linkName))
+}
+
+func (t *fuseFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fuse.ToStatus(t.v.Rename(oldName, newName))
+}
+
+func (t *fuseFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fuse.ToStatus(t.v.Chmod(name, os.FileMode(mode).Perm()))
+}
+
+func (t *fuseFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	var a, m time.Time
+	if atime != nil {
+		a = *atime
+	}
+	if mtime != nil {
+		m = *mtime
+	}
+	return fuse.ToStatus(t.v.Chtimes(name, a, m))
+}
+
+func (t *fuseFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fuse.ToStatus(t.v.Truncate(name, int64(size)))
+}
+
 func (f *fuseFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	ff, err := f.v.Open(f.path)
-	if err != nil {
-		return nil, fuse.ENOSYS
+	f.lock.Lock()
+	if f.r == nil {
+		ff, err := f.v.Open(f.path)
+		if err != nil {
+			f.lock.Unlock()
+			return nil, fuse.ToStatus(err)
+		}
+		f.r = ff
 	}
-	defer ff.Close()
+	ff := f.r
+	f.lock.Unlock()
 
 	len, err := ff.ReadAt(buf, off)
-	if err != nil {
-		return nil, fuse.ENOSYS
+	if err != nil && err != io.EOF {
+		return nil, fuse.ToStatus(err)
 	}
 
 	return fuse.ReadResultData(buf[:len]), fuse.OK
 }
 
+func (f *fuseFile) Release() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+}
+
 func (f *fuseFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 	ff, err := f.v.OpenFile(f.path, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		return 0, fuse.ENOSYS
+		return 0, fuse.ToStatus(err)
 	}
 	defer ff.Close()
 
 	len, err := ff.WriteAt(data, off)
 	if err != nil {
-		return 0, fuse.ENOSYS
+		return 0, fuse.ToStatus(err)
 	}
 	return uint32(len), fuse.OK
 }
 
 func MountVolume(v volume.Volume, mountPoint string) <-chan error {
 
-	nfs := pathfs.NewPathNodeFs(&fuseFs{FileSystem: pathfs.NewDefaultFileSystem(), v: volume.ToFS(v)}, nil)
+	l, _ := volume.UnwrapVolume(v).(volume.VolumeLinker)
+	nfs := pathfs.NewPathNodeFs(&fuseFs{FileSystem: pathfs.NewDefaultFileSystem(), v: volume.ToFS(v), l: l}, nil)
 	server, _, err := nodefs.MountRoot(mountPoint, nfs.Root(), nil)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
 	go server.Serve()
+	if w, ok := v.(volume.VolumeWatcher); ok {
+		// Invalidate kernel caches on remote changes.
+		// Notifications are sent asynchronously because the kernel may wait for operations which need the volume.
+		w.Watch(func(ev volume.FileEvent) {
+			go func() {
+				dir, name := path.Split(ev.Path)
+				nfs.EntryNotify(strings.TrimSuffix(dir, "/"), name)
+				if ev.Type == volume.UpdateEvent {
+					nfs.FileNotify(ev.Path, 0, 0)
+				}
+			}()
+		})
+	}
 	return make(chan error)
 }
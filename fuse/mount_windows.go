@@ -24,8 +24,12 @@ func (fs *fuseFs) WithContext(ctx context.Context) (context.Context, context.Can
 	return ctx, nil
 }
 
+func toVolumePath(p string) string {
+	return strings.TrimLeft(strings.Replace(p, "\\", "/", -1), "/")
+}
+
 func (fs *fuseFs) CreateFile(ctx context.Context, fi *dokan.FileInfo, cd *dokan.CreateData) (dokan.File, bool, error) {
-	path := strings.TrimLeft(strings.Replace(fi.Path()[1:], "\\", "/", -1), "/")
+	path := toVolumePath(fi.Path()[1:])
 	if cd.CreateDisposition == dokan.FileCreate {
 		file, err := fs.v.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0)
 		if err != nil {
@@ -67,8 +71,13 @@ func (fs *fuseFs) GetVolumeInformation(ctx context.Context) (dokan.VolumeInforma
 }
 
 func (fs *fuseFs) MoveFile(ctx context.Context, src dokan.File, sourceFI *dokan.FileInfo, targetPath string, replaceExisting bool) error {
-	log.Println("MoveFile")
-	return nil
+	newPath := toVolumePath(targetPath)
+	if !replaceExisting {
+		if _, err := fs.v.Stat(newPath); err == nil {
+			return os.ErrExist
+		}
+	}
+	return fs.v.Rename(toVolumePath(sourceFI.Path()), newPath)
 }
 
 func (fs *fuseFs) ErrorPrint(err error) {
@@ -229,12 +238,41 @@ func (t *fuseDir) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte,
 	return t.file.WriteAt(bs, offset)
 }
 
+func (t *fuseDir) SetFileTime(ctx context.Context, fi *dokan.FileInfo, creation time.Time, lastAccess time.Time, lastWrite time.Time) error {
+	if lastAccess.IsZero() && lastWrite.IsZero() {
+		return nil
+	}
+	t.st = nil
+	return t.v.Chtimes(t.path, lastAccess, lastWrite)
+}
+
+func (t *fuseDir) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	t.st = nil
+	return t.v.Truncate(t.path, length)
+}
+
 func (t *fuseDir) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
 	if fi.IsDeleteOnClose() {
 		t.v.Remove(t.path)
 	}
 }
 
+func (t *fuseDir) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
+	if f, ok := t.file.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (t *fuseDir) CloseFile(ctx context.Context, fi *dokan.FileInfo) {
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			log.Print(err)
+		}
+		t.file = nil
+	}
+}
+
 func MountVolume(v volume.Volume, mountPoint string) <-chan error {
 	_, err := os.Stat(mountPoint)
 	if len(mountPoint) > 2 && os.IsNotExist(err) {
@@ -11,6 +11,9 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/keybase/dokan-go v0.0.0-20171016134211-b7c8fa8b5dd6
 	github.com/keybase/kbfs v2.11.0+incompatible
+	github.com/klauspost/compress v1.15.15
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/text v0.3.8
 )
 
 require (
@@ -26,7 +29,6 @@ require (
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/ugorji/go/codec v1.1.7 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	golang.org/x/sys v0.0.0-20220818161305-2296e01440c6 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -35,7 +35,7 @@ func hubToken() string {
 
 func usage() {
 	log.Printf("usage: cs help [command]")
-	log.Printf("       cs publish local user/volume")
+	log.Printf("       cs publish [-w] local user/volume")
 	log.Printf("       cs mount user/volume mountpoint")
 }
 
@@ -51,8 +51,12 @@ func publish(localPath, volumePath string, writable bool) error {
 	finish := make(chan error)
 	hubConn.WriteJSON(&map[string]string{"action": "volume", "name": strings.SplitN(volumePath, "/", 2)[1], "url": "ws://localhost:8080/"})
 
-	v := volume.NewLocalVolume(localPath) // volumePath, writable
-	provider := wsvolume.NewWebsocketVolumeProvider(v)
+	v := volume.NewLocalVolume(localPath, volume.Confine(), volume.RejectSpecialFiles())
+	var opts []wsvolume.ProviderOption
+	if !writable {
+		opts = append(opts, wsvolume.ReadOnly())
+	}
+	provider := wsvolume.NewWebsocketVolumeProvider(v, opts...)
 
 	go func() {
 		// listen loop
@@ -88,6 +92,9 @@ func mount(volumePath, mountPoint string) error {
 	}
 
 	v := wsvolume.NewWebsocketVolume(volumePath)
+	v.OnStateChange = func(state wsvolume.ConnState) {
+		log.Println("connection: ", state)
+	}
 	volumeExit, err := v.StartClient(connector)
 	if err != nil {
 		log.Println("connect error: ", err)
@@ -114,8 +114,7 @@ func Connect(wsurl, user, token string) (*websocket.Conn, error) {
 
 	wsConn, resp, err := websocket.NewClient(rawConn, u, wsHeaders, 1024, 1024)
 	if err != nil {
-		fmt.Errorf("websocket.NewClient Error: %s\nResp:%+v", err, resp)
-		return nil, err
+		return nil, fmt.Errorf("websocket.NewClient Error: %s\nResp:%+v", err, resp)
 	}
 	if user == "" {
 		return wsConn, err
@@ -128,7 +128,7 @@ func (c *ProxyConnection) Join(conn2 *websocket.Conn) {
 	c.conn2 = conn2
 	go func() {
 		defer CloseProxyConnection(c.id)
-		c.conn1.WriteJSON(&map[string]string{})
+		// The provider sends the handshake message. Empty messages are rejected by the client.
 		for {
 			t, m, err := c.conn2.ReadMessage()
 			if err != nil {
@@ -0,0 +1,212 @@
+// Package arcache caches opened archives and their parsed indexes.
+package arcache
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Key identifies an archive. FS is the key of the fs.FS, or nil for native paths.
+// Opt distinguishes indexes of the same archive parsed with different options.
+type Key struct {
+	FS   interface{}
+	Path string
+	Opt  string
+}
+
+// Keyer is implemented by fs.FS which can be created for each operation.
+// Archives in such file systems are cached with the returned key instead of the fs.FS itself.
+type Keyer interface {
+	CacheKey() (key interface{}, ok bool)
+}
+
+// KeyOf returns the key of fsys. ok is false if fsys can not be used as a key.
+func KeyOf(fsys fs.FS) (key interface{}, ok bool) {
+	if k, ok := fsys.(Keyer); ok {
+		return k.CacheKey()
+	}
+	if fsys == nil {
+		return nil, true
+	}
+	return fsys, reflect.TypeOf(fsys).Comparable()
+}
+
+// Archive is an opened archive. The reader is shared by all open files.
+type Archive struct {
+	Key     Key
+	Size    int64
+	ModTime time.Time
+	Entries int         // number of entries in the index
+	Index   interface{} // parsed index
+	Closer  io.Closer
+
+	refs    int
+	evicted bool
+	idle    time.Duration
+	timer   *time.Timer // closes the unused archive after idle.
+}
+
+// Ref is a reference to the archive. Close releases it.
+type Ref struct {
+	*Archive
+	cache *Cache
+	once  sync.Once
+}
+
+func (r *Ref) Close() error {
+	r.once.Do(func() { r.cache.release(r.Archive) })
+	return nil
+}
+
+// Cache is a LRU cache of archives. Archives in use are closed when the last reference is released.
+type Cache struct {
+	lock    sync.Mutex
+	lru     *list.List // of *Archive
+	items   map[Key]*list.Element
+	entries int
+}
+
+func New() *Cache {
+	return &Cache{lru: list.New(), items: map[Key]*list.Element{}}
+}
+
+// Open returns a reference to the cached archive, or loads it if the size or mtime of the archive are changed.
+// Archives with more than maxEntries entries are not cached. Unused archives are closed after idle. (0: never)
+func (c *Cache) Open(fsys fs.FS, path, opt string, stat fs.FileInfo, maxArchives, maxEntries int, idle time.Duration, load func() (*Archive, error)) (*Ref, error) {
+	k, ok := KeyOf(fsys)
+	key := Key{FS: k, Path: path, Opt: opt}
+	if !ok {
+		a, err := load()
+		if err != nil {
+			return nil, err
+		}
+		a.refs, a.evicted = 1, true
+		return &Ref{Archive: a, cache: c}, nil
+	}
+	if a := c.get(key, stat); a != nil {
+		return &Ref{Archive: a, cache: c}, nil
+	}
+	a, err := load()
+	if err != nil {
+		return nil, err
+	}
+	a.Key, a.Size, a.ModTime, a.refs, a.idle = key, stat.Size(), stat.ModTime(), 1, idle
+	c.put(a, maxArchives, maxEntries)
+	return &Ref{Archive: a, cache: c}, nil
+}
+
+func (c *Cache) get(key Key, stat fs.FileInfo) *Archive {
+	c.lock.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil
+	}
+	a := el.Value.(*Archive)
+	if a.Size != stat.Size() || !a.ModTime.Equal(stat.ModTime()) {
+		unused := c.remove(el, nil)
+		c.lock.Unlock()
+		closeArchives(unused)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	a.refs++
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	c.lock.Unlock()
+	return a
+}
+
+func (c *Cache) put(a *Archive, maxArchives, maxEntries int) {
+	c.lock.Lock()
+	if a.Entries > maxEntries || maxArchives <= 0 {
+		a.evicted = true
+		c.lock.Unlock()
+		return
+	}
+	var unused []*Archive
+	if el, ok := c.items[a.Key]; ok {
+		unused = c.remove(el, unused)
+	}
+	c.items[a.Key] = c.lru.PushFront(a)
+	c.entries += a.Entries
+	for c.lru.Len() > maxArchives || c.entries > maxEntries {
+		unused = c.remove(c.lru.Back(), unused)
+	}
+	c.lock.Unlock()
+	closeArchives(unused)
+}
+
+// remove removes the archive from the cache, and appends it to unused if it is not in use.
+// Archives must be closed without the lock because closing a nested archive releases its parent.
+func (c *Cache) remove(el *list.Element, unused []*Archive) []*Archive {
+	a := c.lru.Remove(el).(*Archive)
+	delete(c.items, a.Key)
+	c.entries -= a.Entries
+	a.evicted = true
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	if a.refs == 0 {
+		unused = append(unused, a)
+	}
+	return unused
+}
+
+func closeArchives(archives []*Archive) {
+	for _, a := range archives {
+		a.Closer.Close()
+	}
+}
+
+func (c *Cache) release(a *Archive) {
+	c.lock.Lock()
+	a.refs--
+	unused := a.refs == 0 && a.evicted
+	if a.refs == 0 && !a.evicted && a.idle > 0 {
+		// e.g. Files in use can't be removed on Windows.
+		a.timer = time.AfterFunc(a.idle, func() { c.expire(a) })
+	}
+	c.lock.Unlock()
+	if unused {
+		a.Closer.Close()
+	}
+}
+
+// expire removes the archive if it is still unused.
+func (c *Cache) expire(a *Archive) {
+	c.lock.Lock()
+	var unused []*Archive
+	if el, ok := c.items[a.Key]; ok && el.Value == a && a.refs == 0 {
+		unused = c.remove(el, nil)
+	}
+	c.lock.Unlock()
+	closeArchives(unused)
+}
+
+// Entries returns the total number of entries in the cache.
+func (c *Cache) Entries() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries
+}
+
+// Purge removes all archives from the cache. Archives in use are closed after they are released.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	var unused []*Archive
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		unused = c.remove(el, unused)
+		el = next
+	}
+	c.lock.Unlock()
+	closeArchives(unused)
+}
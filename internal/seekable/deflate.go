@@ -0,0 +1,134 @@
+package seekable
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+type deflateDecoder struct {
+	f     *inflater
+	start int64
+	gzip  bool
+
+	// CRC of the current gzip member. It is checked only if the member is decoded from the beginning.
+	crc         uint32
+	crcValid    bool
+	memberStart int64
+}
+
+// NewDeflateReader returns a reader for the deflate stream in src[start:start+csize]. size is the uncompressed size.
+func NewDeflateReader(src io.ReaderAt, start, csize, size int64) *Reader {
+	return newDeflateReader(src, start, start+csize, size, false)
+}
+
+// NewGzipReader returns a reader for the gzip stream in src[0:csize]. Concatenated members are read as one stream.
+// The CRC of a member is checked when it is read from the beginning to the end.
+func NewGzipReader(src io.ReaderAt, csize int64) (*Reader, error) {
+	start, err := gzipDataOffset(src, 0, csize)
+	if err == io.EOF {
+		err = gzip.ErrHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newDeflateReader(src, start, csize, -1, true), nil
+}
+
+func newDeflateReader(src io.ReaderAt, start, end, size int64, gzip bool) *Reader {
+	d := &deflateDecoder{f: newInflater(src, start, end), start: start, gzip: gzip}
+	r := newReader(d, size)
+	d.f.onBoundary = func() {
+		r.addCheckpoint(d.f.bitPos(), d.f.out, d.f.window)
+	}
+	return r
+}
+
+func (d *deflateDecoder) reset(cp *checkpoint) error {
+	if cp == nil {
+		d.crc, d.crcValid, d.memberStart = 0, true, 0
+		return d.f.reset(d.start*8, 0, nil)
+	}
+	d.crcValid = false
+	return d.f.reset(cp.in, cp.out, cp.window)
+}
+
+func (d *deflateDecoder) Read(p []byte) (int, error) {
+	for {
+		n, err := d.f.Read(p)
+		if d.crcValid {
+			d.crc = crc32.Update(d.crc, crc32.IEEETable, p[:n])
+		}
+		if err != io.EOF || !d.gzip {
+			return n, err
+		}
+		// check CRC32 and ISIZE, and start the next member.
+		pos := (d.f.bitPos() + 7) / 8
+		var trailer [8]byte
+		if n, _ := d.f.src.ReadAt(trailer[:], pos); n < len(trailer) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if d.crcValid && (binary.LittleEndian.Uint32(trailer[:4]) != d.crc ||
+			binary.LittleEndian.Uint32(trailer[4:]) != uint32(d.f.out-d.memberStart)) {
+			return 0, gzip.ErrChecksum
+		}
+		start, err := gzipDataOffset(d.f.src, pos+8, d.f.end)
+		if err != nil {
+			return 0, err
+		}
+		if err := d.f.reset(start*8, d.f.out, nil); err != nil {
+			return 0, err
+		}
+		d.crc, d.crcValid, d.memberStart = 0, true, d.f.out
+	}
+}
+
+// gzipDataOffset parses the gzip header at pos and returns the offset of the deflate stream.
+// It returns io.EOF at the end of the stream or zero padding.
+func gzipDataOffset(src io.ReaderAt, pos, end int64) (int64, error) {
+	if pos > end {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r := bufio.NewReader(io.NewSectionReader(src, pos, end-pos))
+	var h [10]byte
+	if _, err := io.ReadFull(r, h[:1]); err != nil || h[0] == 0 {
+		return 0, io.EOF
+	}
+	if _, err := io.ReadFull(r, h[1:]); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 {
+		return 0, gzip.ErrHeader
+	}
+	n := pos + 10
+	flg := h[3]
+	if flg&4 != 0 {
+		if _, err := io.ReadFull(r, h[:2]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		xlen := int64(h[0]) | int64(h[1])<<8
+		if _, err := r.Discard(int(xlen)); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n += 2 + xlen
+	}
+	for _, f := range []byte{8, 16} {
+		if flg&f != 0 {
+			s, err := r.ReadSlice(0)
+			for err == bufio.ErrBufferFull {
+				n += int64(len(s))
+				s, err = r.ReadSlice(0)
+			}
+			if err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			n += int64(len(s))
+		}
+	}
+	if flg&2 != 0 {
+		n += 2
+	}
+	return n, nil
+}
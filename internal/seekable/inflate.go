@@ -0,0 +1,452 @@
+// Package seekable provides random access readers for compressed streams.
+package seekable
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// ErrCorrupt is returned when the compressed data is invalid.
+var ErrCorrupt = errors.New("seekable: corrupt compressed data")
+
+const (
+	windowSize  = 1 << 15
+	maxCodeLen  = 15
+	primaryBits = 9
+)
+
+var (
+	lenBase   = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lenExtra  = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase  = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	clenOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+var fixedLit, fixedDist huffman
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLit.init(lengths[:])
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	fixedDist.init(lengths[:30])
+}
+
+// huffman is a canonical Huffman decoder. Codes up to primaryBits are decoded by the table.
+type huffman struct {
+	counts  [maxCodeLen + 1]uint16
+	symbols []uint16
+	table   [1 << primaryBits]uint16 // symbol<<4 | length, 0: not in table
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	h.counts = [maxCodeLen + 1]uint16{}
+	for _, l := range lengths {
+		h.counts[l]++
+	}
+	h.counts[0] = 0
+	left := 1
+	for l := 1; l <= maxCodeLen; l++ {
+		left = left<<1 - int(h.counts[l])
+		if left < 0 {
+			return ErrCorrupt
+		}
+	}
+
+	var offs [maxCodeLen + 2]uint16
+	for l := 1; l <= maxCodeLen; l++ {
+		offs[l+1] = offs[l] + h.counts[l]
+	}
+	if cap(h.symbols) < len(lengths) {
+		h.symbols = make([]uint16, len(lengths))
+	}
+	h.symbols = h.symbols[:len(lengths)]
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbols[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	h.table = [1 << primaryBits]uint16{}
+	code, idx := 0, 0
+	for l := 1; l <= primaryBits; l++ {
+		for i := 0; i < int(h.counts[l]); i++ {
+			rev := 0
+			for b := 0; b < l; b++ {
+				rev |= (code >> b & 1) << (l - 1 - b)
+			}
+			for k := rev; k < len(h.table); k += 1 << l {
+				h.table[k] = h.symbols[idx]<<4 | uint16(l)
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+// inflater is a deflate decoder whose state at block boundaries can be saved and restored.
+type inflater struct {
+	src     io.ReaderAt
+	end     int64
+	r       *bufio.Reader
+	roffset int64 // offset of the next byte in src
+	bits    uint64
+	nbits   uint
+
+	hist [windowSize]byte // ring buffer of the output
+	hpos int              // write position in hist
+	rpos int              // read position in hist
+	out  int64            // total output size
+
+	final    bool
+	inBlock  bool
+	stored   int // remaining bytes in the stored block, -1: compressed block
+	lit      *huffman
+	dist     *huffman
+	dynLit   huffman
+	dynDist  huffman
+	copyLen  int
+	copyDist int
+	eof      bool
+
+	// onBoundary is called at every block boundary.
+	onBoundary func()
+}
+
+// newInflater returns an inflater for the deflate stream in src[start:end].
+func newInflater(src io.ReaderAt, start, end int64) *inflater {
+	f := &inflater{src: src, end: end}
+	f.r = bufio.NewReader(io.NewSectionReader(src, start, end-start))
+	f.roffset = start
+	return f
+}
+
+// bitPos returns the position of the next unread bit in src.
+func (f *inflater) bitPos() int64 {
+	return f.roffset*8 - int64(f.nbits)
+}
+
+// window returns the last 32KiB of the output.
+func (f *inflater) window() []byte {
+	if f.out > int64(f.hpos) {
+		return append(append([]byte{}, f.hist[f.hpos:]...), f.hist[:f.hpos]...)
+	}
+	return append([]byte{}, f.hist[:f.hpos]...)
+}
+
+// reset restarts decoding from a block boundary.
+func (f *inflater) reset(bitPos, out int64, window []byte) error {
+	start := bitPos / 8
+	f.r.Reset(io.NewSectionReader(f.src, start, f.end-start))
+	f.roffset = start
+	f.bits, f.nbits = 0, 0
+	f.hpos = copy(f.hist[:], window)
+	f.rpos = f.hpos
+	f.out = out
+	f.final, f.inBlock, f.eof = false, false, false
+	f.copyLen = 0
+	if n := uint(bitPos % 8); n > 0 {
+		if _, err := f.getBits(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *inflater) Read(p []byte) (int, error) {
+	for {
+		if f.rpos < f.hpos {
+			n := copy(p, f.hist[f.rpos:f.hpos])
+			f.rpos += n
+			return n, nil
+		}
+		if f.eof {
+			return 0, io.EOF
+		}
+		if f.hpos == windowSize {
+			f.hpos, f.rpos = 0, 0
+		}
+		if err := f.step(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (f *inflater) readByte() error {
+	c, err := f.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	f.roffset++
+	f.bits |= uint64(c) << f.nbits
+	f.nbits += 8
+	return nil
+}
+
+func (f *inflater) getBits(n uint) (uint32, error) {
+	for f.nbits < n {
+		if err := f.readByte(); err != nil {
+			return 0, err
+		}
+	}
+	v := uint32(f.bits & (1<<n - 1))
+	f.bits >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+func (f *inflater) decode(h *huffman) (int, error) {
+	for f.nbits < maxCodeLen {
+		if err := f.readByte(); err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if e := h.table[f.bits&(1<<primaryBits-1)]; e != 0 && uint(e&15) <= f.nbits {
+		f.bits >>= e & 15
+		f.nbits -= uint(e & 15)
+		return int(e >> 4), nil
+	}
+	code, first, index := 0, 0, 0
+	bits := f.bits
+	for l := uint(1); l <= maxCodeLen; l++ {
+		if l > f.nbits {
+			return 0, io.ErrUnexpectedEOF
+		}
+		code |= int(bits & 1)
+		bits >>= 1
+		count := int(h.counts[l])
+		if code-count < first {
+			f.bits >>= l
+			f.nbits -= l
+			return int(h.symbols[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, ErrCorrupt
+}
+
+func (f *inflater) readHeader() error {
+	h, err := f.getBits(3)
+	if err != nil {
+		return err
+	}
+	f.final = h&1 != 0
+	switch h >> 1 {
+	case 0:
+		f.bits >>= f.nbits % 8
+		f.nbits -= f.nbits % 8
+		v, err := f.getBits(32)
+		if err != nil {
+			return err
+		}
+		if uint16(v) != ^uint16(v>>16) {
+			return ErrCorrupt
+		}
+		f.stored = int(v & 0xffff)
+	case 1:
+		f.stored = -1
+		f.lit, f.dist = &fixedLit, &fixedDist
+	case 2:
+		f.stored = -1
+		if err := f.readDynamicTables(); err != nil {
+			return err
+		}
+		f.lit, f.dist = &f.dynLit, &f.dynDist
+	default:
+		return ErrCorrupt
+	}
+	f.inBlock = true
+	return nil
+}
+
+func (f *inflater) readDynamicTables() error {
+	v, err := f.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlit, ndist, nclen := int(v&31)+257, int(v>>5&31)+1, int(v>>10)+4
+	if nlit > 286 || ndist > 30 {
+		return ErrCorrupt
+	}
+	var lengths [286 + 30]uint8
+	for i := 0; i < nclen; i++ {
+		l, err := f.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[clenOrder[i]] = uint8(l)
+	}
+	var clen huffman
+	if err := clen.init(lengths[:19]); err != nil {
+		return err
+	}
+	lengths = [286 + 30]uint8{}
+	for i := 0; i < nlit+ndist; {
+		sym, err := f.decode(&clen)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var rep uint32
+		var val uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return ErrCorrupt
+			}
+			val = lengths[i-1]
+			rep, err = f.getBits(2)
+			rep += 3
+		case 17:
+			rep, err = f.getBits(3)
+			rep += 3
+		default:
+			rep, err = f.getBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > nlit+ndist {
+			return ErrCorrupt
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = val
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return ErrCorrupt
+	}
+	if err := f.dynLit.init(lengths[:nlit]); err != nil {
+		return err
+	}
+	return f.dynDist.init(lengths[nlit : nlit+ndist])
+}
+
+// step decodes until the end of the block or the history buffer is full.
+func (f *inflater) step() error {
+	if !f.inBlock {
+		if f.final {
+			f.eof = true
+			return nil
+		}
+		if f.onBoundary != nil {
+			f.onBoundary()
+		}
+		if err := f.readHeader(); err != nil {
+			return err
+		}
+	}
+
+	if f.stored >= 0 {
+		for f.stored > 0 && f.hpos < windowSize {
+			if f.nbits >= 8 {
+				f.hist[f.hpos] = byte(f.bits)
+				f.bits >>= 8
+				f.nbits -= 8
+				f.hpos++
+				f.out++
+				f.stored--
+				continue
+			}
+			n := windowSize - f.hpos
+			if n > f.stored {
+				n = f.stored
+			}
+			n, err := io.ReadFull(f.r, f.hist[f.hpos:f.hpos+n])
+			f.roffset += int64(n)
+			f.hpos += n
+			f.out += int64(n)
+			f.stored -= n
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+		f.inBlock = f.stored > 0
+		return nil
+	}
+
+	for f.hpos < windowSize {
+		if f.copyLen > 0 {
+			for f.copyLen > 0 && f.hpos < windowSize {
+				f.hist[f.hpos] = f.hist[(f.hpos-f.copyDist)&(windowSize-1)]
+				f.hpos++
+				f.copyLen--
+			}
+			continue
+		}
+		sym, err := f.decode(f.lit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			f.hist[f.hpos] = byte(sym)
+			f.hpos++
+			f.out++
+			continue
+		case sym == 256:
+			f.inBlock = false
+			return nil
+		case sym > 285:
+			return ErrCorrupt
+		}
+		sym -= 257
+		extra, err := f.getBits(uint(lenExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lenBase[sym]) + int(extra)
+		dsym, err := f.decode(f.dist)
+		if err != nil {
+			return err
+		}
+		if dsym >= 30 {
+			return ErrCorrupt
+		}
+		extra, err = f.getBits(uint(distExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[dsym]) + int(extra)
+		if int64(dist) > f.out {
+			return ErrCorrupt
+		}
+		f.copyLen, f.copyDist = length, dist
+		f.out += int64(length)
+	}
+	return nil
+}
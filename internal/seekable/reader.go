@@ -0,0 +1,164 @@
+package seekable
+
+import (
+	"io"
+	"sync"
+)
+
+// Checkpoint limits. The interval is doubled when the number of checkpoints exceeds MaxCheckpoints,
+// so a reader keeps at most MaxCheckpoints windows (32KiB each) regardless of the stream size.
+var (
+	CheckpointInterval int64 = 1 << 20
+	MaxCheckpoints           = 32
+)
+
+// checkpoint is a position where decoding can be restarted.
+type checkpoint struct {
+	in     int64 // position in the compressed stream (in bits for deflate)
+	out    int64
+	window []byte
+}
+
+// decoder is a decompressor which can restart from checkpoints.
+type decoder interface {
+	io.Reader
+	// reset restarts decoding from the checkpoint. (nil: beginning of the stream)
+	reset(cp *checkpoint) error
+}
+
+// Reader provides random access to a compressed stream.
+// Checkpoints are recorded while reading, and reads restart from the nearest checkpoint.
+type Reader struct {
+	lock        sync.Mutex
+	dec         decoder
+	size        int64 // -1: unknown
+	pos         int64 // output position of dec
+	active      bool
+	checkpoints []checkpoint
+	interval    int64
+}
+
+func newReader(dec decoder, size int64) *Reader {
+	return &Reader{dec: dec, size: size, interval: CheckpointInterval}
+}
+
+// Size returns the uncompressed size. It returns -1 if the size is unknown until the end of the stream is read.
+func (r *Reader) Size() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.size
+}
+
+// addCheckpoint is called by decoders at positions where decoding can be restarted.
+func (r *Reader) addCheckpoint(in, out int64, window func() []byte) {
+	last := int64(0)
+	if len(r.checkpoints) > 0 {
+		last = r.checkpoints[len(r.checkpoints)-1].out
+	}
+	if out < last+r.interval {
+		return
+	}
+	cp := checkpoint{in: in, out: out}
+	if window != nil {
+		cp.window = window()
+	}
+	r.checkpoints = append(r.checkpoints, cp)
+	if len(r.checkpoints) > MaxCheckpoints {
+		n := 0
+		for i := 1; i < len(r.checkpoints); i += 2 {
+			r.checkpoints[n] = r.checkpoints[i]
+			n++
+		}
+		for i := n; i < len(r.checkpoints); i++ {
+			r.checkpoints[i] = checkpoint{}
+		}
+		r.checkpoints = r.checkpoints[:n]
+		r.interval *= 2
+	}
+}
+
+// seek prepares the decoder to read from off.
+func (r *Reader) seek(off int64) error {
+	var cp *checkpoint
+	for i := range r.checkpoints {
+		if r.checkpoints[i].out > off {
+			break
+		}
+		cp = &r.checkpoints[i]
+	}
+	if r.active && r.pos <= off && (cp == nil || cp.out <= r.pos || off-r.pos < r.interval) {
+		return nil
+	}
+	r.pos = 0
+	if cp != nil {
+		r.pos = cp.out
+	}
+	if err := r.dec.reset(cp); err != nil {
+		return err
+	}
+	r.active = true
+	return nil
+}
+
+// read reads len(p) bytes unless the stream ends.
+func (r *Reader) read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := r.dec.Read(p[n:])
+		n += m
+		r.pos += int64(m)
+		if err == io.EOF {
+			r.active = false
+			if r.size < 0 {
+				r.size = r.pos
+				return n, io.EOF
+			}
+			if r.pos < r.size {
+				return n, io.ErrUnexpectedEOF
+			}
+			return n, io.EOF
+		} else if err != nil {
+			r.active = false
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.size >= 0 && off >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.seek(off); err != nil {
+		r.active = false
+		return 0, err
+	}
+	var buf [8192]byte
+	for r.pos < off {
+		n := off - r.pos
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if _, err := r.read(buf[:n]); err != nil {
+			return 0, err
+		}
+	}
+	if r.size >= 0 && int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+	}
+	n, err := r.read(p)
+	if err == nil && r.size >= 0 && off+int64(n) >= r.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close releases the decoder.
+func (r *Reader) Close() error {
+	if c, ok := r.dec.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package seekable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"hello", "world", "zip", "volume", "\n", " ", "0123456789"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		if rnd.Intn(10) == 0 {
+			b := make([]byte, rnd.Intn(300))
+			rnd.Read(b)
+			buf.Write(b)
+		} else {
+			buf.WriteString(words[rnd.Intn(len(words))])
+		}
+	}
+	return buf.Bytes()[:size]
+}
+
+func compress(t *testing.T, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDeflateReader(t *testing.T) {
+	savedInterval, savedMax := CheckpointInterval, MaxCheckpoints
+	CheckpointInterval, MaxCheckpoints = 64*1024, 4
+	defer func() { CheckpointInterval, MaxCheckpoints = savedInterval, savedMax }()
+
+	data := testData(3 << 20)
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.HuffmanOnly} {
+		compressed := compress(t, data, level)
+		// put some garbage around the stream.
+		src := append(append([]byte("header"), compressed...), "trailer"...)
+		r := NewDeflateReader(bytes.NewReader(src), 6, int64(len(compressed)), int64(len(data)))
+
+		all, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil || !bytes.Equal(all, data) {
+			t.Fatalf("level %d: sequential read failed: %v", level, err)
+		}
+		if len(r.checkpoints) == 0 || len(r.checkpoints) > MaxCheckpoints {
+			t.Errorf("level %d: unexpected checkpoints: %d", level, len(r.checkpoints))
+		}
+
+		rnd := rand.New(rand.NewSource(int64(level)))
+		for i := 0; i < 50; i++ {
+			off := rnd.Int63n(int64(len(data)))
+			b := make([]byte, rnd.Intn(100000))
+			n, err := r.ReadAt(b, off)
+			if err != nil && err != io.EOF {
+				t.Fatalf("level %d: ReadAt(%d) error: %v", level, off, err)
+			}
+			if n != len(b) && err != io.EOF {
+				t.Fatalf("level %d: short read %d", level, n)
+			}
+			if !bytes.Equal(b[:n], data[off:off+int64(n)]) {
+				t.Fatalf("level %d: ReadAt(%d) unexpected data", level, off)
+			}
+		}
+	}
+}
+
+func TestDeflateReader_Corrupt(t *testing.T) {
+	data := testData(100000)
+	compressed := compress(t, data, flate.DefaultCompression)
+	r := NewDeflateReader(bytes.NewReader(compressed[:len(compressed)/2]), 0, int64(len(compressed)/2), int64(len(data)))
+	if _, err := r.ReadAt(make([]byte, 10), int64(len(data)-10)); err == nil {
+		t.Errorf("ReadAt should fail")
+	}
+}
+
+func testReadAt(t *testing.T, r *Reader, data []byte) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		off := rnd.Int63n(int64(len(data)))
+		b := make([]byte, rnd.Intn(100000))
+		n, err := r.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d) error: %v", off, err)
+		}
+		if n != len(b) && off+int64(n) != int64(len(data)) {
+			t.Fatalf("ReadAt(%d): short read %d", off, n)
+		}
+		if !bytes.Equal(b[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%d) unexpected data", off)
+		}
+	}
+}
+
+func TestGzipReader(t *testing.T) {
+	savedInterval := CheckpointInterval
+	CheckpointInterval = 64 * 1024
+	defer func() { CheckpointInterval = savedInterval }()
+
+	data := testData(1 << 20)
+	var buf bytes.Buffer
+	// multiple members with a header name.
+	for _, part := range [][]byte{data[:300000], data[300000:]} {
+		w := gzip.NewWriter(&buf)
+		w.Name = "test.txt"
+		w.Write(part)
+		w.Close()
+	}
+	r, err := NewGzipReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != -1 {
+		t.Errorf("size should be unknown: %v", r.Size())
+	}
+	testReadAt(t, r, data)
+	if r.Size() != int64(len(data)) {
+		t.Errorf("unexpected size: %v", r.Size())
+	}
+
+	if _, err := NewGzipReader(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Errorf("NewGzipReader should fail for non-gzip data")
+	}
+
+	// broken CRC
+	broken := append([]byte{}, buf.Bytes()...)
+	broken[len(broken)-8] ^= 1
+	r, err = NewGzipReader(bytes.NewReader(broken), int64(len(broken)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(io.NewSectionReader(r, 0, int64(len(data))+1)); err != gzip.ErrChecksum {
+		t.Errorf("ReadAll should return ErrChecksum: %v", err)
+	}
+}
+
+func TestZstdReader(t *testing.T) {
+	savedInterval := CheckpointInterval
+	CheckpointInterval = 64 * 1024
+	defer func() { CheckpointInterval = savedInterval }()
+
+	data := testData(1 << 20)
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(nil)
+	for i := 0; i < len(data); i += 100000 {
+		end := i + 100000
+		if end > len(data) {
+			end = len(data)
+		}
+		buf.Write(w.EncodeAll(data[i:end], nil))
+		// skippable frame
+		buf.Write([]byte{0x50, 0x2a, 0x4d, 0x18, 2, 0, 0, 0, 0, 0})
+	}
+	r, err := NewZstdReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	testReadAt(t, r, data)
+	if len(r.checkpoints) == 0 {
+		t.Errorf("no checkpoints")
+	}
+}
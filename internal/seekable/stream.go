@@ -0,0 +1,83 @@
+package seekable
+
+import (
+	"io"
+	"sync"
+)
+
+// StreamReader provides random access to a stream by reopening it for backward reads.
+type StreamReader struct {
+	lock sync.Mutex
+	open func() (io.ReadCloser, error)
+	size int64
+	r    io.ReadCloser
+	pos  int64
+}
+
+// NewStreamReader returns a reader for the stream. size is the size of the stream.
+func NewStreamReader(open func() (io.ReadCloser, error), size int64) *StreamReader {
+	return &StreamReader{open: open, size: size}
+}
+
+// Size returns the size of the stream.
+func (r *StreamReader) Size() int64 {
+	return r.size
+}
+
+func (r *StreamReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.r == nil || off < r.pos {
+		if r.r != nil {
+			r.r.Close()
+		}
+		rc, err := r.open()
+		if err != nil {
+			r.r = nil
+			return 0, err
+		}
+		r.r, r.pos = rc, 0
+	}
+	if off > r.pos {
+		n, err := io.CopyN(io.Discard, r.r, off-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	if rest := r.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := io.ReadFull(r.r, p)
+	r.pos += int64(n)
+	if err != nil {
+		return n, r.fail(err)
+	}
+	if off+int64(n) >= r.size {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *StreamReader) fail(err error) error {
+	r.r.Close()
+	r.r = nil
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Close closes the underlying stream.
+func (r *StreamReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.r != nil {
+		r.r.Close()
+		r.r = nil
+	}
+	return nil
+}
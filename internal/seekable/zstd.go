@@ -0,0 +1,141 @@
+package seekable
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDecoder decodes zstd frames one by one. Frames are independent, so checkpoints are recorded at frame boundaries.
+type zstdDecoder struct {
+	r       *Reader
+	src     io.ReaderAt
+	end     int64
+	dec     *zstd.Decoder
+	next    int64 // offset of the next frame
+	inFrame bool
+}
+
+// NewZstdReader returns a reader for the zstd stream in src[0:csize].
+// Decoding can be restarted only at frame boundaries. A stream with a single frame (the default of the zstd command)
+// is decoded from the beginning on every backward seek. Streams with many small frames (e.g. by pzstd) are seekable.
+func NewZstdReader(src io.ReaderAt, csize int64) (*Reader, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	d := &zstdDecoder{src: src, end: csize, dec: dec}
+	d.r = newReader(d, -1)
+	return d.r, nil
+}
+
+func (d *zstdDecoder) reset(cp *checkpoint) error {
+	d.next, d.inFrame = 0, false
+	if cp != nil {
+		d.next = cp.in
+	}
+	return nil
+}
+
+func (d *zstdDecoder) Read(p []byte) (int, error) {
+	for {
+		if !d.inFrame {
+			if d.next >= d.end {
+				return 0, io.EOF
+			}
+			size, skippable, err := zstdFrameSize(d.src, d.next, d.end)
+			if err != nil {
+				return 0, err
+			}
+			if !skippable {
+				d.r.addCheckpoint(d.next, d.r.pos, nil)
+				if err := d.dec.Reset(io.NewSectionReader(d.src, d.next, size)); err != nil {
+					return 0, err
+				}
+				d.inFrame = true
+			}
+			d.next += size
+			continue
+		}
+		n, err := d.dec.Read(p)
+		if err == io.EOF {
+			d.inFrame = false
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (d *zstdDecoder) Close() error {
+	d.dec.Close()
+	return nil
+}
+
+// zstdFrameSize returns the size of the frame at off by reading the frame and block headers.
+func zstdFrameSize(src io.ReaderAt, off, end int64) (int64, bool, error) {
+	var b [8]byte
+	read := func(pos int64, n int) error {
+		if pos+int64(n) > end {
+			return io.ErrUnexpectedEOF
+		}
+		_, err := src.ReadAt(b[:n], pos)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := read(off, 5); err != nil {
+		return 0, false, err
+	}
+	magic := binary.LittleEndian.Uint32(b[:])
+	if magic&0xfffffff0 == 0x184d2a50 {
+		if err := read(off+4, 4); err != nil {
+			return 0, false, err
+		}
+		return 8 + int64(binary.LittleEndian.Uint32(b[:])), true, nil
+	}
+	if magic != 0xfd2fb528 {
+		return 0, false, ErrCorrupt
+	}
+	fhd := b[4]
+	single := fhd>>5&1 != 0
+	pos := off + 5
+	if !single {
+		pos++
+	}
+	pos += [...]int64{0, 1, 2, 4}[fhd&3]
+	fcs := [...]int64{0, 2, 4, 8}[fhd>>6]
+	if fcs == 0 && single {
+		fcs = 1
+	}
+	pos += fcs
+	for {
+		if err := read(pos, 3); err != nil {
+			return 0, false, err
+		}
+		h := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		pos += 3
+		switch h >> 1 & 3 {
+		case 0, 2:
+			pos += int64(h >> 3)
+		case 1:
+			pos++
+		default:
+			return 0, false, ErrCorrupt
+		}
+		if h&1 != 0 {
+			break
+		}
+	}
+	if fhd>>2&1 != 0 {
+		pos += 4
+	}
+	if pos > end {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	return pos - off, false, nil
+}
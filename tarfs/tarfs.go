@@ -0,0 +1,457 @@
+// Package tarfs provides a read-only fs.FS for tar, tar.gz and tar.zst archives.
+package tarfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/binzume/cfs/internal/arcache"
+	"github.com/binzume/cfs/internal/seekable"
+)
+
+// Limits of the parsed index cache. Archives with more entries than CacheMaxEntries are not cached.
+// Unused archives are closed after CacheIdleTimeout, so that the files can be removed or renamed. (0: never)
+var (
+	CacheMaxArchives = 16
+	CacheMaxEntries  = 200000
+	CacheIdleTimeout = 30 * time.Second
+)
+
+var archiveCache = arcache.New()
+
+// Purge closes and removes all unused archives from the cache.
+func Purge() {
+	archiveCache.Purge()
+}
+
+type TarFS struct {
+	fsys fs.FS
+	path string
+}
+
+// NewFS returns a new FS. (fsys = nil : native path)
+// The compression (gzip or zstd) is detected from the content.
+// zstd streams are seekable only at frame boundaries, so files in a single-frame tar.zst (the default of the zstd command)
+// are decoded from the beginning of the archive. Archives with many small frames (e.g. by pzstd) are read faster.
+func NewFS(path string, fsys fs.FS) fs.StatFS {
+	return &TarFS{fsys: fsys, path: path}
+}
+
+// CacheKey implements arcache.Keyer, so archives in this archive are cached.
+func (v *TarFS) CacheKey() (interface{}, bool) {
+	k, ok := arcache.KeyOf(v.fsys)
+	return arcache.Key{FS: k, Path: v.path}, ok
+}
+
+// IsTarFile returns true if the name has a tar extension.
+func IsTarFile(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tzst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarIndex is a directory tree of the archive.
+type tarIndex struct {
+	entries map[string]*tarEntry
+	modTime time.Time
+	content io.ReaderAt // uncompressed tar stream
+}
+
+type tarEntry struct {
+	path     string
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	dir      bool
+	children []*tarEntry
+
+	dataOff  int64
+	sparse   bool
+	hdrOff   int64 // offset of a header before this entry
+	skip     int   // number of entries between hdrOff and this entry
+	linkname string
+	typeflag byte
+}
+
+func (e *tarEntry) Name() string {
+	if e.path == "" {
+		return "."
+	}
+	return path.Base(e.path)
+}
+
+func (e *tarEntry) Size() int64 {
+	if e.dir {
+		return 0
+	}
+	return e.size
+}
+
+func (e *tarEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | e.mode.Perm()
+	}
+	return e.mode
+}
+
+func (e *tarEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *tarEntry) IsDir() bool {
+	return e.dir
+}
+
+func (e *tarEntry) Sys() interface{} {
+	return nil
+}
+
+func (e *tarEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e *tarEntry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// normalizeName returns the slash-separated path of the entry name without leading "/" or "./".
+func normalizeName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func newTarIndex(content io.ReaderAt, size int64, modTime time.Time) (*tarIndex, error) {
+	idx := &tarIndex{entries: map[string]*tarEntry{}, modTime: modTime, content: content}
+	idx.entries[""] = &tarEntry{path: "", dir: true, mode: 0555, modTime: modTime}
+
+	sr := io.NewSectionReader(content, 0, size)
+	tr := tar.NewReader(sr)
+	var boundary int64
+	skip := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		dataOff, _ := sr.Seek(0, io.SeekCurrent)
+		e := &tarEntry{
+			mode:     hdr.FileInfo().Mode(),
+			size:     hdr.Size,
+			modTime:  hdr.ModTime,
+			dataOff:  dataOff,
+			hdrOff:   boundary,
+			skip:     skip,
+			linkname: hdr.Linkname,
+			typeflag: hdr.Typeflag,
+		}
+		for k := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "GNU.sparse.") {
+				e.sparse = true
+			}
+		}
+		if hdr.Typeflag == tar.TypeGNUSparse {
+			e.sparse = true
+		}
+		if e.sparse || hdr.Typeflag == tar.TypeXGlobalHeader {
+			// the size in the archive is unknown.
+			skip++
+		} else {
+			boundary, skip = (dataOff+hdr.Size+511)&^511, 0
+		}
+		name := normalizeName(hdr.Name)
+		if name == "" || hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			d := idx.dir(name)
+			d.mode, d.modTime = e.mode, e.modTime
+			continue
+		}
+		e.path = name
+		if old, exists := idx.entries[name]; exists {
+			if old.dir {
+				continue
+			}
+			// later entries replace earlier ones.
+			*old = *e
+			continue
+		}
+		idx.entries[name] = e
+		parent := idx.dir(path.Dir("/" + name)[1:])
+		parent.children = append(parent.children, e)
+	}
+	for _, e := range idx.entries {
+		if e.typeflag == tar.TypeLink {
+			if t, ok := idx.entries[normalizeName(e.linkname)]; ok && !t.dir {
+				e.size, e.dataOff, e.sparse, e.hdrOff, e.skip = t.size, t.dataOff, t.sparse, t.hdrOff, t.skip
+				e.mode = t.mode
+			}
+		}
+		sort.Slice(e.children, func(i, j int) bool { return e.children[i].path < e.children[j].path })
+	}
+	return idx, nil
+}
+
+// dir returns the directory entry. Missing parent directories are synthesized.
+func (idx *tarIndex) dir(name string) *tarEntry {
+	if e, ok := idx.entries[name]; ok {
+		e.dir = true
+		return e
+	}
+	e := &tarEntry{path: name, dir: true, mode: 0555, modTime: idx.modTime}
+	idx.entries[name] = e
+	parent := idx.dir(path.Dir("/" + name)[1:])
+	parent.children = append(parent.children, e)
+	return e
+}
+
+// contentReader returns a ReaderAt of the file content.
+func (idx *tarIndex) contentReader(e *tarEntry) io.ReaderAt {
+	if !e.sparse {
+		return io.NewSectionReader(idx.content, e.dataOff, e.size)
+	}
+	return seekable.NewStreamReader(func() (io.ReadCloser, error) {
+		tr := tar.NewReader(io.NewSectionReader(idx.content, e.hdrOff, 1<<62))
+		for i := 0; i <= e.skip; i++ {
+			if _, err := tr.Next(); err != nil {
+				return nil, err
+			}
+		}
+		return ioutil.NopCloser(tr), nil
+	}, e.size)
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
+	for _, cl := range c {
+		cl.Close()
+	}
+	return nil
+}
+
+func loadArchive(fsys fs.FS, path string, stat fs.FileInfo) (*arcache.Archive, error) {
+	var fr fs.File
+	var err error
+	if fsys != nil {
+		fr, err = fsys.Open(path)
+	} else {
+		fr, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readerAt, ok := fr.(io.ReaderAt)
+	if !ok {
+		fr.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("ReaderAt not implemented")}
+	}
+
+	content, size, closer, err := decompress(readerAt, stat.Size())
+	if err != nil {
+		fr.Close()
+		return nil, err
+	}
+	idx, err := newTarIndex(content, size, stat.ModTime())
+	if err != nil {
+		closers{closer, fr}.Close()
+		return nil, err
+	}
+	return &arcache.Archive{Index: idx, Entries: len(idx.entries), Closer: closers{closer, fr}}, nil
+}
+
+// decompress detects the compression by the magic number.
+func decompress(r io.ReaderAt, size int64) (io.ReaderAt, int64, io.Closer, error) {
+	var magic [4]byte
+	n, _ := r.ReadAt(magic[:], 0)
+	switch {
+	case n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := seekable.NewGzipReader(r, size)
+		return gr, 1 << 62, gr, err
+	case n == 4 && string(magic[:]) == "\x28\xb5\x2f\xfd":
+		zr, err := seekable.NewZstdReader(r, size)
+		return zr, 1 << 62, zr, err
+	}
+	return r, size, ioutil.NopCloser(nil), nil
+}
+
+func (v *TarFS) statTar() (fs.FileInfo, error) {
+	if v.fsys != nil {
+		return fs.Stat(v.fsys, v.path)
+	}
+	return os.Stat(v.path)
+}
+
+// openTar returns the index of the archive. The returned closer must be closed after use.
+func (v *TarFS) openTar() (io.Closer, *tarIndex, error) {
+	stat, err := v.statTar()
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, err := archiveCache.Open(v.fsys, v.path, "", stat, CacheMaxArchives, CacheMaxEntries, CacheIdleTimeout, func() (*arcache.Archive, error) {
+		return loadArchive(v.fsys, v.path, stat)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, ref.Index.(*tarIndex), nil
+}
+
+// entryPath validates the path. "" is also accepted as the root.
+func entryPath(op, path string) (string, error) {
+	if path == "" || path == "." {
+		return "", nil
+	}
+	if !fs.ValidPath(path) {
+		return "", &fs.PathError{Op: op, Path: path, Err: fs.ErrInvalid}
+	}
+	return path, nil
+}
+
+func (v *TarFS) Stat(path string) (fs.FileInfo, error) {
+	path, err := entryPath("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	closer, idx, err := v.openTar()
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	if e, ok := idx.entries[path]; ok {
+		return e, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+}
+
+func (v *TarFS) ReadDir(path string) ([]fs.DirEntry, error) {
+	name, err := entryPath("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	closer, idx, err := v.openTar()
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	e, ok := idx.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: fs.ErrNotExist}
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: errors.New("not a directory")}
+	}
+	return e.dirEntries(), nil
+}
+
+func (e *tarEntry) dirEntries() []fs.DirEntry {
+	files := []fs.DirEntry{}
+	for _, c := range e.children {
+		files = append(files, c)
+	}
+	return files
+}
+
+func (v *TarFS) Open(path string) (fs.File, error) {
+	path, err := entryPath("open", path)
+	if err != nil {
+		return nil, err
+	}
+	closer, idx, err := v.openTar()
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := idx.entries[path]
+	if !ok {
+		closer.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	if e.dir {
+		closer.Close()
+		return &tarDir{entry: e, entries: e.dirEntries()}, nil
+	}
+	return &tarFileReader{reader: idx.contentReader(e), parentCloser: closer, entry: e}, nil
+}
+
+type tarFileReader struct {
+	reader       io.ReaderAt
+	parentCloser io.Closer
+	readPos      int64
+	entry        *tarEntry
+}
+
+func (r *tarFileReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.readPos)
+	r.readPos += int64(n)
+	return n, err
+}
+
+func (r *tarFileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.entry.size {
+		return 0, io.EOF
+	}
+	return r.reader.ReadAt(p, off)
+}
+
+func (r *tarFileReader) Stat() (fs.FileInfo, error) {
+	return r.entry, nil
+}
+
+func (r *tarFileReader) Close() error {
+	if c, ok := r.reader.(io.Closer); ok {
+		c.Close()
+	}
+	return r.parentCloser.Close()
+}
+
+// tarDir is an opened directory in the archive.
+type tarDir struct {
+	entry   *tarEntry
+	entries []fs.DirEntry
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) {
+	return d.entry, nil
+}
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.path, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) Close() error {
+	return nil
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,131 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testTarEntry struct {
+	name string
+	data string
+	link string
+}
+
+var testEntries = []testTarEntry{
+	{name: "./a/b/c.txt", data: "Hello"},
+	{name: "a/d/"},
+	{name: "e.txt", data: "old"},
+	{name: "e.txt", data: "World"},
+	{name: "f.txt", link: "a/b/c.txt"},
+}
+
+func createTestTar(t *testing.T, entries []testTarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), ModTime: time.Unix(1600000000, 0), Typeflag: tar.TypeReg}
+		if e.name[len(e.name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		} else if e.link != "" {
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTarFS(t *testing.T) {
+	data := createTestTar(t, testEntries)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+
+	zw, _ := zstd.NewWriter(nil)
+	zst := zw.EncodeAll(data, nil)
+
+	for name, archive := range map[string][]byte{"test.tar": data, "test.tar.gz": gz.Bytes(), "test.tar.zst": zst} {
+		vol := NewFS(writeTestFile(t, name, archive), nil)
+		if err := fstest.TestFS(vol, "a/b/c.txt", "a/d", "e.txt", "f.txt"); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		for path, expected := range map[string]string{"a/b/c.txt": "Hello", "e.txt": "World", "f.txt": "Hello"} {
+			b, err := fs.ReadFile(vol, path)
+			if err != nil || string(b) != expected {
+				t.Errorf("%v: ReadFile(%v): %q %v", name, path, b, err)
+			}
+		}
+		if _, err := vol.Stat("c.txt"); !os.IsNotExist(err) {
+			t.Errorf("%v: Stat should return ErrNotExist: %v", name, err)
+		}
+		stat, err := vol.Stat("a/b")
+		if err != nil || !stat.IsDir() {
+			t.Errorf("%v: a/b should be a directory: %v", name, err)
+		}
+	}
+	Purge()
+}
+
+func TestTarFS_ReadAt(t *testing.T) {
+	content := make([]byte, 3<<20)
+	for i := range content {
+		content[i] = byte(i*7 + i/1000)
+	}
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		w.Write(content)
+	}
+	w.Close()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(buf.Bytes())
+	gw.Close()
+
+	vol := NewFS(writeTestFile(t, "test.tgz", gz.Bytes()), nil)
+	defer Purge()
+	r, err := vol.Open("b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ra := r.(io.ReaderAt)
+	for _, off := range []int64{2000000, 10, 3000000, 0, int64(len(content)) - 100} {
+		b := make([]byte, 1000)
+		n, err := ra.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%v) error: %v", off, err)
+		}
+		if !bytes.Equal(b[:n], content[off:off+int64(n)]) {
+			t.Errorf("ReadAt(%v) unexpected data", off)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package volume
+
+import (
+	"context"
+	"os"
+)
+
+// VolumeReaderContext is a context-aware version of VolumeReader.
+type VolumeReaderContext interface {
+	ReadDirContext(ctx context.Context, path string) ([]*FileInfo, error)
+	StatContext(ctx context.Context, path string) (*FileInfo, error)
+	OpenContext(ctx context.Context, path string) (reader FileReadCloser, err error)
+}
+
+// VolumeWriterContext is a context-aware version of VolumeWriter.
+type VolumeWriterContext interface {
+	OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (f File, err error)
+	RemoveContext(ctx context.Context, path string) error
+	MkdirContext(ctx context.Context, path string, mode os.FileMode) error
+}
+
+type ContextVolume interface {
+	VolumeReaderContext
+	VolumeWriterContext
+}
+
+type contextVolumeWrapper struct {
+	fs  FS
+	raw Volume
+}
+
+// ToContextVolume returns a ContextVolume. Volumes without context support are called after checking ctx.Err().
+func ToContextVolume(v Volume) ContextVolume {
+	if cv, ok := v.(ContextVolume); ok {
+		return cv
+	}
+	return &contextVolumeWrapper{fs: ToFS(v), raw: UnwrapVolume(v)}
+}
+
+func (v *contextVolumeWrapper) ReadDirContext(ctx context.Context, path string) ([]*FileInfo, error) {
+	if r, ok := v.raw.(VolumeReaderContext); ok {
+		return r.ReadDirContext(ctx, path)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.fs.ReadDir(path)
+}
+
+func (v *contextVolumeWrapper) StatContext(ctx context.Context, path string) (*FileInfo, error) {
+	if r, ok := v.raw.(VolumeReaderContext); ok {
+		return r.StatContext(ctx, path)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.fs.Stat(path)
+}
+
+func (v *contextVolumeWrapper) OpenContext(ctx context.Context, path string) (FileReadCloser, error) {
+	if r, ok := v.raw.(VolumeReaderContext); ok {
+		return r.OpenContext(ctx, path)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.fs.Open(path)
+}
+
+func (v *contextVolumeWrapper) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (File, error) {
+	if w, ok := v.raw.(VolumeWriterContext); ok {
+		return w.OpenFileContext(ctx, path, flag, perm)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.fs.OpenFile(path, flag, perm)
+}
+
+func (v *contextVolumeWrapper) RemoveContext(ctx context.Context, path string) error {
+	if w, ok := v.raw.(VolumeWriterContext); ok {
+		return w.RemoveContext(ctx, path)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return v.fs.Remove(path)
+}
+
+func (v *contextVolumeWrapper) MkdirContext(ctx context.Context, path string, mode os.FileMode) error {
+	if w, ok := v.raw.(VolumeWriterContext); ok {
+		return w.MkdirContext(ctx, path, mode)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return v.fs.Mkdir(path, mode)
+}
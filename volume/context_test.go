@@ -0,0 +1,65 @@
+package volume
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestToContextVolume(t *testing.T) {
+	vol := ToContextVolume(FromFS(fstest.MapFS{
+		"hello.txt": &fstest.MapFile{Data: []byte("Hello")},
+	}))
+	ctx := context.Background()
+
+	stat, err := vol.StatContext(ctx, "hello.txt")
+	if err != nil {
+		t.Errorf("StatContext error: %v", err)
+	} else if stat.Size() != 5 {
+		t.Errorf("unexpected size: %v", stat.Size())
+	}
+	if _, err := vol.ReadDirContext(ctx, ""); err != nil {
+		t.Errorf("ReadDirContext error: %v", err)
+	}
+	r, err := vol.OpenContext(ctx, "hello.txt")
+	if err != nil {
+		t.Errorf("OpenContext error: %v", err)
+	} else {
+		r.Close()
+	}
+	if err := vol.MkdirContext(ctx, "dir", 0755); !os.IsPermission(err) {
+		t.Errorf("MkdirContext should return permission error: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := vol.StatContext(canceled, "hello.txt"); err != context.Canceled {
+		t.Errorf("StatContext should return context.Canceled: %v", err)
+	}
+	if _, err := vol.OpenContext(canceled, "hello.txt"); err != context.Canceled {
+		t.Errorf("OpenContext should return context.Canceled: %v", err)
+	}
+	if err := vol.RemoveContext(canceled, "hello.txt"); err != context.Canceled {
+		t.Errorf("RemoveContext should return context.Canceled: %v", err)
+	}
+}
+
+func TestVolumeGroup_Context(t *testing.T) {
+	var vol ContextVolume = newTestVolumeGroup()
+	if ToContextVolume(vol.(Volume)) != vol {
+		t.Errorf("VolumeGroup should implement ContextVolume")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := vol.StatContext(ctx, "mem/hoge2/hello.txt"); err != nil {
+		t.Errorf("StatContext error: %v", err)
+	}
+	cancel()
+	if _, err := vol.StatContext(ctx, "mem/hoge2/hello.txt"); err != context.Canceled {
+		t.Errorf("StatContext should return context.Canceled: %v", err)
+	}
+	if _, err := vol.ReadDirContext(ctx, "hoge"); err != context.Canceled {
+		t.Errorf("ReadDirContext should return context.Canceled: %v", err)
+	}
+}
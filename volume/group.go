@@ -1,17 +1,31 @@
 package volume
 
 import (
+	"context"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 type VolumeGroup struct {
 	vv   []volumeGroupEntry
 	lock sync.RWMutex
+
+	statLock   sync.Mutex
+	mountStats map[string]mountStat // attributes of the mount points.
+}
+
+type mountStat struct {
+	stat *FileInfo
+	time time.Time
 }
 
+// mountStatExpireTime limits the staleness of the mount point attributes changed without the group.
+var mountStatExpireTime = time.Second
+
 type volumeGroupEntry struct {
 	p string
 	v Volume
@@ -26,6 +40,7 @@ func (vg *VolumeGroup) AddVolume(path string, v Volume) {
 	vg.lock.Lock()
 	defer vg.lock.Unlock()
 	vg.vv = append(vg.vv, volumeGroupEntry{strings.TrimPrefix(path, "/"), v})
+	vg.clearMountStats()
 }
 
 func (vg *VolumeGroup) RemoveVolume(path string) bool {
@@ -35,6 +50,7 @@ func (vg *VolumeGroup) RemoveVolume(path string) bool {
 	for i, v := range vg.vv {
 		if v.p == path {
 			vg.vv = append(vg.vv[:i], vg.vv[i+1:]...)
+			vg.clearMountStats()
 			return true
 		}
 	}
@@ -45,6 +61,38 @@ func (vg *VolumeGroup) Clear() {
 	vg.lock.Lock()
 	defer vg.lock.Unlock()
 	vg.vv = nil
+	vg.clearMountStats()
+}
+
+func (vg *VolumeGroup) clearMountStats() {
+	vg.statLock.Lock()
+	vg.mountStats = nil
+	vg.statLock.Unlock()
+}
+
+// mountStat returns the attributes of the root of the mounted volume, so that ReadDir and Stat return the same entry.
+// They are cached because the parent directory is listed frequently and the volume may be remote.
+// The cache is cleared by the modifications through the group.
+func (vg *VolumeGroup) mountStat(ctx context.Context, e volumeGroupEntry, name string) *FileInfo {
+	vg.statLock.Lock()
+	ms, ok := vg.mountStats[e.p]
+	vg.statLock.Unlock()
+	if !ok || time.Since(ms.time) > mountStatExpireTime {
+		s, err := ToContextVolume(e.v).StatContext(ctx, "")
+		if err != nil || !s.IsDir() {
+			return &FileInfo{FileMode: os.ModeDir, Path: name}
+		}
+		ms = mountStat{stat: s, time: time.Now()}
+		vg.statLock.Lock()
+		if vg.mountStats == nil {
+			vg.mountStats = map[string]mountStat{}
+		}
+		vg.mountStats[e.p] = ms
+		vg.statLock.Unlock()
+	}
+	fi := *ms.stat
+	fi.Path = name
+	return &fi
 }
 
 func (vg *VolumeGroup) Resolve(path string) (FS, string, bool) {
@@ -52,8 +100,12 @@ func (vg *VolumeGroup) Resolve(path string) (FS, string, bool) {
 }
 
 func (vg *VolumeGroup) Stat(path string) (*FileInfo, error) {
+	return vg.StatContext(context.Background(), path)
+}
+
+func (vg *VolumeGroup) StatContext(ctx context.Context, path string) (*FileInfo, error) {
 	if v, p, ok := vg.resolve(path); ok {
-		stat, err := v.Stat(p)
+		stat, err := ToContextVolume(v).StatContext(ctx, p)
 		if stat != nil {
 			stat.Path = path
 		}
@@ -78,20 +130,73 @@ func (vg *VolumeGroup) Stat(path string) (*FileInfo, error) {
 }
 
 func (vg *VolumeGroup) Remove(path string) error {
+	return vg.RemoveContext(context.Background(), path)
+}
+
+func (vg *VolumeGroup) RemoveContext(ctx context.Context, path string) error {
+	defer vg.clearMountStats()
 	if v, p, ok := vg.resolve(path); ok {
-		return v.Remove(p)
+		return ToContextVolume(v).RemoveContext(ctx, p)
 	}
 	return noentError("Remove", path)
 }
 
+// Rename moves oldpath to newpath. If they belong to different volumes, the file is copied and then removed.
+// The partial copy is removed if copying fails. Permissions and mtime are copied if the destination supports them.
+func (vg *VolumeGroup) Rename(oldpath, newpath string) error {
+	defer vg.clearMountStats()
+	src, srcPath, srcMount, ok := vg.resolveMount(oldpath)
+	if !ok {
+		return noentError("Rename", oldpath)
+	}
+	dst, dstPath, dstMount, ok := vg.resolveMount(newpath)
+	if !ok {
+		return noentError("Rename", newpath)
+	}
+	if srcMount == dstMount {
+		return src.Rename(srcPath, dstPath)
+	}
+	return move(src, srcPath, dst, dstPath)
+}
+
+func (vg *VolumeGroup) Chmod(path string, mode os.FileMode) error {
+	defer vg.clearMountStats()
+	if v, p, ok := vg.resolve(path); ok {
+		return v.Chmod(p, mode)
+	}
+	return noentError("Chmod", path)
+}
+
+func (vg *VolumeGroup) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	defer vg.clearMountStats()
+	if v, p, ok := vg.resolve(path); ok {
+		return v.Chtimes(p, atime, mtime)
+	}
+	return noentError("Chtimes", path)
+}
+
+func (vg *VolumeGroup) Truncate(path string, size int64) error {
+	defer vg.clearMountStats()
+	if v, p, ok := vg.resolve(path); ok {
+		return v.Truncate(p, size)
+	}
+	return noentError("Truncate", path)
+}
+
 func (vg *VolumeGroup) Mkdir(path string, perm os.FileMode) error {
+	return vg.MkdirContext(context.Background(), path, perm)
+}
+
+func (vg *VolumeGroup) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	defer vg.clearMountStats()
 	if v, p, ok := vg.resolve(path); ok {
-		return v.Mkdir(p, perm)
+		return ToContextVolume(v).MkdirContext(ctx, p, perm)
 	}
 	return noentError("Mkdir", path)
 }
 
 func (vg *VolumeGroup) Create(path string) (FileWriteCloser, error) {
+	defer vg.clearMountStats()
 	if v, p, ok := vg.resolve(path); ok {
 		return v.Create(p)
 	}
@@ -99,21 +204,34 @@ func (vg *VolumeGroup) Create(path string) (FileWriteCloser, error) {
 }
 
 func (vg *VolumeGroup) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	return vg.OpenFileContext(context.Background(), path, flag, perm)
+}
+
+func (vg *VolumeGroup) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (File, error) {
+	if flag != os.O_RDONLY {
+		defer vg.clearMountStats()
+	}
 	if v, p, ok := vg.resolve(path); ok {
-		return v.OpenFile(p, flag, perm)
+		return ToContextVolume(v).OpenFileContext(ctx, p, flag, perm)
 	}
 	return nil, noentError("OpenFile", path)
 }
 
 func (vg *VolumeGroup) ReadDir(path string) ([]*FileInfo, error) {
+	return vg.ReadDirContext(context.Background(), path)
+}
+
+func (vg *VolumeGroup) ReadDirContext(ctx context.Context, path string) ([]*FileInfo, error) {
 	files := []*FileInfo{} // TODO uniq.
 
 	resolved := false
 	if v, p, ok := vg.resolve(path); ok {
-		ff, err := v.ReadDir(p)
+		ff, err := ToContextVolume(v).ReadDirContext(ctx, p)
 		if err == nil {
 			resolved = true
 			files = ff
+		} else if ctx.Err() != nil {
+			return nil, err
 		}
 	}
 
@@ -128,7 +246,11 @@ func (vg *VolumeGroup) ReadDir(path string) ([]*FileInfo, error) {
 	for _, e := range vg.vv {
 		if e.v.Available() && len(e.p) > len(path) && strings.HasPrefix(e.p, path) {
 			n := strings.Split(e.p[len(path):], "/")[0]
-			files = append(files, &FileInfo{FileMode: os.ModeDir, Path: n})
+			if e.p == path+n {
+				files = append(files, vg.mountStat(ctx, e, n))
+			} else {
+				files = append(files, &FileInfo{FileMode: os.ModeDir, Path: n})
+			}
 		}
 	}
 	if !resolved && len(files) == 0 {
@@ -138,8 +260,12 @@ func (vg *VolumeGroup) ReadDir(path string) ([]*FileInfo, error) {
 }
 
 func (vg *VolumeGroup) Open(path string) (FileReadCloser, error) {
+	return vg.OpenContext(context.Background(), path)
+}
+
+func (vg *VolumeGroup) OpenContext(ctx context.Context, path string) (FileReadCloser, error) {
 	if v, p, ok := vg.resolve(path); ok {
-		return v.Open(p)
+		return ToContextVolume(v).OpenContext(ctx, p)
 	}
 	return nil, noentError("Open", path)
 }
@@ -195,11 +321,122 @@ func (vg *VolumeGroup) Watch(callback func(f FileEvent)) (io.Closer, error) {
 	return &multiCloser{closers}, nil
 }
 
+// move copies the whole tree and then removes the source.
+func move(src FS, srcPath string, dst FS, dstPath string) error {
+	if err := copyTree(src, srcPath, dst, dstPath); err != nil {
+		return err
+	}
+	return removeAll(src, srcPath)
+}
+
+// copyTree copies the file or directory. Nothing is left in dst if it fails.
+// Symlinks are copied as symlinks. It fails if dst doesn't support them.
+func copyTree(src FS, srcPath string, dst FS, dstPath string) error {
+	stat, err := lstat(src, srcPath)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		return copySymlink(src, srcPath, dst, dstPath)
+	}
+	if !stat.IsDir() {
+		if err := copyFile(src, srcPath, dst, dstPath); err != nil {
+			return err
+		}
+		copyAttrs(stat, dst, dstPath)
+		return nil
+	}
+	if err := dst.Mkdir(dstPath, stat.Mode().Perm()); err != nil {
+		return err
+	}
+	files, err := src.ReadDir(srcPath)
+	for _, f := range files {
+		if err != nil {
+			break
+		}
+		err = copyTree(src, path.Join(srcPath, f.Name()), dst, path.Join(dstPath, f.Name()))
+	}
+	if err != nil {
+		removeAll(dst, dstPath)
+		return err
+	}
+	copyAttrs(stat, dst, dstPath)
+	return nil
+}
+
+func copyFile(src FS, srcPath string, dst FS, dstPath string) error {
+	r, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		dst.Remove(dstPath)
+	}
+	return err
+}
+
+func copySymlink(src FS, srcPath string, dst FS, dstPath string) error {
+	target, err := UnwrapVolume(src).(VolumeLinker).Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+	l, ok := dst.(VolumeLinker)
+	if !ok {
+		return unsupportedError("Symlink", dstPath)
+	}
+	return l.Symlink(target, dstPath)
+}
+
+// lstat doesn't follow the symlink if the volume supports symlinks.
+func lstat(v FS, p string) (*FileInfo, error) {
+	if l, ok := UnwrapVolume(v).(VolumeLinker); ok {
+		return l.Lstat(p)
+	}
+	return v.Stat(p)
+}
+
+// copyAttrs copies the permissions and mtime. Errors are ignored because some volumes don't support them.
+func copyAttrs(stat *FileInfo, dst FS, dstPath string) {
+	dst.Chmod(dstPath, stat.Mode().Perm())
+	dst.Chtimes(dstPath, time.Time{}, stat.ModTime())
+}
+
+// removeAll removes the tree. Symlinks are removed without following them.
+func removeAll(v FS, p string) error {
+	if stat, err := lstat(v, p); err == nil && stat.IsDir() {
+		files, err := v.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := removeAll(v, path.Join(p, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return v.Remove(p)
+}
+
 func (vg *VolumeGroup) resolve(path string) (FS, string, bool) {
+	v, p, _, ok := vg.resolveMount(path)
+	return v, p, ok
+}
+
+// resolveMount returns the volume, the path in the volume and the mount point.
+func (vg *VolumeGroup) resolveMount(path string) (FS, string, string, bool) {
 	path = strings.TrimPrefix(path, "/")
 	vg.lock.RLock()
 	var v FS
-	var p string
+	var p, mount string
 	defer vg.lock.RUnlock()
 	for _, e := range vg.vv {
 		if !e.v.Available() {
@@ -208,11 +445,13 @@ func (vg *VolumeGroup) resolve(path string) (FS, string, bool) {
 		if (e.p == "" || e.p == path) && len(e.p) >= len(p) {
 			v = ToFS(e.v)
 			p = path[len(e.p):]
+			mount = e.p
 		}
 		if strings.HasPrefix(path, e.p+"/") && len(e.p)+1 > len(p) {
 			v = ToFS(e.v)
 			p = path[len(e.p)+1:]
+			mount = e.p
 		}
 	}
-	return v, p, v != nil
+	return v, p, mount, v != nil
 }
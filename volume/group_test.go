@@ -2,7 +2,9 @@ package volume
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func newTestVolumeGroup() *VolumeGroup {
@@ -34,7 +36,7 @@ func TestVolumeGroup(t *testing.T) {
 		[]string{"hoge/created.txt"},
 		[]string{"not_existing/test.txt"},
 		[]string{},
-		[]string{"not_existing/testdir", "mem/hoge2/testdir"},
+		[]string{"not_existing/testdir", "mem/hoge2/not_existing/testdir"},
 	)
 
 	vol.Clear()
@@ -55,3 +57,176 @@ func TestVolumeGroup_Open(t *testing.T) {
 		t.Errorf("unexpexted string: %v", string(b))
 	}
 }
+
+func TestVolumeGroup_Rename(t *testing.T) {
+	vol1 := NewLocalVolume(t.TempDir())
+	vol2 := NewLocalVolume(t.TempDir())
+	vol := NewVolumeGroup()
+	vol.AddVolume("vol1", vol1)
+	vol.AddVolume("vol2", vol2)
+
+	vol1.Mkdir("dir", 0755)
+	w, err := vol1.Create("dir/a.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	// same volume
+	err = vol.Rename("vol1/dir/a.txt", "vol1/dir/b.txt")
+	if err != nil {
+		t.Errorf("Rename error: %v", err)
+	}
+	if _, err := vol1.Stat("dir/b.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+
+	// across volumes
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	vol1.Chmod("dir/b.txt", 0600)
+	vol1.Chtimes("dir/b.txt", mtime, mtime)
+	err = vol.Rename("vol1/dir", "vol2/dir2")
+	if err != nil {
+		t.Errorf("Rename error: %v", err)
+	}
+	if _, err := vol1.Stat("dir"); !os.IsNotExist(err) {
+		t.Errorf("old dir should not exist: %v", err)
+	}
+	r, err := vol.Open("vol2/dir2/b.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer r.Close()
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "Hello" {
+		t.Errorf("unexpexted string: %v", string(b))
+	}
+	if stat, err := vol2.Stat("dir2/b.txt"); err != nil || stat.Mode().Perm() != 0600 || !stat.ModTime().Equal(mtime) {
+		t.Errorf("attributes should be copied: %v %v", stat, err)
+	}
+
+	// partial copy is removed.
+	vol2.Mkdir("dir3", 0755)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		w, _ := vol2.Create("dir3/" + name)
+		w.Write([]byte(name))
+		w.Close()
+	}
+	vol.AddVolume("bad", &failingOpenVolume{Volume: vol2, name: "dir3/b.txt"})
+	if err := vol.Rename("bad/dir3", "vol1/dir3"); err == nil {
+		t.Errorf("Rename should fail")
+	}
+	if _, err := vol1.Stat("dir3"); !os.IsNotExist(err) {
+		t.Errorf("partial copy should be removed: %v", err)
+	}
+	if files, _ := vol2.ReadDir("dir3"); len(files) != 3 {
+		t.Errorf("source should not be modified: %v", files)
+	}
+
+	err = vol.Rename("not_existing/a.txt", "vol2/a.txt")
+	if _, ok := err.(*os.PathError); !ok {
+		t.Errorf("Rename should return pathError. err: %v", err)
+	}
+}
+
+func TestVolumeGroup_RenameSymlink(t *testing.T) {
+	vol1 := NewLocalVolume(t.TempDir())
+	vol2 := NewLocalVolume(t.TempDir())
+	vol := NewVolumeGroup()
+	vol.AddVolume("vol1", vol1)
+	vol.AddVolume("vol2", vol2)
+
+	vol1.Mkdir("outside", 0755)
+	w, _ := vol1.Create("outside/secret.txt")
+	w.Write([]byte("secret"))
+	w.Close()
+	vol1.Mkdir("dir", 0755)
+	if err := vol1.Symlink("../outside", "dir/link"); err != nil {
+		t.Skipf("symlink is not supported: %v", err)
+	}
+
+	if err := vol.Rename("vol1/dir", "vol2/dir2"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if target, err := vol2.Readlink("dir2/link"); err != nil || target != "../outside" {
+		t.Errorf("symlink should be copied: %q %v", target, err)
+	}
+	if _, err := vol1.Stat("outside/secret.txt"); err != nil {
+		t.Errorf("link target should not be removed: %v", err)
+	}
+	if _, err := vol1.Lstat("dir"); !os.IsNotExist(err) {
+		t.Errorf("old dir should not exist: %v", err)
+	}
+
+	// the destination doesn't support symlinks.
+	vol1.Mkdir("dir", 0755)
+	vol1.Symlink("../outside", "dir/link")
+	vol.AddVolume("mem", &struct{ FS }{NewOnMemoryVolume(nil)})
+	if err := vol.Rename("vol1/dir", "mem/dir"); err == nil {
+		t.Errorf("Rename should fail")
+	}
+	if _, err := vol1.Lstat("dir/link"); err != nil {
+		t.Errorf("source should not be modified: %v", err)
+	}
+	if _, err := vol1.Stat("outside/secret.txt"); err != nil {
+		t.Errorf("link target should not be removed: %v", err)
+	}
+}
+
+type failingOpenVolume struct {
+	Volume
+	name string
+}
+
+func (v *failingOpenVolume) Open(path string) (FileReadCloser, error) {
+	if path == v.name {
+		return nil, permissionError("Open", path)
+	}
+	return v.Volume.Open(path)
+}
+
+type countingStatVolume struct {
+	*OnMemoryVolume
+	stats int
+}
+
+func (v *countingStatVolume) Stat(path string) (*FileInfo, error) {
+	v.stats++
+	return v.OnMemoryVolume.Stat(path)
+}
+
+func TestVolumeGroup_MountStat(t *testing.T) {
+	mem := &countingStatVolume{OnMemoryVolume: NewOnMemoryVolume(map[string][]byte{"hello.txt": []byte("Hello")})}
+	vol := NewVolumeGroup()
+	vol.AddVolume("mem", mem)
+
+	for i := 0; i < 3; i++ {
+		files, err := vol.ReadDir("")
+		if err != nil || len(files) != 1 || files[0].Name() != "mem" || !files[0].IsDir() {
+			t.Fatalf("unexpected files: %v %v", files, err)
+		}
+		if files[0].Mode().Perm() == 0 {
+			t.Errorf("mount point should have the attributes of the volume: %v", files[0].Mode())
+		}
+	}
+	if mem.stats != 1 {
+		t.Errorf("stat of the mount point should be cached: %d", mem.stats)
+	}
+
+	// modifications through the group clear the cache.
+	if err := vol.Chmod("mem", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.Mkdir("mem/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := vol.ReadDir("")
+	stat, err := vol.Stat("mem")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files: %v %v", files, err)
+	}
+	if files[0].Mode() != stat.Mode() || !files[0].ModTime().Equal(stat.ModTime()) {
+		t.Errorf("ReadDir and Stat should return the same attributes: %v %v", files[0], stat)
+	}
+}
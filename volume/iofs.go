@@ -0,0 +1,333 @@
+package volume
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/binzume/cfs/internal/arcache"
+)
+
+// IOFS is an io/fs.FS which implements the optional fs interfaces.
+type IOFS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+	fs.SubFS
+}
+
+type ioFS struct {
+	v      Volume
+	prefix string
+}
+
+// AsFS returns an io/fs.FS backed by the volume.
+func AsFS(v Volume) IOFS {
+	if fv, ok := v.(*fsVolume); ok {
+		if fsys, ok := fv.fsys.(IOFS); ok {
+			return fsys
+		}
+	}
+	return &ioFS{v: v}
+}
+
+func (f *ioFS) volumePath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return f.prefix, nil
+	}
+	return path.Join(f.prefix, name), nil
+}
+
+func (f *ioFS) Open(name string) (fs.File, error) {
+	p, err := f.volumePath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.v.Stat(p)
+	if err != nil {
+		return nil, toFSError("open", name, err)
+	}
+	if stat.IsDir() {
+		return &ioDir{fs: f, name: name, stat: stat}, nil
+	}
+	r, err := f.v.Open(p)
+	if err != nil {
+		return nil, toFSError("open", name, err)
+	}
+	return &ioFile{FileReadCloser: r, stat: stat}, nil
+}
+
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := f.volumePath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.v.Stat(p)
+	if err != nil {
+		return nil, toFSError("stat", name, err)
+	}
+	return fixName(stat, name), nil
+}
+
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := f.volumePath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := f.v.ReadDir(p)
+	if err != nil {
+		return nil, toFSError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(files))
+	for i, fi := range files {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func (f *ioFS) Sub(dir string) (fs.FS, error) {
+	p, err := f.volumePath("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "." {
+		return f, nil
+	}
+	return &ioFS{v: f.v, prefix: p}, nil
+}
+
+// CacheKey implements arcache.Keyer, so that archives in the volume are cached
+// even if the volume is converted for each operation.
+func (f *ioFS) CacheKey() (interface{}, bool) {
+	if fv, ok := f.v.(interface{ baseFS() fs.FS }); ok {
+		k, ok := arcache.KeyOf(fv.baseFS())
+		return arcache.Key{FS: k, Path: f.prefix}, ok
+	}
+	return arcache.Key{FS: f.v, Path: f.prefix}, reflect.TypeOf(f.v).Comparable()
+}
+
+// fixName returns FileInfo with the base name of name.
+func fixName(stat *FileInfo, name string) *FileInfo {
+	if stat.Name() != path.Base(name) {
+		st := *stat
+		st.Path = name
+		return &st
+	}
+	return stat
+}
+
+type ioFile struct {
+	FileReadCloser
+	stat *FileInfo
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	return f.stat, nil
+}
+
+type ioDir struct {
+	fs      *ioFS
+	name    string
+	stat    *FileInfo
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) {
+	return fixName(d.stat, d.name), nil
+}
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *ioDir) Close() error {
+	return nil
+}
+
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.loaded = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func toFSError(op, name string, err error) error {
+	var base error
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		base = fs.ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		base = fs.ErrPermission
+	case errors.Is(err, fs.ErrExist):
+		base = fs.ErrExist
+	case errors.Is(err, fs.ErrInvalid):
+		base = fs.ErrInvalid
+	case errors.Is(err, fs.ErrClosed):
+		base = fs.ErrClosed
+	default:
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			base = perr.Err
+		} else {
+			base = err
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: base}
+}
+
+type fsVolume struct {
+	fsys fs.FS
+}
+
+// FromFS returns a read-only volume backed by the io/fs.FS.
+func FromFS(fsys fs.FS) Volume {
+	if f, ok := fsys.(*ioFS); ok && f.prefix == "" {
+		return f.v
+	}
+	return &fsVolume{fsys: fsys}
+}
+
+func toFSPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func newFSFileEntry(p string, fi fs.FileInfo) *FileInfo {
+	if f, ok := fi.(*FileInfo); ok {
+		st := *f
+		st.Path = p
+		return &st
+	}
+	st := &FileInfo{
+		Path:        p,
+		FileSize:    fi.Size(),
+		UpdatedTime: fi.ModTime(),
+		FileMode:    fi.Mode(),
+	}
+	if meta, ok := fi.Sys().(map[string]interface{}); ok {
+		for k, v := range meta {
+			st.SetMetadata(k, v)
+		}
+	}
+	return st
+}
+
+func (v *fsVolume) baseFS() fs.FS {
+	return v.fsys
+}
+
+func (v *fsVolume) Available() bool {
+	return true
+}
+
+func (v *fsVolume) Stat(path string) (*FileInfo, error) {
+	fi, err := fs.Stat(v.fsys, toFSPath(path))
+	if err != nil {
+		return nil, toFSError("Stat", path, err)
+	}
+	return newFSFileEntry(path, fi), nil
+}
+
+func (v *fsVolume) ReadDir(path string) ([]*FileInfo, error) {
+	entries, err := fs.ReadDir(v.fsys, toFSPath(path))
+	if err != nil {
+		return nil, toFSError("ReadDir", path, err)
+	}
+	files := []*FileInfo{}
+	for _, ent := range entries {
+		fi, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, newFSFileEntry(ent.Name(), fi))
+	}
+	return files, nil
+}
+
+func (v *fsVolume) Open(path string) (FileReadCloser, error) {
+	f, err := v.fsys.Open(toFSPath(path))
+	if err != nil {
+		return nil, toFSError("Open", path, err)
+	}
+	if r, ok := f.(FileReadCloser); ok {
+		return r, nil
+	}
+	return &fsFileReader{File: f}, nil
+}
+
+// fsFileReader implements io.ReaderAt for fs.File.
+type fsFileReader struct {
+	fs.File
+	lock sync.Mutex
+	pos  int64
+}
+
+func (r *fsFileReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n, err := r.File.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *fsFileReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off != r.pos {
+		s, ok := r.File.(io.Seeker)
+		if !ok {
+			return 0, &fs.PathError{Op: "ReadAt", Err: UnsupportedError}
+		}
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.pos = off
+	}
+	n, err := io.ReadFull(r.File, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package volume
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAsFS(t *testing.T) {
+	fsys := AsFS(NewLocalVolume("./testdata"))
+
+	if err := fstest.TestFS(fsys, "test.txt", "test.zip", "test/empty.txt"); err != nil {
+		t.Error(err)
+	}
+
+	b, err := fs.ReadFile(fsys, "test.txt")
+	if err != nil {
+		t.Errorf("ReadFile error: %v", err)
+	}
+	if string(b) != "Hello" {
+		t.Errorf("unexpexted string: %v", string(b))
+	}
+
+	_, err = fsys.Stat("not_existing_file")
+	if !os.IsNotExist(err) {
+		t.Errorf("Stat should return ErrNotExist: %v", err)
+	}
+	if _, ok := err.(*fs.PathError); !ok {
+		t.Errorf("Stat should return pathError: %v", err)
+	}
+	_, err = fsys.Open("/test.txt")
+	if perr, ok := err.(*fs.PathError); !ok || perr.Err != fs.ErrInvalid {
+		t.Errorf("Open should return ErrInvalid: %v", err)
+	}
+
+	sub, err := fsys.Sub("test")
+	if err != nil {
+		t.Fatalf("Sub error: %v", err)
+	}
+	if _, err := fs.Stat(sub, "empty.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+
+	group := NewVolumeGroup()
+	group.AddVolume("mem/hoge", NewOnMemoryVolume(map[string][]byte{"hello.txt": []byte("Hello")}))
+	if err := fstest.TestFS(AsFS(group), "mem/hoge/hello.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFromFS(t *testing.T) {
+	vol := FromFS(fstest.MapFS{
+		"hello.txt":     &fstest.MapFile{Data: []byte("Hello")},
+		"dir/world.txt": &fstest.MapFile{Data: []byte("World")},
+	})
+
+	testVolume(t, vol,
+		[]string{"hello.txt", "/hello.txt", "dir/world.txt"},
+		[]string{"not_existing_file", "not_existing_dir/hello.txt"},
+		[]string{"", "/", "dir"},
+		[]string{"not_existing_dir"},
+	)
+
+	r, err := vol.Open("dir/world.txt")
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer r.Close()
+	b := make([]byte, 3)
+	if n, err := r.ReadAt(b, 2); err != nil || string(b[:n]) != "rld" {
+		t.Errorf("ReadAt error: %v, %q", err, string(b[:n]))
+	}
+
+	local := NewLocalVolume("./testdata")
+	if FromFS(AsFS(local)) != local {
+		t.Errorf("FromFS should unwrap volume")
+	}
+}
@@ -12,12 +12,28 @@ import (
 )
 
 type LocalVolume struct {
-	basePath string
+	basePath       string
+	realBase       string // basePath with symlinks resolved. used by confined volumes.
+	confine        bool
+	rejectSymlinks bool
+	rejectSpecial  bool
 }
 
 // NewLocalVolume returns a new volume.
-func NewLocalVolume(basePath string) *LocalVolume {
-	return &LocalVolume{basePath: basePath}
+func NewLocalVolume(basePath string, opts ...LocalOption) *LocalVolume {
+	v := &LocalVolume{basePath: basePath}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.confine {
+		if p, err := filepath.EvalSymlinks(basePath); err == nil {
+			v.realBase = p
+		}
+		if p, err := filepath.Abs(basePath); err == nil {
+			v.basePath = p
+		}
+	}
+	return v
 }
 
 func newLocalFileEntry(path string, info os.FileInfo) *FileInfo {
@@ -36,7 +52,11 @@ func (v *LocalVolume) Available() bool {
 }
 
 func (v *LocalVolume) Stat(path string) (*FileInfo, error) {
-	fi, err := os.Stat(v.RealPath(path))
+	real, err := v.realPath("stat", path, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(real)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +64,11 @@ func (v *LocalVolume) Stat(path string) (*FileInfo, error) {
 }
 
 func (v *LocalVolume) ReadDir(path string) ([]*FileInfo, error) {
-	items, err := ioutil.ReadDir(v.RealPath(path))
+	real, err := v.realPath("readdir", path, true)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ioutil.ReadDir(real)
 	if err != nil {
 		return nil, err
 	}
@@ -55,29 +79,142 @@ func (v *LocalVolume) ReadDir(path string) ([]*FileInfo, error) {
 	return files, err
 }
 
+// RealPath returns the path in the local filesystem. Symlinks are not resolved even if the volume is confined.
 func (v *LocalVolume) RealPath(path string) string {
 	// Real path should be included in basePath.
 	return filepath.Join(v.basePath, filepath.Join("/", path))
 }
 
 func (v *LocalVolume) OpenFile(path string, flag int, perm os.FileMode) (f File, err error) {
-	return os.OpenFile(v.RealPath(path), flag, perm)
+	return v.openFile("open", path, flag, perm)
 }
 
 func (v *LocalVolume) Open(path string) (reader FileReadCloser, err error) {
-	return os.Open(v.RealPath(path))
+	return v.openFile("open", path, os.O_RDONLY, 0)
 }
 
 func (v *LocalVolume) Create(path string) (reader FileWriteCloser, err error) {
-	return os.Create(v.RealPath(path))
+	return v.openFile("open", path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
 func (v *LocalVolume) Remove(path string) error {
-	return os.Remove(v.RealPath(path))
+	real, err := v.realPath("remove", path, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(real)
+}
+
+func (v *LocalVolume) Rename(oldpath, newpath string) error {
+	oldreal, err := v.realPath("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	newreal, err := v.realPath("rename", newpath, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldreal, newreal)
 }
 
 func (v *LocalVolume) Mkdir(path string, mode os.FileMode) error {
-	return os.Mkdir(v.RealPath(path), mode)
+	real, err := v.realPath("mkdir", path, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(real, mode)
+}
+
+func (v *LocalVolume) Chmod(path string, mode os.FileMode) error {
+	real, err := v.realPath("chmod", path, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(real, mode)
+}
+
+func (v *LocalVolume) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	real, err := v.realPath("chtimes", path, true)
+	if err != nil {
+		return err
+	}
+	if atime.IsZero() || mtime.IsZero() {
+		fi, err := os.Stat(real)
+		if err != nil {
+			return err
+		}
+		if atime.IsZero() {
+			atime = time.Unix(0, GetATime(fi))
+		}
+		if mtime.IsZero() {
+			mtime = fi.ModTime()
+		}
+	}
+	return os.Chtimes(real, atime, mtime)
+}
+
+func (v *LocalVolume) Truncate(path string, size int64) error {
+	real, err := v.realPath("truncate", path, true)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(real, size)
+}
+
+func (v *LocalVolume) Lstat(path string) (*FileInfo, error) {
+	real, err := v.realPath("lstat", path, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(real)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalFileEntry(path, fi), nil
+}
+
+// Readlink returns the slash-separated target of the symlink.
+// If the volume is confined, absolute targets in the base directory are returned as relative paths and others are refused.
+func (v *LocalVolume) Readlink(path string) (string, error) {
+	real, err := v.realPath("readlink", path, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(real)
+	if err != nil {
+		return "", err
+	}
+	if v.confine && filepath.IsAbs(target) {
+		rel, ok := v.relPath(target)
+		if !ok {
+			return "", permissionError("readlink", path)
+		}
+		dir, _ := filepath.Rel(v.basePath, filepath.Dir(real))
+		if target, err = filepath.Rel(dir, rel); err != nil {
+			return "", permissionError("readlink", path)
+		}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// Symlink creates newname as a symlink to oldname. oldname is a slash-separated path relative to the directory of newname.
+// If the volume is confined, absolute paths and paths out of the base directory are refused.
+func (v *LocalVolume) Symlink(oldname, newname string) error {
+	real, err := v.realPath("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	target := filepath.FromSlash(oldname)
+	if v.confine {
+		dir, _ := filepath.Rel(v.basePath, filepath.Dir(real))
+		if filepath.IsAbs(target) {
+			return permissionError("symlink", newname)
+		}
+		if _, ok := v.relPath(filepath.Join(v.basePath, dir, target)); !ok {
+			return permissionError("symlink", newname)
+		}
+	}
+	return os.Symlink(target, real)
 }
 
 func (v *LocalVolume) Walk(callback func(*FileInfo)) error {
@@ -96,7 +233,11 @@ func (v *LocalVolume) walk(callback func(*FileInfo), path string) error {
 		callback(newLocalFileEntry(filepath.ToSlash(vpath), info))
 		return nil
 	}
-	return filepath.Walk(v.RealPath(path), f)
+	real, err := v.realPath("walk", path, true)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(real, f)
 }
 
 func (v *LocalVolume) Watch(callback func(FileEvent)) (io.Closer, error) {
@@ -0,0 +1,154 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// LocalOption configures LocalVolume.
+type LocalOption func(*LocalVolume)
+
+// Confine resolves symlinks in the volume and refuses paths which escape from the base directory.
+// Symlinks are followed only if they point into the base directory. (like RESOLVE_BENEATH of openat2)
+// Note that the resolution is not atomic. Symlinks replaced by other processes after the check may be followed.
+func Confine() LocalOption {
+	return func(v *LocalVolume) {
+		v.confine = true
+	}
+}
+
+// RejectSymlinks refuses paths which contain symlinks. The last element is allowed for operations which don't follow it. (e.g. Remove, Lstat)
+// It implies Confine.
+func RejectSymlinks() LocalOption {
+	return func(v *LocalVolume) {
+		v.confine = true
+		v.rejectSymlinks = true
+	}
+}
+
+// RejectSpecialFiles refuses opening devices, named pipes and sockets.
+func RejectSpecialFiles() LocalOption {
+	return func(v *LocalVolume) {
+		v.rejectSpecial = true
+	}
+}
+
+func isSpecialFile(mode os.FileMode) bool {
+	return mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0
+}
+
+func splitPath(p string) []string {
+	return strings.Split(filepath.ToSlash(p), "/")
+}
+
+// realPath returns the real path of the file. If the volume is confined, symlinks are resolved in the base directory.
+// The last component is not resolved unless follow is true.
+func (v *LocalVolume) realPath(op, path string, follow bool) (string, error) {
+	if !v.confine {
+		return v.RealPath(path), nil
+	}
+	var resolved []string
+	rest := splitPath(path)
+	missing := false
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			if len(resolved) == 0 {
+				return "", permissionError(op, path)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		if missing {
+			resolved = append(resolved, name)
+			continue
+		}
+		real := filepath.Join(v.basePath, filepath.Join(resolved...), name)
+		fi, err := os.Lstat(real)
+		if err != nil {
+			// Following components are checked lexically. The operation will fail anyway.
+			missing = true
+			resolved = append(resolved, name)
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink == 0 || (len(rest) == 0 && !follow) {
+			resolved = append(resolved, name)
+			continue
+		}
+		if v.rejectSymlinks {
+			return "", permissionError(op, path)
+		}
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: op, Path: path, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(real)
+		if err != nil {
+			return "", permissionError(op, path)
+		}
+		if filepath.IsAbs(target) {
+			rel, ok := v.relPath(target)
+			if !ok {
+				return "", permissionError(op, path)
+			}
+			resolved = nil
+			target = rel
+		}
+		rest = append(splitPath(target), rest...)
+	}
+	return filepath.Join(v.basePath, filepath.Join(resolved...)), nil
+}
+
+// relPath returns the path relative to the base directory. ok is false if the path is not in the base directory.
+func (v *LocalVolume) relPath(p string) (string, bool) {
+	for _, base := range []string{v.realBase, v.basePath} {
+		if base == "" {
+			continue
+		}
+		rel, err := filepath.Rel(base, filepath.Clean(p))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+// checkSpecial refuses special files if RejectSpecialFiles is set. Files which don't exist are allowed.
+func (v *LocalVolume) checkSpecial(op, path, real string) error {
+	if !v.rejectSpecial {
+		return nil
+	}
+	if fi, err := os.Stat(real); err == nil && isSpecialFile(fi.Mode()) {
+		return permissionError(op, path)
+	}
+	return nil
+}
+
+func (v *LocalVolume) openFile(op, path string, flag int, perm os.FileMode) (*os.File, error) {
+	real, err := v.realPath(op, path, true)
+	if err != nil {
+		return nil, err
+	}
+	// Check before opening because opening a named pipe blocks.
+	if err := v.checkSpecial(op, path, real); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(real, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if v.rejectSpecial {
+		// The file may be replaced after the check.
+		if fi, err := f.Stat(); err != nil || isSpecialFile(fi.Mode()) {
+			f.Close()
+			return nil, permissionError(op, path)
+		}
+	}
+	return f, nil
+}
@@ -6,7 +6,7 @@ import "os"
 import "syscall"
 
 func GetATime(fi os.FileInfo) int64 {
-	return fi.Sys().(*syscall.Stat_t).Mtim.Nano()
+	return fi.Sys().(*syscall.Stat_t).Atim.Nano()
 }
 
 func GetCTime(fi os.FileInfo) int64 {
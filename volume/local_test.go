@@ -3,6 +3,7 @@ package volume
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -103,3 +104,210 @@ func TestLocalVolume_Watch(t *testing.T) {
 
 	vol.Remove("/test/dir")
 }
+
+func TestLocalVolume_Rename(t *testing.T) {
+	var vol = NewLocalVolume(t.TempDir())
+
+	w, err := vol.Create("a.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	err = vol.Rename("a.txt", "b.txt")
+	if err != nil {
+		t.Errorf("Rename error: %v", err)
+	}
+	if _, err := vol.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Errorf("old file should not exist: %v", err)
+	}
+	if stat, err := vol.Stat("b.txt"); err != nil || stat.Size() != 5 {
+		t.Errorf("Stat error: %v", err)
+	}
+
+	err = vol.Rename("not_existing.txt", "c.txt")
+	if _, ok := err.(*os.LinkError); !ok {
+		t.Errorf("Rename should return linkError. err: %v", err)
+	}
+}
+
+func TestLocalVolume_Attr(t *testing.T) {
+	var vol = NewLocalVolume(t.TempDir())
+	var _ VolumeAttrWriter = vol
+
+	w, err := vol.Create("a.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	if err := vol.Chmod("a.txt", 0600); err != nil {
+		t.Errorf("Chmod error: %v", err)
+	}
+	if err := vol.Truncate("a.txt", 2); err != nil {
+		t.Errorf("Truncate error: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := vol.Chtimes("a.txt", mtime, mtime); err != nil {
+		t.Errorf("Chtimes error: %v", err)
+	}
+	// zero time is not changed.
+	if err := vol.Chtimes("a.txt", time.Now(), time.Time{}); err != nil {
+		t.Errorf("Chtimes error: %v", err)
+	}
+
+	stat, err := vol.Stat("a.txt")
+	if err != nil {
+		t.Fatalf("Stat error: %v", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode: %v", stat.Mode())
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime: %v", stat.ModTime())
+	}
+	if stat.Size() != 2 {
+		t.Errorf("unexpected size: %v", stat.Size())
+	}
+}
+
+// makeSymlinkTree creates a tree with symlinks pointing into and out of the base directory.
+func makeSymlinkTree(t *testing.T) (base, outside string) {
+	dir := t.TempDir()
+	base = filepath.Join(dir, "base")
+	outside = filepath.Join(dir, "outside")
+	os.MkdirAll(filepath.Join(base, "sub"), 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(base, "sub/b.txt"), []byte("Hello"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	links := map[string]string{
+		"in":     "sub",
+		"inabs":  filepath.Join(base, "sub"),
+		"out":    "../outside",
+		"outabs": outside,
+		"loop":   "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Skipf("symlink is not supported: %v", err)
+		}
+	}
+	return
+}
+
+func TestLocalVolume_Confine(t *testing.T) {
+	base, outside := makeSymlinkTree(t)
+
+	if _, err := NewLocalVolume(base).Stat("out/secret.txt"); err != nil {
+		t.Errorf("symlinks should be followed without confinement: %v", err)
+	}
+
+	vol := NewLocalVolume(base, Confine())
+	for _, p := range []string{"sub/b.txt", "in/b.txt", "inabs/b.txt", "/in/../sub/b.txt"} {
+		if stat, err := vol.Stat(p); err != nil || stat.Size() != 5 {
+			t.Errorf("Stat(%v) error: %v", p, err)
+		}
+	}
+	for _, p := range []string{"out/secret.txt", "outabs/secret.txt", "out", "../outside/secret.txt", "in/../../outside/secret.txt", "sub/../out/secret.txt"} {
+		if _, err := vol.Stat(p); !os.IsPermission(err) {
+			t.Errorf("Stat(%v) should be refused: %v", p, err)
+		}
+		if _, err := vol.Open(p); !os.IsPermission(err) {
+			t.Errorf("Open(%v) should be refused: %v", p, err)
+		}
+	}
+	if _, err := vol.Stat("loop"); err == nil {
+		t.Errorf("Stat(loop) should fail")
+	}
+	if _, err := vol.Create("out/new.txt"); !os.IsPermission(err) {
+		t.Errorf("Create should be refused: %v", err)
+	}
+	if err := vol.Mkdir("outabs/dir", 0755); !os.IsPermission(err) {
+		t.Errorf("Mkdir should be refused: %v", err)
+	}
+	if err := vol.Rename("sub/b.txt", "out/b.txt"); !os.IsPermission(err) {
+		t.Errorf("Rename should be refused: %v", err)
+	}
+	if err := vol.Chmod("out/secret.txt", 0777); !os.IsPermission(err) {
+		t.Errorf("Chmod should be refused: %v", err)
+	}
+	if err := vol.Truncate("outabs/secret.txt", 0); !os.IsPermission(err) {
+		t.Errorf("Truncate should be refused: %v", err)
+	}
+	if _, err := vol.ReadDir("out"); !os.IsPermission(err) {
+		t.Errorf("ReadDir should be refused: %v", err)
+	}
+
+	// Links themselves can be removed.
+	if err := vol.Remove("out"); err != nil {
+		t.Errorf("Remove error: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(outside, "secret.txt")); err != nil || string(data) != "secret" {
+		t.Errorf("outside file is modified: %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("file should not be created outside: %v", err)
+	}
+}
+
+func TestLocalVolume_RejectSymlinks(t *testing.T) {
+	base, _ := makeSymlinkTree(t)
+	vol := NewLocalVolume(base, RejectSymlinks())
+
+	if _, err := vol.Stat("sub/b.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+	for _, p := range []string{"in/b.txt", "inabs", "out/secret.txt"} {
+		if _, err := vol.Stat(p); !os.IsPermission(err) {
+			t.Errorf("Stat(%v) should be refused: %v", p, err)
+		}
+	}
+	if err := vol.Remove("in"); err != nil {
+		t.Errorf("Remove error: %v", err)
+	}
+}
+
+func TestLocalVolume_Symlink(t *testing.T) {
+	base, outside := makeSymlinkTree(t)
+	var _ VolumeLinker = NewLocalVolume(base)
+
+	for _, vol := range []*LocalVolume{NewLocalVolume(base), NewLocalVolume(base, Confine())} {
+		if err := vol.Symlink("sub/b.txt", "link.txt"); err != nil {
+			t.Fatalf("Symlink error: %v", err)
+		}
+		if stat, err := vol.Stat("link.txt"); err != nil || stat.Size() != 5 {
+			t.Errorf("Stat should follow the symlink: %v %v", stat, err)
+		}
+		if stat, err := vol.Lstat("link.txt"); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+		}
+		if target, err := vol.Readlink("link.txt"); err != nil || target != "sub/b.txt" {
+			t.Errorf("Readlink: %q %v", target, err)
+		}
+		files, _ := vol.ReadDir("")
+		for _, f := range files {
+			if f.Name() == "in" && f.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("ReadDir should not follow symlinks: %v", f.Mode())
+			}
+		}
+		vol.Remove("link.txt")
+	}
+
+	vol := NewLocalVolume(base, Confine())
+	if target, err := vol.Readlink("inabs"); err != nil || target != "sub" {
+		t.Errorf("absolute target in the volume should be relative: %q %v", target, err)
+	}
+	if _, err := vol.Readlink("outabs"); !os.IsPermission(err) {
+		t.Errorf("Readlink should be refused: %v", err)
+	}
+	for _, target := range []string{"../../outside", outside, "../sub/../../outside"} {
+		if err := vol.Symlink(target, "sub/escape"); !os.IsPermission(err) {
+			t.Errorf("Symlink(%q) should be refused: %v", target, err)
+		}
+	}
+	if err := vol.Symlink("../in/b.txt", "sub/ok"); err != nil {
+		t.Errorf("Symlink error: %v", err)
+	}
+}
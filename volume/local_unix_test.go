@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLocalVolume_RejectSpecialFiles(t *testing.T) {
+	base := t.TempDir()
+	if err := syscall.Mkfifo(filepath.Join(base, "fifo"), 0644); err != nil {
+		t.Skipf("mkfifo error: %v", err)
+	}
+	os.Symlink("/dev/null", filepath.Join(base, "null"))
+	vol := NewLocalVolume(base, RejectSpecialFiles())
+
+	if _, err := vol.Stat("fifo"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+	if _, err := vol.Open("fifo"); !os.IsPermission(err) {
+		t.Errorf("Open(fifo) should be refused: %v", err)
+	}
+	if _, err := vol.OpenFile("fifo", os.O_WRONLY, 0); !os.IsPermission(err) {
+		t.Errorf("OpenFile(fifo) should be refused: %v", err)
+	}
+	if _, err := vol.Create("null"); !os.IsPermission(err) {
+		t.Errorf("Create(null) should be refused: %v", err)
+	}
+}
+
+func TestLocalVolume_ChtimesZero(t *testing.T) {
+	base := t.TempDir()
+	os.WriteFile(filepath.Join(base, "a.txt"), []byte("Hello"), 0644)
+	vol := NewLocalVolume(base)
+
+	atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := vol.Chtimes("a.txt", atime, mtime); err != nil {
+		t.Fatalf("Chtimes error: %v", err)
+	}
+	if err := vol.Chtimes("a.txt", time.Time{}, mtime.Add(time.Hour)); err != nil {
+		t.Fatalf("Chtimes error: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(base, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := time.Unix(0, GetATime(fi)); !a.Equal(atime) {
+		t.Errorf("atime should not be changed: %v", a)
+	}
+	if !fi.ModTime().Equal(mtime.Add(time.Hour)) {
+		t.Errorf("unexpected mtime: %v", fi.ModTime())
+	}
+}
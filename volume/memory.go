@@ -2,18 +2,152 @@ package volume
 
 import (
 	"bytes"
+	"io"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// OnMemoryVolume is a writable volume which keeps a directory tree in memory.
 type OnMemoryVolume struct {
-	lock  sync.RWMutex
-	files map[string][]byte
+	lock     sync.RWMutex
+	root     *memNode
+	watchers map[*memWatcher]struct{}
 }
 
+type memNode struct {
+	mode        os.FileMode
+	createdTime time.Time
+	modTime     time.Time
+	data        []byte
+	children    map[string]*memNode
+}
+
+// NewOnMemoryVolume returns a new volume. Parent directories of the initial files are created automatically.
 func NewOnMemoryVolume(init map[string][]byte) *OnMemoryVolume {
-	return &OnMemoryVolume{files: init}
+	v := &OnMemoryVolume{root: newMemDir(os.ModePerm), watchers: map[*memWatcher]struct{}{}}
+	for name, data := range init {
+		dir := v.root
+		elems := splitMemPath(name)
+		for i := 0; i < len(elems)-1 && dir != nil; i++ {
+			if dir.children[elems[i]] == nil {
+				dir.children[elems[i]] = newMemDir(os.ModePerm)
+			}
+			dir = dir.children[elems[i]]
+			if !dir.isDir() {
+				dir = nil
+			}
+		}
+		if len(elems) == 0 || dir == nil {
+			continue
+		}
+		f := newMemFile(0644)
+		f.data = data
+		dir.children[elems[len(elems)-1]] = f
+	}
+	return v
+}
+
+func newMemDir(perm os.FileMode) *memNode {
+	now := time.Now()
+	return &memNode{mode: os.ModeDir | perm&os.ModePerm, createdTime: now, modTime: now, children: map[string]*memNode{}}
+}
+
+func newMemFile(perm os.FileMode) *memNode {
+	now := time.Now()
+	return &memNode{mode: perm & os.ModePerm, createdTime: now, modTime: now}
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode&os.ModeDir != 0
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+func (n *memNode) stat(path string) *FileInfo {
+	return &FileInfo{
+		Path:        path,
+		FileSize:    int64(len(n.data)),
+		FileMode:    n.mode,
+		CreatedTime: n.createdTime,
+		UpdatedTime: n.modTime,
+	}
+}
+
+func cleanMemPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func splitMemPath(p string) []string {
+	p = cleanMemPath(p)
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// lookup returns the node. Symlinks are followed. v.lock must be held.
+func (v *OnMemoryVolume) lookup(p string) (*memNode, error) {
+	n, _, err := v.resolve(p, true)
+	return n, err
+}
+
+// resolve returns the node and the path with symlinks resolved. The symlink of the last element is followed if follow is true.
+// If the node doesn't exist, NoentError is returned with the path. v.lock must be held.
+func (v *OnMemoryVolume) resolve(p string, follow bool) (*memNode, string, error) {
+	n := v.root
+	var resolved []string
+	rest := splitMemPath(p)
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if !n.isDir() {
+			return nil, "", syscall.ENOTDIR
+		}
+		c := n.children[name]
+		if c == nil {
+			return nil, path.Join(append(append(resolved, name), rest...)...), NoentError
+		}
+		if c.isSymlink() && (len(rest) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return nil, "", syscall.ELOOP
+			}
+			// Absolute targets start from the root of the volume.
+			target := string(c.data)
+			if !strings.HasPrefix(target, "/") {
+				target = path.Join(append(resolved, target)...)
+			}
+			rest = append(splitMemPath(target), rest...)
+			n, resolved = v.root, nil
+			continue
+		}
+		n = c
+		resolved = append(resolved, name)
+	}
+	return n, path.Join(resolved...), nil
+}
+
+// lookupParent returns the parent directory and the base name. v.lock must be held.
+func (v *OnMemoryVolume) lookupParent(p string) (*memNode, string, error) {
+	p = cleanMemPath(p)
+	if p == "" {
+		return nil, "", os.ErrInvalid
+	}
+	dir, err := v.lookup(path.Dir(p))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return dir, path.Base(p), nil
 }
 
 func (v *OnMemoryVolume) Available() bool {
@@ -21,54 +155,464 @@ func (v *OnMemoryVolume) Available() bool {
 }
 
 func (v *OnMemoryVolume) Stat(path string) (*FileInfo, error) {
-	if path == "" {
-		return &FileInfo{Path: path, FileMode: os.ModeDir, FileSize: 0, UpdatedTime: time.Time{}}, nil
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	n, err := v.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "Stat", Path: path, Err: err}
+	}
+	return n.stat(path), nil
+}
+
+func (v *OnMemoryVolume) ReadDir(path string) ([]*FileInfo, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	n, err := v.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "ReadDir", Path: path, Err: err}
+	}
+	if !n.isDir() {
+		return nil, &os.PathError{Op: "ReadDir", Path: path, Err: syscall.ENOTDIR}
+	}
+	files := []*FileInfo{}
+	for name, c := range n.children {
+		files = append(files, c.stat(name))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func (v *OnMemoryVolume) Open(path string) (reader FileReadCloser, err error) {
+	return v.openFile("Open", path, os.O_RDONLY, 0)
+}
+
+func (v *OnMemoryVolume) Create(path string) (FileWriteCloser, error) {
+	return v.openFile("Create", path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (v *OnMemoryVolume) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	return v.openFile("OpenFile", path, flag, perm)
+}
+
+func (v *OnMemoryVolume) openFile(op, path string, flag int, perm os.FileMode) (*memFileHandle, error) {
+	v.lock.Lock()
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	n, real, err := v.resolve(path, true)
+	if err == NoentError && flag&os.O_CREATE != 0 {
+		// Dangling symlinks create the target.
+		dir, name, err := v.lookupParent(real)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+		n = newMemFile(perm)
+		dir.children[name] = n
+		dir.modTime = n.modTime
+		ev = append(ev, FileEvent{Type: CreateEvent, Path: real, OptionalFileInfo: n.stat(real)})
+	} else if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrExist}
+	}
+	if n.isDir() {
+		return nil, &os.PathError{Op: op, Path: path, Err: syscall.EISDIR}
 	}
-	data := v.get(path)
-	if data == nil {
-		return nil, noentError("Stat", path)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&os.O_TRUNC != 0 && writable && len(n.data) > 0 {
+		n.data = nil
+		n.modTime = time.Now()
+		ev = append(ev, FileEvent{Type: UpdateEvent, Path: cleanMemPath(path), OptionalFileInfo: n.stat(cleanMemPath(path))})
 	}
-	return &FileInfo{Path: path, FileSize: int64(len(data)), UpdatedTime: time.Time{}}, nil
+	return &memFileHandle{v: v, n: n, path: cleanMemPath(path), flag: flag}, nil
+}
+
+func (v *OnMemoryVolume) Mkdir(path string, mode os.FileMode) error {
+	v.lock.Lock()
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	dir, name, err := v.lookupParent(path)
+	if err != nil {
+		return &os.PathError{Op: "Mkdir", Path: path, Err: err}
+	}
+	if dir.children[name] != nil {
+		return &os.PathError{Op: "Mkdir", Path: path, Err: os.ErrExist}
+	}
+	n := newMemDir(mode)
+	dir.children[name] = n
+	dir.modTime = n.modTime
+	ev = append(ev, FileEvent{Type: CreateEvent, Path: cleanMemPath(path), OptionalFileInfo: n.stat(cleanMemPath(path))})
+	return nil
 }
 
 func (v *OnMemoryVolume) Remove(path string) error {
 	v.lock.Lock()
-	defer v.lock.Unlock()
-	delete(v.files, path)
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	dir, name, err := v.lookupParent(path)
+	if err != nil {
+		return &os.PathError{Op: "Remove", Path: path, Err: err}
+	}
+	n := dir.children[name]
+	if n == nil {
+		return noentError("Remove", path)
+	}
+	if len(n.children) > 0 {
+		return &os.PathError{Op: "Remove", Path: path, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, name)
+	dir.modTime = time.Now()
+	ev = append(ev, FileEvent{Type: RemoveEvent, Path: cleanMemPath(path)})
 	return nil
 }
 
-func (v *OnMemoryVolume) ReadDir(path string) ([]*FileInfo, error) {
+func (v *OnMemoryVolume) Rename(oldpath, newpath string) error {
+	v.lock.Lock()
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	src, srcName, err := v.lookupParent(oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "Rename", Old: oldpath, New: newpath, Err: err}
+	}
+	n := src.children[srcName]
+	if n == nil {
+		return &os.LinkError{Op: "Rename", Old: oldpath, New: newpath, Err: NoentError}
+	}
+	dst, dstName, err := v.lookupParent(newpath)
+	if err != nil {
+		return &os.LinkError{Op: "Rename", Old: oldpath, New: newpath, Err: err}
+	}
+	oldpath, newpath = cleanMemPath(oldpath), cleanMemPath(newpath)
+	if oldpath == newpath {
+		return nil
+	}
+	if n.isDir() && strings.HasPrefix(newpath, oldpath+"/") {
+		return &os.LinkError{Op: "Rename", Old: oldpath, New: newpath, Err: os.ErrInvalid}
+	}
+	if old := dst.children[dstName]; old != nil {
+		if old.isDir() != n.isDir() || len(old.children) > 0 {
+			return &os.LinkError{Op: "Rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+		}
+		ev = append(ev, FileEvent{Type: RemoveEvent, Path: newpath})
+	}
+	delete(src.children, srcName)
+	dst.children[dstName] = n
+	now := time.Now()
+	src.modTime = now
+	dst.modTime = now
+	ev = append(ev, FileEvent{Type: RemoveEvent, Path: oldpath}, FileEvent{Type: CreateEvent, Path: newpath, OptionalFileInfo: n.stat(newpath)})
+	return nil
+}
+
+func (v *OnMemoryVolume) Lstat(path string) (*FileInfo, error) {
 	v.lock.RLock()
 	defer v.lock.RUnlock()
-	files := []*FileInfo{}
-	for name := range v.files {
-		f, err := v.Stat(name)
-		if err == nil {
-			files = append(files, f)
-		}
+	n, _, err := v.resolve(path, false)
+	if err != nil {
+		return nil, &os.PathError{Op: "Lstat", Path: path, Err: err}
 	}
-	return files, nil
+	return n.stat(path), nil
 }
 
-type MemReadCloser struct {
-	*bytes.Reader
+func (v *OnMemoryVolume) Readlink(path string) (string, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	n, _, err := v.resolve(path, false)
+	if err != nil {
+		return "", &os.PathError{Op: "Readlink", Path: path, Err: err}
+	}
+	if !n.isSymlink() {
+		return "", &os.PathError{Op: "Readlink", Path: path, Err: os.ErrInvalid}
+	}
+	return string(n.data), nil
 }
 
-func (*MemReadCloser) Close() error {
+// Symlink creates newname as a symlink to oldname. Relative paths are resolved from the directory of newname.
+func (v *OnMemoryVolume) Symlink(oldname, newname string) error {
+	v.lock.Lock()
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	dir, name, err := v.lookupParent(newname)
+	if err != nil {
+		return &os.LinkError{Op: "Symlink", Old: oldname, New: newname, Err: err}
+	}
+	if dir.children[name] != nil {
+		return &os.LinkError{Op: "Symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	n := newMemFile(os.ModePerm)
+	n.mode |= os.ModeSymlink
+	n.data = []byte(oldname)
+	dir.children[name] = n
+	dir.modTime = n.modTime
+	ev = append(ev, FileEvent{Type: CreateEvent, Path: cleanMemPath(newname), OptionalFileInfo: n.stat(cleanMemPath(newname))})
 	return nil
 }
 
-func (v *OnMemoryVolume) Open(path string) (reader FileReadCloser, err error) {
-	data := v.get(path)
-	if data == nil {
-		return nil, noentError("Open", path)
+func (v *OnMemoryVolume) Chmod(path string, mode os.FileMode) error {
+	return v.update("Chmod", path, func(n *memNode) error {
+		n.mode = n.mode&^os.ModePerm | mode&os.ModePerm
+		return nil
+	})
+}
+
+func (v *OnMemoryVolume) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return v.update("Chtimes", path, func(n *memNode) error {
+		if !mtime.IsZero() {
+			n.modTime = mtime
+		}
+		return nil
+	})
+}
+
+func (v *OnMemoryVolume) Truncate(path string, size int64) error {
+	return v.update("Truncate", path, func(n *memNode) error {
+		if n.isDir() {
+			return syscall.EISDIR
+		}
+		if size < 0 {
+			return os.ErrInvalid
+		}
+		n.truncate(size)
+		n.modTime = time.Now()
+		return nil
+	})
+}
+
+func (v *OnMemoryVolume) update(op, path string, f func(n *memNode) error) error {
+	v.lock.Lock()
+	var ev []FileEvent
+	defer func() {
+		v.lock.Unlock()
+		v.notify(ev)
+	}()
+
+	n, err := v.lookup(path)
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	if err := f(n); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	ev = append(ev, FileEvent{Type: UpdateEvent, Path: cleanMemPath(path), OptionalFileInfo: n.stat(cleanMemPath(path))})
+	return nil
+}
+
+func (n *memNode) truncate(size int64) {
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return
 	}
-	return &MemReadCloser{bytes.NewReader(data)}, nil
+	data := make([]byte, size)
+	copy(data, n.data)
+	n.data = data
 }
 
-func (v *OnMemoryVolume) get(path string) []byte {
+func (v *OnMemoryVolume) Walk(callback func(*FileInfo)) error {
 	v.lock.RLock()
-	defer v.lock.RUnlock()
-	return v.files[path]
+	var files []*FileInfo
+	var walk func(n *memNode, p string)
+	walk = func(n *memNode, p string) {
+		for name, c := range n.children {
+			if c.isDir() {
+				walk(c, path.Join(p, name))
+			} else {
+				files = append(files, c.stat(path.Join(p, name)))
+			}
+		}
+	}
+	walk(v.root, "")
+	v.lock.RUnlock()
+
+	for _, f := range files {
+		callback(f)
+	}
+	return nil
+}
+
+type memWatcher struct {
+	v        *OnMemoryVolume
+	callback func(FileEvent)
+}
+
+func (w *memWatcher) Close() error {
+	w.v.lock.Lock()
+	defer w.v.lock.Unlock()
+	delete(w.v.watchers, w)
+	return nil
+}
+
+// Watch registers the callback. The callback is called synchronously after each mutation.
+func (v *OnMemoryVolume) Watch(callback func(FileEvent)) (io.Closer, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	w := &memWatcher{v: v, callback: callback}
+	v.watchers[w] = struct{}{}
+	return w, nil
+}
+
+func (v *OnMemoryVolume) notify(events []FileEvent) {
+	if len(events) == 0 {
+		return
+	}
+	v.lock.RLock()
+	watchers := make([]*memWatcher, 0, len(v.watchers))
+	for w := range v.watchers {
+		watchers = append(watchers, w)
+	}
+	v.lock.RUnlock()
+	for _, ev := range events {
+		for _, w := range watchers {
+			w.callback(ev)
+		}
+	}
+}
+
+type memFileHandle struct {
+	v      *OnMemoryVolume
+	n      *memNode
+	path   string
+	flag   int
+	pos    int64
+	dirty  bool
+	closed bool
+}
+
+func (f *memFileHandle) checkAccess(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.path, Err: os.ErrClosed}
+	}
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if write && !writable || !write && !readable {
+		return &os.PathError{Op: op, Path: f.path, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFileHandle) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.checkAccess("ReadAt", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "ReadAt", Path: f.path, Err: os.ErrInvalid}
+	}
+	f.v.lock.RLock()
+	defer f.v.lock.RUnlock()
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.n.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFileHandle) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFileHandle) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.checkAccess("WriteAt", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 || off < 0 {
+		return 0, &os.PathError{Op: "WriteAt", Path: f.path, Err: os.ErrInvalid}
+	}
+	return f.writeAt(b, off), nil
+}
+
+func (f *memFileHandle) writeAt(b []byte, off int64) int {
+	f.v.lock.Lock()
+	defer f.v.lock.Unlock()
+	if end := off + int64(len(b)); end > int64(len(f.n.data)) {
+		f.n.truncate(end)
+	}
+	copy(f.n.data[off:], b)
+	f.n.modTime = time.Now()
+	f.dirty = true
+	return len(b)
+}
+
+func (f *memFileHandle) Write(b []byte) (int, error) {
+	if err := f.checkAccess("Write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.v.lock.RLock()
+		f.pos = int64(len(f.n.data))
+		f.v.lock.RUnlock()
+	}
+	n := f.writeAt(b, f.pos)
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFileHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.v.lock.RLock()
+		offset += int64(len(f.n.data))
+		f.v.lock.RUnlock()
+	default:
+		return f.pos, &os.PathError{Op: "Seek", Path: f.path, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return f.pos, &os.PathError{Op: "Seek", Path: f.path, Err: os.ErrInvalid}
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *memFileHandle) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "Close", Path: f.path, Err: os.ErrClosed}
+	}
+	f.closed = true
+	if f.dirty {
+		f.v.lock.RLock()
+		stat := f.n.stat(f.path)
+		f.v.lock.RUnlock()
+		f.v.notify([]FileEvent{{Type: UpdateEvent, Path: f.path, OptionalFileInfo: stat}})
+	}
+	return nil
+}
+
+type MemReadCloser struct {
+	*bytes.Reader
+}
+
+func (*MemReadCloser) Close() error {
+	return nil
 }
@@ -1,21 +1,32 @@
 package volume
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestOnMemoryVolume(t *testing.T) {
 	vol := NewOnMemoryVolume(map[string][]byte{
-		"hello.txt": []byte("Hello"),
-		"hoge.txt":  []byte("World"),
+		"hello.txt":     []byte("Hello"),
+		"hoge.txt":      []byte("World"),
+		"dir/world.txt": []byte("World"),
 	})
+	var _ FS = vol
+
 	testVolume(t, vol,
-		[]string{"hello.txt", "hoge.txt"},
-		[]string{"not_existing_file", "not_existing_dir/hello.txt"},
-		[]string{""},
-		[]string{},
+		[]string{"hello.txt", "hoge.txt", "/dir/world.txt"},
+		[]string{"not_existing_file", "not_existing_dir/hello.txt", "hello.txt/hoge"},
+		[]string{"", "/", "dir"},
+		[]string{"not_existing_dir"},
+	)
+	testVolumeWriter(t, vol,
+		[]string{"created.txt", "dir/created.txt"},
+		[]string{"not_existing/test.txt"},
+		[]string{"newdir"},
+		[]string{"not_existing/testdir", "dir"},
 	)
 }
 
@@ -69,3 +80,217 @@ func TestOnMemoryVolume_Remove(t *testing.T) {
 		t.Errorf("should return pathError. err: %v", err)
 	}
 }
+
+func TestOnMemoryVolume_Attr(t *testing.T) {
+	var vol = NewOnMemoryVolume(map[string][]byte{
+		"hello.txt": []byte("Hello"),
+	})
+	var _ VolumeAttrWriter = vol
+
+	if err := vol.Chmod("hello.txt", 0600); err != nil {
+		t.Errorf("Chmod error: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := vol.Chtimes("hello.txt", mtime, mtime); err != nil {
+		t.Errorf("Chtimes error: %v", err)
+	}
+	// zero time is not changed.
+	if err := vol.Chtimes("hello.txt", time.Now(), time.Time{}); err != nil {
+		t.Errorf("Chtimes error: %v", err)
+	}
+	stat, _ := vol.Stat("hello.txt")
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode: %v", stat.Mode())
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime: %v", stat.ModTime())
+	}
+
+	if err := vol.Truncate("hello.txt", 8); err != nil {
+		t.Errorf("Truncate error: %v", err)
+	}
+	r, _ := vol.Open("hello.txt")
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "Hello\x00\x00\x00" {
+		t.Errorf("unexpexted string: %q", string(b))
+	}
+
+	if err := vol.Chmod("not_existing", 0600); !os.IsNotExist(err) {
+		t.Errorf("Chmod should return noent error: %v", err)
+	}
+}
+
+func TestOnMemoryVolume_Write(t *testing.T) {
+	var vol = NewOnMemoryVolume(nil)
+
+	if err := vol.Mkdir("dir", 0755); err != nil {
+		t.Fatalf("Mkdir error: %v", err)
+	}
+	f, err := vol.OpenFile("dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile error: %v", err)
+	}
+	if n, err := f.WriteAt([]byte("World"), 6); err != nil || n != 5 {
+		t.Errorf("WriteAt error: %v %v", n, err)
+	}
+	if n, err := f.Write([]byte("Hello,")); err != nil || n != 6 {
+		t.Errorf("Write error: %v %v", n, err)
+	}
+	if n, err := f.WriteAt([]byte("y"), -1); !errors.Is(err, os.ErrInvalid) || n != 0 {
+		t.Errorf("WriteAt with negative offset should return ErrInvalid: %v %v", n, err)
+	}
+	b := make([]byte, 11)
+	if n, err := f.ReadAt(b, 0); err != nil || string(b[:n]) != "Hello,World" {
+		t.Errorf("ReadAt error: %v %q", err, string(b[:n]))
+	}
+	f.Close()
+
+	if _, err := vol.OpenFile("dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); !os.IsExist(err) {
+		t.Errorf("OpenFile should return exist error: %v", err)
+	}
+
+	stat, err := vol.Stat("dir/a.txt")
+	if err != nil {
+		t.Fatalf("Stat error: %v", err)
+	}
+	if stat.Size() != 11 || stat.Mode() != 0600 || stat.ModTime().IsZero() || stat.CreatedTime.IsZero() {
+		t.Errorf("unexpected stat: %v", stat)
+	}
+
+	f, _ = vol.OpenFile("dir/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("!"))
+	if _, err := f.ReadAt(b, 0); err == nil {
+		t.Errorf("ReadAt should fail on write only file")
+	}
+	f.Close()
+
+	r, _ := vol.Open("dir/a.txt")
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "Hello,World!" {
+		t.Errorf("unexpexted string: %v", string(data))
+	}
+
+	files, err := vol.ReadDir("dir")
+	if err != nil || len(files) != 1 || files[0].Name() != "a.txt" {
+		t.Errorf("ReadDir error: %v %v", files, err)
+	}
+
+	if err := vol.Remove("dir"); err == nil {
+		t.Errorf("Remove should fail on non-empty dir")
+	}
+	if err := vol.Rename("dir", "dir2"); err != nil {
+		t.Errorf("Rename error: %v", err)
+	}
+	if _, err := vol.Stat("dir2/a.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+	if _, err := vol.Stat("dir/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat should return noent error: %v", err)
+	}
+}
+
+func TestOnMemoryVolume_Watch(t *testing.T) {
+	var vol = NewOnMemoryVolume(nil)
+
+	var events []FileEvent
+	c, err := vol.Watch(func(ev FileEvent) {
+		events = append(events, ev)
+	})
+	if err != nil {
+		t.Fatalf("Watch error: %v", err)
+	}
+
+	w, _ := vol.Create("a.txt")
+	w.Write([]byte("Hello"))
+	w.Close()
+	vol.Rename("a.txt", "b.txt")
+	vol.Remove("b.txt")
+	c.Close()
+	vol.Mkdir("dir", 0755)
+
+	expected := []FileEvent{
+		{Type: CreateEvent, Path: "a.txt"},
+		{Type: UpdateEvent, Path: "a.txt"},
+		{Type: RemoveEvent, Path: "a.txt"},
+		{Type: CreateEvent, Path: "b.txt"},
+		{Type: RemoveEvent, Path: "b.txt"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	for i, ev := range events {
+		if ev.Type != expected[i].Type || ev.Path != expected[i].Path {
+			t.Errorf("unexpected event: %v != %v", ev, expected[i])
+		}
+	}
+}
+
+func TestOnMemoryVolume_Symlink(t *testing.T) {
+	vol := NewOnMemoryVolume(map[string][]byte{
+		"dir/hello.txt": []byte("Hello"),
+	})
+	var _ VolumeLinker = vol
+
+	links := map[string]string{
+		"link.txt":     "dir/hello.txt",
+		"dirlink":      "dir",
+		"abs":          "/dir/hello.txt",
+		"dir/up":       "../dir/hello.txt",
+		"dangling.txt": "dir/new.txt",
+		"loop":         "loop",
+	}
+	for name, target := range links {
+		if err := vol.Symlink(target, name); err != nil {
+			t.Fatalf("Symlink error: %v", err)
+		}
+	}
+	if err := vol.Symlink("dir", "link.txt"); !os.IsExist(err) {
+		t.Errorf("Symlink should return ErrExist: %v", err)
+	}
+
+	for _, p := range []string{"link.txt", "dirlink/hello.txt", "abs", "dir/up", "dirlink/up"} {
+		if stat, err := vol.Stat(p); err != nil || stat.Size() != 5 || stat.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("Stat(%v) should follow the symlink: %v %v", p, stat, err)
+		}
+	}
+	if files, err := vol.ReadDir("dirlink"); err != nil || len(files) != 2 {
+		t.Errorf("ReadDir(dirlink): %v %v", files, err)
+	}
+	if _, err := vol.Stat("loop"); err == nil {
+		t.Errorf("Stat(loop) should fail")
+	}
+
+	stat, err := vol.Lstat("link.txt")
+	if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if target, err := vol.Readlink("dirlink/up"); err != nil || target != "../dir/hello.txt" {
+		t.Errorf("Readlink: %q %v", target, err)
+	}
+	if _, err := vol.Readlink("dir/hello.txt"); err == nil {
+		t.Errorf("Readlink of a regular file should fail")
+	}
+
+	// Creating a file via a dangling symlink creates the target.
+	w, err := vol.Create("dangling.txt")
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	w.Write([]byte("World"))
+	w.Close()
+	if stat, err := vol.Stat("dir/new.txt"); err != nil || stat.Size() != 5 {
+		t.Errorf("target should be created: %v %v", stat, err)
+	}
+
+	// Remove doesn't follow the symlink.
+	if err := vol.Remove("link.txt"); err != nil {
+		t.Errorf("Remove error: %v", err)
+	}
+	if _, err := vol.Lstat("link.txt"); !os.IsNotExist(err) {
+		t.Errorf("symlink should be removed: %v", err)
+	}
+	if _, err := vol.Stat("dir/hello.txt"); err != nil {
+		t.Errorf("target should not be removed: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package volume
+
+import (
+	"io/fs"
+
+	"github.com/binzume/cfs/tarfs"
+)
+
+// TarVolume is a read-only volume backed by tarfs. tar.gz and tar.zst are also supported.
+type TarVolume struct {
+	*fsVolume
+	volume Volume
+	path   string
+}
+
+// NewTarVolume returns a new volume. (volume = nil : native path)
+func NewTarVolume(path string, volume Volume) Volume {
+	if volume == nil {
+		return &TarVolume{fsVolume: &fsVolume{fsys: tarfs.NewFS(path, nil)}, path: path}
+	}
+	return newTarVolumeFS(path, volume, AsFS(volume))
+}
+
+func newTarVolumeFS(path string, volume Volume, fsys fs.FS) *TarVolume {
+	return &TarVolume{fsVolume: &fsVolume{fsys: tarfs.NewFS(toFSPath(path), fsys)}, volume: volume, path: path}
+}
@@ -0,0 +1,55 @@
+package volume
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func createTestTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestTarVolume(t *testing.T) {
+	mem := NewOnMemoryVolume(map[string][]byte{
+		"test.tar.gz": createTestTarGz(t, map[string]string{"a/b.txt": "Hello", "c.txt": "World"}),
+	})
+	vol := NewTarVolume("test.tar.gz", mem)
+
+	testVolume(t, vol,
+		[]string{"a/b.txt", "c.txt"},
+		[]string{"not_existing", "b.txt"},
+		[]string{"", "a"},
+		[]string{"not_existing", "a/not_existing"},
+	)
+
+	auto := NewAutoUnzipVolume(mem)
+	testVolume(t, auto,
+		[]string{"test.tar.gz", "test.tar.gz/:/a/b.txt"},
+		[]string{"test.tar.gz/:/b.txt"},
+		[]string{"test.tar.gz/:/", "test.tar.gz/:/a"},
+		[]string{"test.tar.gz/:/not_existing"},
+	)
+	r, err := auto.Open("test.tar.gz/:/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "Hello" {
+		t.Errorf("unexpected data: %q %v", b, err)
+	}
+}
@@ -24,6 +24,23 @@ type VolumeWriter interface {
 	Mkdir(path string, mode os.FileMode) error
 	OpenFile(path string, flag int, perm os.FileMode) (f File, err error)
 	Remove(path string) error
+	Rename(oldpath, newpath string) error
+}
+
+// VolumeAttrWriter is implemented by volumes which can change file attributes.
+// Chtimes leaves the time unchanged if it is zero.
+type VolumeAttrWriter interface {
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, atime time.Time, mtime time.Time) error
+	Truncate(path string, size int64) error
+}
+
+// VolumeLinker is implemented by volumes which support symbolic links.
+// Lstat, Readlink, Remove and Rename don't follow the symlink of the last element. Other methods follow symlinks.
+type VolumeLinker interface {
+	Lstat(path string) (*FileInfo, error)
+	Readlink(path string) (string, error)
+	Symlink(oldname, newname string) error
 }
 
 type VolumeWalker interface {
@@ -114,6 +131,7 @@ type FileEvent struct {
 type FS interface {
 	Volume
 	VolumeWriter
+	VolumeAttrWriter
 	VolumeWalker
 	VolumeWatcher
 }
@@ -134,6 +152,9 @@ func GetMetadata(f os.FileInfo, key string) interface{} {
 	return nil
 }
 
+// maxSymlinks is the max number of symlinks followed in a path. (same as Linux)
+const maxSymlinks = 40
+
 var NoentError = os.ErrNotExist
 var PermissionError = os.ErrPermission
 var UnsupportedError = errors.New("unsupported operation")
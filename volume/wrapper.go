@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"syscall"
+	"time"
 )
 
 type volumeWrapper struct {
@@ -48,6 +49,14 @@ func (v *volumeWrapper) Remove(path string) error {
 	}
 	return permissionError("Remove", path)
 }
+
+func (v *volumeWrapper) Rename(oldpath, newpath string) error {
+	if w, ok := v.Volume.(VolumeWriter); ok && v.writable {
+		return w.Rename(oldpath, newpath)
+	}
+	return permissionError("Rename", oldpath)
+}
+
 func (v *volumeWrapper) Mkdir(path string, perm os.FileMode) error {
 	if w, ok := v.Volume.(VolumeWriter); ok && v.writable {
 		return w.Mkdir(path, perm)
@@ -73,6 +82,39 @@ func (v *volumeWrapper) OpenFile(path string, flag int, perm os.FileMode) (File,
 	return nil, permissionError("OpenFile", path)
 }
 
+func (v *volumeWrapper) Chmod(path string, mode os.FileMode) error {
+	w, ok := v.Volume.(VolumeAttrWriter)
+	if !ok {
+		return unsupportedError("Chmod", path)
+	}
+	if !v.writable {
+		return permissionError("Chmod", path)
+	}
+	return w.Chmod(path, mode)
+}
+
+func (v *volumeWrapper) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	w, ok := v.Volume.(VolumeAttrWriter)
+	if !ok {
+		return unsupportedError("Chtimes", path)
+	}
+	if !v.writable {
+		return permissionError("Chtimes", path)
+	}
+	return w.Chtimes(path, atime, mtime)
+}
+
+func (v *volumeWrapper) Truncate(path string, size int64) error {
+	w, ok := v.Volume.(VolumeAttrWriter)
+	if !ok {
+		return unsupportedError("Truncate", path)
+	}
+	if !v.writable {
+		return permissionError("Truncate", path)
+	}
+	return w.Truncate(path, size)
+}
+
 func walk(v Volume, callback func(*FileInfo)) error {
 	if w, ok := v.(VolumeWalker); ok {
 		return w.Walk(callback)
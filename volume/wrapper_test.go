@@ -3,13 +3,15 @@ package volume
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestVolumeWrapper(t *testing.T) {
-	var vol = NewOnMemoryVolume(map[string][]byte{
+	// read only volume
+	var vol = &struct{ Volume }{NewOnMemoryVolume(map[string][]byte{
 		"hello.txt": []byte("Hello"),
 		"hoge.txt":  []byte("World"),
-	})
+	})}
 	var fs FS = ToFS(vol)
 
 	if UnwrapVolume(fs) != vol {
@@ -37,6 +39,27 @@ func TestVolumeWrapper(t *testing.T) {
 		t.Errorf("should return pathError. err: %v", err)
 	}
 
+	err = ToFS(NewStubVolume()).Chmod("hello.txt", 0644)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != UnsupportedError {
+		t.Errorf("should return unsupported error. err: %v", err)
+	}
+
+	// attributes of read only volume can't be changed.
+	mem := NewOnMemoryVolume(map[string][]byte{"hello.txt": []byte("Hello")})
+	roFs := ToFS(&struct {
+		Volume
+		VolumeAttrWriter
+	}{mem, mem})
+	if err := roFs.Chmod("hello.txt", 0600); !os.IsPermission(err) {
+		t.Errorf("should return permission error. err: %v", err)
+	}
+	if err := roFs.Chtimes("hello.txt", time.Now(), time.Now()); !os.IsPermission(err) {
+		t.Errorf("should return permission error. err: %v", err)
+	}
+	if err := roFs.Truncate("hello.txt", 0); !os.IsPermission(err) {
+		t.Errorf("should return permission error. err: %v", err)
+	}
+
 	maskedFs := &struct {
 		Volume
 		VolumeWriter
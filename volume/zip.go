@@ -1,190 +1,165 @@
 package volume
 
 import (
-	"archive/zip"
-	"bytes"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"strings"
 	"syscall"
+
+	"github.com/binzume/cfs/tarfs"
+	"github.com/binzume/cfs/zipfs"
 )
 
+// ZipVolume is a read-only volume backed by zipfs.
 type ZipVolume struct {
+	*fsVolume
 	volume Volume
 	path   string
 }
 
-// NewZipVolume returns a new volume.
-func NewZipVolume(path string, volume Volume) Volume {
-	return &ZipVolume{volume: volume, path: path}
-}
-
-type zipFileReader struct {
-	opener       func() (io.ReadCloser, error)
-	parentCloser io.Closer
-	size         int64
-	reader       io.ReadCloser
-	readPos      int64
-	byteReader   *bytes.Reader
-}
-
-func (zfr *zipFileReader) Read(p []byte) (n int, err error) {
-	if zfr.reader == nil {
-		zfr.reader, err = zfr.opener()
-		if err != nil {
-			return
-		}
-	}
-	n, err = zfr.reader.Read(p)
-	zfr.readPos += int64(n)
-	return
+// NewZipVolume returns a new volume. (volume = nil : native path)
+func NewZipVolume(path string, volume Volume, opts ...zipfs.Option) Volume {
+	return newZipVolume(path, volume, opts...)
 }
 
-func (zfr *zipFileReader) Close() error {
-	if zfr.reader != nil {
-		zfr.reader.Close()
+func newZipVolume(path string, volume Volume, opts ...zipfs.Option) *ZipVolume {
+	if volume == nil {
+		return &ZipVolume{fsVolume: &fsVolume{fsys: zipfs.NewFS(path, nil, opts...)}, path: path}
 	}
-	return zfr.parentCloser.Close()
+	return newZipVolumeFS(path, volume, AsFS(volume), opts...)
 }
 
-func (zfr *zipFileReader) ReadAt(p []byte, off int64) (n int, err error) {
-	if zfr.byteReader == nil {
-		if off == zfr.readPos {
-			return zfr.Read(p)
-		}
-
-		// load all
-		// log.Printf("UNZIP READ ALL requested range: %v-%v size:(%v)", off, off+int64(len(p)), len(p))
-		r, err := zfr.opener()
-		if err != nil {
-			return 0, err
-		}
-		defer r.Close()
-		buf, err := ioutil.ReadAll(r)
-		if err != nil {
-			return 0, err
-		}
-		zfr.byteReader = bytes.NewReader(buf)
-	}
-	return zfr.byteReader.ReadAt(p, off)
+// newZipVolumeFS returns a new ZipVolume. Archives are cached per fsys, so the same fsys should be used for the volume.
+func newZipVolumeFS(path string, volume Volume, fsys fs.FS, opts ...zipfs.Option) *ZipVolume {
+	return &ZipVolume{fsVolume: &fsVolume{fsys: zipfs.NewFS(toFSPath(path), fsys, opts...)}, volume: volume, path: path}
 }
 
-func (v *ZipVolume) Available() bool {
-	return true
+// zipLinkFS is implemented by zipfs.ZipFS.
+type zipLinkFS interface {
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
 }
 
-func (v *ZipVolume) openZip() (io.Closer, *zip.Reader, error) {
-	var fr FileReadCloser
-	var err error
-	var stat os.FileInfo
-
-	if v.volume != nil {
-		stat, err = v.volume.Stat(v.path)
-	} else {
-		stat, err = os.Stat(v.path)
+func (v *ZipVolume) Lstat(path string) (*FileInfo, error) {
+	fsys, ok := v.fsys.(zipLinkFS)
+	if !ok {
+		return v.Stat(path)
 	}
+	fi, err := fsys.Lstat(toFSPath(path))
 	if err != nil {
-		return nil, nil, err
+		return nil, toFSError("Lstat", path, err)
 	}
+	return newFSFileEntry(path, fi), nil
+}
 
-	if v.volume != nil {
-		fr, err = v.volume.Open(v.path)
-	} else {
-		fr, err = os.Open(v.path)
+func (v *ZipVolume) Readlink(path string) (string, error) {
+	fsys, ok := v.fsys.(zipLinkFS)
+	if !ok {
+		return "", unsupportedError("Readlink", path)
 	}
+	target, err := fsys.ReadLink(toFSPath(path))
 	if err != nil {
-		return nil, nil, err
+		return "", toFSError("Readlink", path, err)
 	}
+	return target, nil
+}
 
-	r, err := zip.NewReader(fr, stat.Size())
-	if err != nil {
-		fr.Close()
-		return nil, nil, err
-	}
-	return fr, r, err
+func (v *ZipVolume) Symlink(oldname, newname string) error {
+	return permissionError("Symlink", newname)
 }
 
-func (v *ZipVolume) Stat(path string) (*FileInfo, error) {
-	if path == "" {
-		return &FileInfo{Path: path, FileMode: os.ModeDir}, nil
-	}
-	closer, r, err := v.openZip()
-	if err != nil {
-		return nil, err
-	}
-	defer closer.Close()
-	for _, f := range r.File {
-		if !strings.HasSuffix("/"+f.Name, "/"+path) {
-			continue
-		}
-		fi := f.FileInfo()
-		return &FileInfo{
-			Path:        f.Name,
-			FileMode:    fi.Mode(),
-			FileSize:    fi.Size(),
-			UpdatedTime: fi.ModTime(),
-		}, nil
-	}
-	return nil, noentError("Stat", path)
+type AutoUnzipVolume struct {
+	FS
+	// MaxDepth is the max nesting level of archives. (0: zipfs.DefaultMaxDepth)
+	MaxDepth int
+	// MaxArchiveSize is the max size of archives in archives. (0: zipfs.DefaultMaxArchiveSize)
+	MaxArchiveSize int64
+	// Charset of non UTF-8 names in zip files. (see zipfs.WithCharset)
+	Charset string
+	// Password provides passwords of encrypted zip files. (see zipfs.WithPassword)
+	Password zipfs.PasswordFunc
+	// Separator of archive paths. (empty: zipfs.DefaultSeparator)
+	Separator string
+	// Extensions of zip files. They are matched case-insensitively. (nil: zipfs.DefaultZipExtensions)
+	Extensions []string
+	// SniffContent enables detection of zip files by their content. e.g. ".jar", ".epub", ".docx"
+	SniffContent bool
+	fsys         fs.FS
+	depth        int
 }
 
-func (v *ZipVolume) ReadDir(path string) ([]*FileInfo, error) {
-	closer, r, err := v.openZip()
-	if err != nil {
-		return nil, err
-	}
-	defer closer.Close()
+func NewAutoUnzipVolume(v Volume) FS {
+	fsys := ToFS(v)
+	return &AutoUnzipVolume{FS: fsys, MaxDepth: zipfs.DefaultMaxDepth, MaxArchiveSize: zipfs.DefaultMaxArchiveSize, fsys: AsFS(fsys)}
+}
 
-	files := []*FileInfo{}
-	for _, f := range r.File {
-		fi := f.FileInfo()
-		if fi.IsDir() {
-			continue
-		}
-		fe := &FileInfo{
-			Path:        f.Name,
-			FileMode:    fi.Mode(),
-			FileSize:    fi.Size(),
-			UpdatedTime: fi.ModTime(),
-		}
-		files = append(files, fe)
+func (v *AutoUnzipVolume) archiveVolume(path string) Volume {
+	fsys := v.fsys
+	if fsys == nil {
+		fsys = AsFS(v.FS)
+	}
+	if tarfs.IsTarFile(path) {
+		return newTarVolumeFS(path, v.FS, fsys)
 	}
-	return files, nil
+	return newZipVolumeFS(path, v.FS, fsys, zipfs.WithCharset(v.Charset), zipfs.WithPassword(v.Password))
 }
 
-func (v *ZipVolume) Open(path string) (reader FileReadCloser, err error) {
-	closer, r, err := v.openZip()
-	if err != nil {
-		return nil, err
+func (v *AutoUnzipVolume) separator() string {
+	if v.Separator == "" {
+		return zipfs.DefaultSeparator
 	}
+	return v.Separator
+}
 
-	for _, f := range r.File {
-		fi := f.FileInfo()
-		if fi.IsDir() || !strings.HasSuffix("/"+f.Name, "/"+path) {
-			continue
+// openArchive returns an AutoUnzipVolume for the contents of the archive, so that nested archives can be opened.
+func (v *AutoUnzipVolume) openArchive(op, path string) (*AutoUnzipVolume, error) {
+	maxDepth, maxSize := v.MaxDepth, v.MaxArchiveSize
+	if maxDepth <= 0 {
+		maxDepth = zipfs.DefaultMaxDepth
+	}
+	if maxSize <= 0 {
+		maxSize = zipfs.DefaultMaxArchiveSize
+	}
+	if v.depth >= maxDepth {
+		return nil, &os.PathError{Op: op, Path: path, Err: zipfs.ErrTooDeep}
+	}
+	if v.depth > 0 {
+		stat, err := v.FS.Stat(path)
+		if err != nil {
+			return nil, err
 		}
-		opener := func() (io.ReadCloser, error) {
-			return f.Open()
+		if stat.Size() > maxSize {
+			return nil, &os.PathError{Op: op, Path: path, Err: zipfs.ErrTooLarge}
 		}
-		return &zipFileReader{opener: opener, parentCloser: closer, size: fi.Size()}, nil
 	}
-	closer.Close()
-	return nil, noentError("Open", path)
+	av := v.archiveVolume(path)
+	return &AutoUnzipVolume{FS: ToFS(av), MaxDepth: v.MaxDepth, MaxArchiveSize: v.MaxArchiveSize, Charset: v.Charset, Password: v.Password,
+		Separator: v.Separator, Extensions: v.Extensions, SniffContent: v.SniffContent, fsys: AsFS(av), depth: v.depth + 1}, nil
 }
 
-const zipSep = ":"
-
-type AutoUnzipVolume struct {
-	FS
+func (v *AutoUnzipVolume) IsZipFile(path string) bool {
+	extensions := v.Extensions
+	if extensions == nil {
+		extensions = zipfs.DefaultZipExtensions
+	}
+	return zipfs.HasExtension(path, extensions) || v.SniffContent && v.sniffZip(path)
 }
 
-func NewAutoUnzipVolume(v Volume) FS {
-	return &AutoUnzipVolume{ToFS(v)}
+func (v *AutoUnzipVolume) sniffZip(path string) bool {
+	r, err := v.FS.Open(path)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	var b [4]byte
+	_, err = io.ReadFull(r, b[:])
+	return err == nil && zipfs.IsZipSignature(b[:])
 }
 
-func (v *AutoUnzipVolume) IsZipFile(path string) bool {
-	return strings.HasSuffix(path, ".zip") || strings.HasSuffix(path, ".ZIP")
+// IsArchiveFile returns true if the path is a zip or tar file.
+func (v *AutoUnzipVolume) IsArchiveFile(path string) bool {
+	return tarfs.IsTarFile(path) || v.IsZipFile(path)
 }
 
 func (v *AutoUnzipVolume) Open(path string) (reader FileReadCloser, err error) {
@@ -192,10 +167,13 @@ func (v *AutoUnzipVolume) Open(path string) (reader FileReadCloser, err error) {
 	if err == nil {
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+zipSep+"/", 2)
-	if len(pathAndName) == 2 && v.IsZipFile(pathAndName[0]) {
-		zv := &ZipVolume{v.FS, pathAndName[0]}
-		return zv.Open(pathAndName[1])
+	pathAndName := strings.SplitN(path, "/"+v.separator()+"/", 2)
+	if len(pathAndName) == 2 && v.IsArchiveFile(pathAndName[0]) {
+		av, err := v.openArchive("Open", pathAndName[0])
+		if err != nil {
+			return nil, err
+		}
+		return av.Open(pathAndName[1])
 	}
 	return nil, err
 }
@@ -205,12 +183,15 @@ func (v *AutoUnzipVolume) Stat(path string) (stat *FileInfo, err error) {
 	if err == nil {
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+zipSep+"/", 2)
-	if len(pathAndName) == 2 && v.IsZipFile(pathAndName[0]) {
-		zv := &ZipVolume{v.FS, pathAndName[0]}
-		stat, err := zv.Stat(pathAndName[1])
+	pathAndName := strings.SplitN(path, "/"+v.separator()+"/", 2)
+	if len(pathAndName) == 2 && v.IsArchiveFile(pathAndName[0]) {
+		av, err := v.openArchive("Stat", pathAndName[0])
+		if err != nil {
+			return nil, err
+		}
+		stat, err := av.Stat(pathAndName[1])
 		if stat != nil {
-			stat.Path = pathAndName[0] + "/" + zipSep + "/" + stat.Path
+			stat.Path = pathAndName[0] + "/" + v.separator() + "/" + stat.Path
 		}
 		return stat, err
 	}
@@ -222,15 +203,22 @@ func (v *AutoUnzipVolume) ReadDir(path string) (files []*FileInfo, err error) {
 	if err == nil {
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+zipSep+"/", 2)
+	pathAndName := strings.SplitN(path, "/"+v.separator()+"/", 2)
 
 	fi, err2 := v.Stat(pathAndName[0])
-	if err2 == nil && !fi.IsDir() && v.IsZipFile(pathAndName[0]) {
-		zv := &ZipVolume{v.FS, pathAndName[0]}
-		files, err = zv.ReadDir("")
+	if err2 == nil && !fi.IsDir() && v.IsArchiveFile(pathAndName[0]) {
+		av, err := v.openArchive("ReadDir", pathAndName[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(pathAndName) == 2 {
+			return av.ReadDir(pathAndName[1])
+		}
+		files, err = av.ReadDir("")
 		for _, fi := range files {
-			fi.Path = zipSep + "/" + fi.Path
+			fi.Path = v.separator() + "/" + fi.Path
 		}
+		return files, err
 	}
 	return
 }
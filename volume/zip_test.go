@@ -1,11 +1,34 @@
 package volume
 
 import (
+	"archive/zip"
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"testing"
+
+	"github.com/binzume/cfs/zipfs"
 )
 
+func createTestZip(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
 func TestZipVolume(t *testing.T) {
 	vol := NewZipVolume("testdata/test.zip", nil)
 
@@ -17,6 +40,43 @@ func TestZipVolume(t *testing.T) {
 	)
 }
 
+func TestZipVolume_Hierarchy(t *testing.T) {
+	files := map[string]string{"a/b/c.txt": "c", "a/d.txt": "d", "e.txt": "e"}
+	mem := NewOnMemoryVolume(map[string][]byte{
+		"test.zip": createTestZip(t, files, "a/b/c.txt", "a/d.txt", "e.txt"),
+	})
+	vol := NewZipVolume("test.zip", mem)
+
+	testVolume(t, vol,
+		[]string{"a/b/c.txt", "a/d.txt", "e.txt"},
+		[]string{"a/b/not_existing", "a/c.txt", "b/c.txt", "c.txt"},
+		[]string{"", "a", "a/b"},
+		[]string{"not_existing", "a/not_existing"},
+	)
+
+	for dir, expected := range map[string]string{"": "a,e.txt", "a": "b,d.txt", "a/b": "c.txt"} {
+		entries, err := vol.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir(%q) error: %v", dir, err)
+		}
+		var names []string
+		for _, f := range entries {
+			names = append(names, f.Name())
+		}
+		if strings.Join(names, ",") != expected {
+			t.Errorf("ReadDir(%q): %v, want %v", dir, names, expected)
+		}
+	}
+
+	stat, err := vol.Stat("a/b")
+	if err != nil {
+		t.Fatalf("Stat error: %v", err)
+	}
+	if !stat.IsDir() {
+		t.Errorf("a/b should be a directory: %v", stat.Mode())
+	}
+}
+
 func TestZipVolume_Open(t *testing.T) {
 	var vol = NewZipVolume("testdata/test.zip", nil)
 
@@ -120,3 +180,308 @@ func TestHttpVolume_ReadAt(t *testing.T) {
 		}
 	}
 }
+
+func TestZipWriterVolume(t *testing.T) {
+	mem := NewOnMemoryVolume(nil)
+	vol := NewZipWriterVolume("out/test.zip", mem)
+	mem.Mkdir("out", 0755)
+
+	testVolumeWriter(t, vol,
+		[]string{"created.txt"},
+		[]string{"not_existing/test.txt"},
+		[]string{"testdir"},
+		[]string{"not_existing/testdir"},
+	)
+
+	vol.Mkdir("dir", 0755)
+	vol.Mkdir("dir/empty", 0755)
+	w, err := vol.Create("dir/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Hello"))
+	w.Close()
+	f, err := vol.OpenFile("dir/random.txt", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("World"), 1)
+	f.WriteAt([]byte("_"), 0)
+	f.Close()
+
+	if err := vol.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if err := vol.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if err := vol.Commit(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Commit after Close should fail: %v", err)
+	}
+
+	zv := NewZipVolume("out/test.zip", mem)
+	testVolume(t, zv,
+		[]string{"dir/hello.txt", "dir/random.txt"},
+		[]string{"created.txt", "testdir"},
+		[]string{"", "dir", "dir/empty"},
+		[]string{"testdir"},
+	)
+	for name, expected := range map[string]string{"dir/hello.txt": "Hello", "dir/random.txt": "_World"} {
+		r, err := zv.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != expected {
+			t.Errorf("unexpected data: %q", b)
+		}
+	}
+}
+
+func TestZipWriterVolume_CommitError(t *testing.T) {
+	mem := NewOnMemoryVolume(nil)
+	vol := NewZipWriterVolume("out/test.zip", mem)
+	w, _ := vol.Create("hello.txt")
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	// The parent directory doesn't exist.
+	if err := vol.Close(); err == nil {
+		t.Fatalf("Close should fail")
+	}
+	if _, err := vol.Stat("hello.txt"); err != nil {
+		t.Errorf("files should be kept after the error: %v", err)
+	}
+
+	mem.Mkdir("out", 0755)
+	if err := vol.Commit(); err != nil {
+		t.Fatalf("Commit should be retried: %v", err)
+	}
+	if err := vol.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if _, err := NewZipVolume("out/test.zip", mem).Stat("hello.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+}
+
+type failingWriteVolume struct {
+	*OnMemoryVolume
+}
+
+type failingWriter struct {
+	FileWriteCloser
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func (v *failingWriteVolume) Create(path string) (FileWriteCloser, error) {
+	w, err := v.OnMemoryVolume.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{w}, nil
+}
+
+func TestZipWriterVolume_WriteError(t *testing.T) {
+	mem := &failingWriteVolume{NewOnMemoryVolume(nil)}
+	vol := NewZipWriterVolume("test.zip", mem)
+	w, _ := vol.Create("hello.txt")
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	if err := vol.Commit(); err == nil {
+		t.Fatalf("Commit should fail")
+	}
+	if _, err := mem.Stat("test.zip"); !os.IsNotExist(err) {
+		t.Errorf("broken archive should be removed: %v", err)
+	}
+}
+
+func TestZipWriterVolume_Closed(t *testing.T) {
+	mem := NewOnMemoryVolume(nil)
+	vol := NewZipWriterVolume("test.zip", mem)
+	vol.Mkdir("dir", 0755)
+	if err := vol.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	check := func(err error) {
+		t.Helper()
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("ErrClosed expected: %v", err)
+		}
+	}
+	_, err := vol.Create("hello.txt")
+	check(err)
+	_, err = vol.OpenFile("hello.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	check(err)
+	check(vol.Mkdir("dir2", 0755))
+	check(vol.Remove("dir"))
+	check(vol.Rename("dir", "dir2"))
+	check(vol.Symlink("dir", "link"))
+	check(vol.Chmod("dir", 0700))
+}
+
+func TestZipWriterVolume_Symlink(t *testing.T) {
+	mem := NewOnMemoryVolume(nil)
+	vol := NewZipWriterVolume("test.zip", mem)
+	vol.Mkdir("dir", 0755)
+	w, _ := vol.Create("dir/hello.txt")
+	w.Write([]byte("Hello"))
+	w.Close()
+	vol.Symlink("dir/hello.txt", "link")
+	vol.Symlink("dir", "dirlink")
+	if err := vol.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	zv := newZipVolume("test.zip", mem)
+	for name, expected := range map[string]string{"link": "dir/hello.txt", "dirlink": "dir"} {
+		if target, err := zv.Readlink(name); err != nil || target != expected {
+			t.Errorf("Readlink(%q): %q %v", name, target, err)
+		}
+	}
+	if stat, err := zv.Stat("link"); err != nil || stat.Size() != 5 {
+		t.Errorf("Stat should follow the symlink: %v %v", stat, err)
+	}
+	if stat, err := zv.Stat("dirlink"); err != nil || !stat.IsDir() {
+		t.Errorf("Stat should follow the symlink: %v %v", stat, err)
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	group := NewVolumeGroup()
+	group.AddVolume("a", NewOnMemoryVolume(map[string][]byte{"x/hello.txt": []byte("Hello")}))
+	group.AddVolume("b", NewOnMemoryVolume(map[string][]byte{"world.txt": []byte("World")}))
+
+	var buf bytes.Buffer
+	if err := WriteZip(&buf, group, ""); err != nil {
+		t.Fatalf("WriteZip error: %v", err)
+	}
+	mem := NewOnMemoryVolume(map[string][]byte{"test.zip": buf.Bytes()})
+	testVolume(t, NewZipVolume("test.zip", mem),
+		[]string{"a/x/hello.txt", "b/world.txt"},
+		[]string{"hello.txt"},
+		[]string{"a", "a/x", "b"},
+		[]string{"c"},
+	)
+}
+
+func TestAutoUnzipVolume_Nested(t *testing.T) {
+	inner := createTestZip(t, map[string]string{"c.txt": "Hello"}, "c.txt")
+	middle := createTestZip(t, map[string]string{"b.zip": string(inner), "d.txt": "World"}, "b.zip", "d.txt")
+	outer := createTestZip(t, map[string]string{"x/a.zip": string(middle)}, "x/a.zip")
+	mem := NewOnMemoryVolume(map[string][]byte{"test.zip": outer})
+	vol := NewAutoUnzipVolume(mem)
+
+	testVolume(t, vol,
+		[]string{"test.zip/:/x/a.zip/:/b.zip/:/c.txt", "test.zip/:/x/a.zip/:/d.txt"},
+		[]string{"test.zip/:/x/a.zip/:/b.zip/:/d.txt", "test.zip/:/x/a.zip/:/c.txt"},
+		[]string{"test.zip/:/x/a.zip/:/", "test.zip/:/x/a.zip/:/b.zip/:/"},
+		[]string{"test.zip/:/x/a.zip/:/x"},
+	)
+
+	stat, err := vol.Stat("test.zip/:/x/a.zip/:/b.zip/:/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Path != "test.zip/:/x/a.zip/:/b.zip/:/c.txt" || stat.Size() != 5 {
+		t.Errorf("unexpected stat: %v %v", stat.Path, stat.Size())
+	}
+
+	files, err := vol.ReadDir("test.zip/:/x/a.zip")
+	if err != nil || len(files) != 2 || files[0].Path != ":/b.zip" {
+		t.Errorf("unexpected files: %v %v", files, err)
+	}
+
+	vol.(*AutoUnzipVolume).MaxDepth = 2
+	if _, err := vol.Stat("test.zip/:/x/a.zip/:/b.zip/:/c.txt"); !errors.Is(err, zipfs.ErrTooDeep) {
+		t.Errorf("Stat should return ErrTooDeep: %v", err)
+	}
+	vol.(*AutoUnzipVolume).MaxDepth = 0
+	vol.(*AutoUnzipVolume).MaxArchiveSize = 100
+	if _, err := vol.Open("test.zip/:/x/a.zip/:/d.txt"); !errors.Is(err, zipfs.ErrTooLarge) {
+		t.Errorf("Open should return ErrTooLarge: %v", err)
+	}
+}
+
+func TestZipVolume_Encrypted(t *testing.T) {
+	password := func(archive, name string) (string, bool) { return "secret", true }
+	vol := NewZipVolume("testdata/encrypted.zip", nil, zipfs.WithPassword(password))
+
+	files, err := vol.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.GetMetadata(zipfs.MetadataEncrypted) != true {
+			t.Errorf("%s should be encrypted", f.Name())
+		}
+	}
+	for name, content := range map[string]string{"zipcrypto.txt": "Hello", "aes.txt": "World"} {
+		r, err := vol.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != content {
+			t.Errorf("unexpected content: %q %v", string(b), err)
+		}
+	}
+
+	wrong := &AutoUnzipVolume{FS: ToFS(NewLocalVolume("testdata")), Password: func(archive, name string) (string, bool) { return "wrong", true }}
+	if _, err := wrong.Open("encrypted.zip/:/aes.txt"); !errors.Is(err, zipfs.ErrWrongPassword) {
+		t.Errorf("ErrWrongPassword expected: %v", err)
+	}
+}
+
+func TestAutoUnzipVolume_Detection(t *testing.T) {
+	data := createTestZip(t, map[string]string{"mimetype": "application/epub+zip"}, "mimetype")
+	mem := NewOnMemoryVolume(map[string][]byte{"a.CBZ": data, "b.epub": data})
+	vol := &AutoUnzipVolume{FS: ToFS(mem), Separator: "!", Extensions: []string{".cbz"}}
+
+	testVolume(t, vol,
+		[]string{"a.CBZ/!/mimetype"},
+		[]string{"a.CBZ/:/mimetype", "b.epub/!/mimetype"},
+		[]string{"a.CBZ/!/"},
+		[]string{"b.epub/!/"},
+	)
+
+	vol.SniffContent = true
+	stat, err := vol.Stat("b.epub/!/mimetype")
+	if err != nil || stat.Path != "b.epub/!/mimetype" {
+		t.Errorf("b.epub should be detected by content: %v %v", stat, err)
+	}
+}
+
+func TestZipVolume_Symlink(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("a/b.txt")
+	w.Write([]byte("Hello"))
+	h := &zip.FileHeader{Name: "link"}
+	h.SetMode(os.ModeSymlink | 0777)
+	w, _ = zw.CreateHeader(h)
+	w.Write([]byte("a/b.txt"))
+	zw.Close()
+	vol := newZipVolume("test.zip", NewOnMemoryVolume(map[string][]byte{"test.zip": buf.Bytes()}))
+	var _ VolumeLinker = vol
+
+	if stat, err := vol.Stat("link"); err != nil || stat.Size() != 5 {
+		t.Errorf("Stat should follow the symlink: %v %v", stat, err)
+	}
+	if stat, err := vol.Lstat("link"); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if target, err := vol.Readlink("link"); err != nil || target != "a/b.txt" {
+		t.Errorf("Readlink: %q %v", target, err)
+	}
+	if err := vol.Symlink("a", "link2"); !os.IsPermission(err) {
+		t.Errorf("Symlink should return a permission error: %v", err)
+	}
+}
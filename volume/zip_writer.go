@@ -0,0 +1,227 @@
+package volume
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ZipWriterVolume is a writable volume which builds a new zip archive.
+// Files are kept in memory until Commit or Close writes the archive to the path, so the size of the archive is limited by the memory.
+// Use WriteZip to export files of an existing volume. It streams the files to the writer.
+type ZipWriterVolume struct {
+	*OnMemoryVolume
+	lock   sync.Mutex
+	volume Volume
+	path   string
+	closed bool
+}
+
+// NewZipWriterVolume returns a new volume. The archive is written to path on the volume. (volume = nil : native path)
+func NewZipWriterVolume(path string, volume Volume) *ZipWriterVolume {
+	return &ZipWriterVolume{OnMemoryVolume: NewOnMemoryVolume(nil), volume: volume, path: path}
+}
+
+// Commit writes the archive. The archive is overwritten if Commit is called again.
+func (v *ZipWriterVolume) Commit() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed {
+		return &os.PathError{Op: "commit", Path: v.path, Err: os.ErrClosed}
+	}
+	return v.commit()
+}
+
+func (v *ZipWriterVolume) commit() error {
+	var w io.WriteCloser
+	var err error
+	if v.volume != nil {
+		w, err = ToFS(v.volume).Create(v.path)
+	} else {
+		w, err = os.Create(v.path)
+	}
+	if err != nil {
+		return err
+	}
+	err = WriteZip(w, v.OnMemoryVolume, "")
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Don't leave the broken archive.
+		if v.volume != nil {
+			ToFS(v.volume).Remove(v.path)
+		} else {
+			os.Remove(v.path)
+		}
+	}
+	return err
+}
+
+// Close writes the archive and releases the files in memory.
+// If writing fails, the files are kept, so Commit or Close can be retried.
+func (v *ZipWriterVolume) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed {
+		return nil
+	}
+	if err := v.commit(); err != nil {
+		return err
+	}
+	v.closed = true
+	v.OnMemoryVolume.lock.Lock()
+	v.OnMemoryVolume.root = newMemDir(os.ModePerm)
+	v.OnMemoryVolume.lock.Unlock()
+	return nil
+}
+
+func (v *ZipWriterVolume) checkClosed(op, path string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (v *ZipWriterVolume) Create(path string) (FileWriteCloser, error) {
+	if err := v.checkClosed("create", path); err != nil {
+		return nil, err
+	}
+	return v.OnMemoryVolume.Create(path)
+}
+
+func (v *ZipWriterVolume) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	if err := v.checkClosed("open", path); err != nil {
+		return nil, err
+	}
+	return v.OnMemoryVolume.OpenFile(path, flag, perm)
+}
+
+func (v *ZipWriterVolume) Mkdir(path string, mode os.FileMode) error {
+	if err := v.checkClosed("mkdir", path); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Mkdir(path, mode)
+}
+
+func (v *ZipWriterVolume) Remove(path string) error {
+	if err := v.checkClosed("remove", path); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Remove(path)
+}
+
+func (v *ZipWriterVolume) Rename(oldpath, newpath string) error {
+	if err := v.checkClosed("rename", oldpath); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Rename(oldpath, newpath)
+}
+
+func (v *ZipWriterVolume) Symlink(oldname, newname string) error {
+	if err := v.checkClosed("symlink", newname); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Symlink(oldname, newname)
+}
+
+func (v *ZipWriterVolume) Chmod(path string, mode os.FileMode) error {
+	if err := v.checkClosed("chmod", path); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Chmod(path, mode)
+}
+
+func (v *ZipWriterVolume) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if err := v.checkClosed("chtimes", path); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Chtimes(path, atime, mtime)
+}
+
+func (v *ZipWriterVolume) Truncate(path string, size int64) error {
+	if err := v.checkClosed("truncate", path); err != nil {
+		return err
+	}
+	return v.OnMemoryVolume.Truncate(path, size)
+}
+
+// WriteZip writes files in the dir of the volume to w as a zip archive.
+// Symlinks are stored as symlink entries if the volume implements VolumeLinker.
+func WriteZip(w io.Writer, v Volume, dir string) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipDir(zw, v, dir, ""); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipDir(zw *zip.Writer, v Volume, dir, prefix string) error {
+	files, err := v.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		src := path.Join(dir, f.Name())
+		name := prefix + f.Name()
+		hdr, err := zip.FileInfoHeader(f)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if f.IsDir() {
+			hdr.Name += "/"
+			if _, err := zw.CreateHeader(hdr); err != nil {
+				return err
+			}
+			if err := writeZipDir(zw, v, src, hdr.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			if err := writeZipSymlink(zw, v, src, hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		r, err := v.Open(src)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeZipSymlink writes the target of the symlink as the content of the entry.
+func writeZipSymlink(zw *zip.Writer, v Volume, src string, hdr *zip.FileHeader) error {
+	l, ok := UnwrapVolume(v).(VolumeLinker)
+	if !ok {
+		return unsupportedError("Readlink", src)
+	}
+	target, err := l.Readlink(src)
+	if err != nil {
+		return err
+	}
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, target)
+	return err
+}
@@ -0,0 +1,76 @@
+package wsvolume
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/binzume/cfs/volume"
+)
+
+// ErrorCode is the error field of responses.
+type ErrorCode string
+
+const (
+	ErrorNotExist    ErrorCode = "noent"
+	ErrorExist       ErrorCode = "exist"
+	ErrorPermission  ErrorCode = "perm"
+	ErrorNotDir      ErrorCode = "notdir"
+	ErrorIsDir       ErrorCode = "isdir"
+	ErrorNotEmpty    ErrorCode = "notempty"
+	ErrorUnsupported ErrorCode = "unsupported"
+	ErrorNoSpace     ErrorCode = "nospace"
+	ErrorClosed      ErrorCode = "closed"
+	ErrorInvalid     ErrorCode = "invalid"
+)
+
+// errorCodes is ordered by priority. Errno values are checked before the general errors.
+var errorCodes = []struct {
+	code ErrorCode
+	err  error
+}{
+	{ErrorNotDir, syscall.ENOTDIR},
+	{ErrorIsDir, syscall.EISDIR},
+	{ErrorNotEmpty, syscall.ENOTEMPTY},
+	{ErrorNoSpace, syscall.ENOSPC},
+	{ErrorUnsupported, volume.UnsupportedError},
+	{ErrorNotExist, fs.ErrNotExist},
+	{ErrorExist, fs.ErrExist},
+	{ErrorPermission, fs.ErrPermission},
+	{ErrorClosed, fs.ErrClosed},
+	{ErrorInvalid, fs.ErrInvalid},
+}
+
+// errorCodeOf returns the code of the error. ok is false if err is unknown.
+func errorCodeOf(err error) (code ErrorCode, ok bool) {
+	if errors.Is(err, syscall.ENOTSUP) {
+		return ErrorUnsupported, true
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code, true
+		}
+	}
+	return "", false
+}
+
+// Err returns the error corresponding to the code. Unknown codes are returned as *RemoteError.
+func (c ErrorCode) Err() error {
+	for _, e := range errorCodes {
+		if e.code == c {
+			return e.err
+		}
+	}
+	s := string(c)
+	return (*RemoteError)(&s)
+}
+
+// pathError wraps the error returned by the provider in *os.PathError.
+// Other errors such as context.Canceled are returned as is.
+func pathError(op, path string, err error) error {
+	if e, ok := err.(*RemoteError); ok {
+		return &os.PathError{Op: op, Path: path, Err: ErrorCode(*e).Err()}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package wsvolume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/binzume/cfs/volume"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, e := range errorCodes {
+		code, ok := errorCodeOf(&os.PathError{Op: "test", Path: "/tmp/a", Err: e.err})
+		if !ok || code != e.code {
+			t.Errorf("unexpected code: %v %v", e.err, code)
+		}
+		remote := RemoteError(code)
+		if err := pathError("test", "a", &remote); !errors.Is(err, e.err) {
+			t.Errorf("unexpected error: %v %v", code, err)
+		}
+	}
+	if code, _ := errorCodeOf(syscall.ENOENT); code != ErrorNotExist {
+		t.Errorf("unexpected code: %v", code)
+	}
+	if code, _ := errorCodeOf(syscall.ENOTSUP); code != ErrorUnsupported {
+		t.Errorf("unexpected code: %v", code)
+	}
+	if _, ok := errorCodeOf(fmt.Errorf("unknown")); ok {
+		t.Errorf("unknown error should not have a code")
+	}
+	var pe *os.PathError
+	if err := pathError("read", "a", ErrorCode("read error").Err()); !errors.As(err, &pe) || pe.Err.Error() != "read error" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWsVolume_Errors(t *testing.T) {
+	dir := t.TempDir()
+	local := volume.NewLocalVolume(dir)
+	local.Mkdir("dir", 0755)
+	local.Create("dir/a.txt")
+	vol, closer := connectTestVolume(t, local)
+	defer closer()
+
+	check := func(err error, target error) {
+		t.Helper()
+		var pe *os.PathError
+		if !errors.As(err, &pe) {
+			t.Errorf("*os.PathError expected: %#v", err)
+		}
+		if !errors.Is(err, target) {
+			t.Errorf("%v expected: %v", target, err)
+		}
+	}
+	_, err := vol.Stat("notfound")
+	check(err, fs.ErrNotExist)
+	check(vol.Mkdir("dir", 0755), fs.ErrExist)
+	_, err = vol.OpenFile("dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	check(err, fs.ErrExist)
+	check(vol.Remove("dir"), syscall.ENOTEMPTY)
+	_, err = vol.ReadDir("dir/a.txt")
+	check(err, syscall.ENOTDIR)
+	check(vol.request(context.Background(), ReqData{"op": "unknown", "path": "a"}, nil), volume.UnsupportedError)
+}
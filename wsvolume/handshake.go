@@ -0,0 +1,122 @@
+package wsvolume
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions. Peers are compatible if their version ranges overlap.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Capabilities in the handshake.
+const (
+	CapRename      = "rename"
+	CapWatch       = "watch"
+	CapHash        = "hash" // reserved. not implemented yet.
+	CapHandles     = "handles"
+	CapCompression = "compression" // permessage-deflate is used if it is negotiated by HTTP.
+	CapSymlink     = "symlink"     // lstat, readlink and symlink. The provider supports it if the volume implements volume.VolumeLinker.
+)
+
+// MaxBlockSize is the max size of a read or write block. The smaller one of the peers is used.
+var MaxBlockSize = 1024 * 1024
+
+const MessageTypeHello = 1
+
+// Hello is the handshake message. Both peers send it on connection and then read the hello of the other.
+type Hello struct {
+	Type         int      `json:"type"`
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"minVersion"`
+	Capabilities []string `json:"caps"`
+	MaxBlockSize int      `json:"maxBlockSize"`
+}
+
+func newHello(caps []string) *Hello {
+	return &Hello{
+		Type:         MessageTypeHello,
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Capabilities: caps,
+		MaxBlockSize: MaxBlockSize,
+	}
+}
+
+// Has returns true if the peer supports the capability.
+func (h *Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// blockSize returns the max block size of the peers.
+func (h *Hello) blockSize() int {
+	if h.MaxBlockSize > 0 && h.MaxBlockSize < MaxBlockSize {
+		return h.MaxBlockSize
+	}
+	return MaxBlockSize
+}
+
+func (h *Hello) check() error {
+	if h.Version < MinProtocolVersion || h.MinVersion > ProtocolVersion {
+		return fmt.Errorf("wsvolume: incompatible protocol version %d (supported: %d-%d)", h.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// readHello reads the handshake message in WSDialer.HandshakeTimeout.
+// Other messages are rejected. e.g. Providers of the old protocol send an empty object and ignore the hello.
+func readHello(conn *websocket.Conn) (*Hello, error) {
+	if timeout := WSDialer.HandshakeTimeout; timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("wsvolume: handshake: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	var hello Hello
+	if err := json.Unmarshal(msg, &hello); err != nil || hello.Type != MessageTypeHello {
+		return nil, reject(conn, fmt.Errorf("wsvolume: incompatible peer: handshake message expected: %.100s", msg))
+	}
+	if err := hello.check(); err != nil {
+		return nil, reject(conn, err)
+	}
+	return &hello, nil
+}
+
+// reject notifies the peer of the error and closes the connection.
+func reject(conn *websocket.Conn, err error) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error())
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+	return err
+}
+
+// clientHandshake sends the hello of the client and waits for the hello of the provider.
+func clientHandshake(conn *websocket.Conn, caps []string) (*Hello, error) {
+	if err := conn.WriteJSON(newHello(caps)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return readHello(conn)
+}
+
+// providerHandshake sends the hello of the provider and waits for the hello of the client.
+func providerHandshake(conn *websocket.Conn, caps []string) (*Hello, error) {
+	if err := conn.WriteJSON(newHello(caps)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return readHello(conn)
+}
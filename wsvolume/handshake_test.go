@@ -0,0 +1,182 @@
+package wsvolume
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/binzume/cfs/volume"
+)
+
+func TestHandshake(t *testing.T) {
+	vol, closer := connectTestVolume(t, volume.NewOnMemoryVolume(nil))
+	defer closer()
+
+	peer := vol.Peer()
+	if peer == nil || peer.Version != ProtocolVersion {
+		t.Fatalf("unexpected handshake: %v", peer)
+	}
+	for _, c := range []string{CapRename, CapWatch, CapHandles} {
+		if !peer.Has(c) {
+			t.Errorf("provider should support %v", c)
+		}
+	}
+}
+
+// startFakeProvider starts a server which sends the message and replies to the first message.
+func startFakeProvider(hello interface{}, reply interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(hello)
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		conn.WriteJSON(reply)
+		conn.ReadMessage()
+	}))
+}
+
+// startLegacyProvider starts a server which behaves like the provider before the handshake.
+// It sends an empty object, fails to decode the hello and stops reading without closing the connection.
+func startLegacyProvider() (*httptest.Server, func()) {
+	quit := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(&map[string]interface{}{})
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var op map[string]json.Number
+		if json.Unmarshal(msg, &op) == nil {
+			conn.WriteJSON(map[string]interface{}{"error": "unknown operation error", "rid": op["rid"]})
+		}
+		<-quit
+	}))
+	return server, func() {
+		close(quit)
+		server.Close()
+	}
+}
+
+func TestHandshake_IncompatibleProvider(t *testing.T) {
+	legacy, closeLegacy := startLegacyProvider()
+	defer closeLegacy()
+	start := time.Now()
+	_, err := NewWebsocketVolume("hoge").StartClientWithDefaultConnector("ws" + strings.TrimPrefix(legacy.URL, "http"))
+	if err == nil || !strings.Contains(err.Error(), "incompatible peer") {
+		t.Errorf("legacy provider should be rejected: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("legacy provider should be rejected immediately: %v", d)
+	}
+
+	// no response
+	defer func(d time.Duration) { WSDialer.HandshakeTimeout = d }(WSDialer.HandshakeTimeout)
+	WSDialer.HandshakeTimeout = 100 * time.Millisecond
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+		conn.ReadMessage()
+	}))
+	defer silent.Close()
+	_, err = NewWebsocketVolume("hoge").StartClientWithDefaultConnector("ws" + strings.TrimPrefix(silent.URL, "http"))
+	if err == nil || !strings.Contains(err.Error(), "handshake") {
+		t.Errorf("handshake should time out: %v", err)
+	}
+
+	future := startFakeProvider(&Hello{Type: MessageTypeHello, Version: 99, MinVersion: 99}, nil)
+	defer future.Close()
+	_, err = NewWebsocketVolume("hoge").StartClientWithDefaultConnector("ws" + strings.TrimPrefix(future.URL, "http"))
+	if err == nil || !strings.Contains(err.Error(), "incompatible protocol version") {
+		t.Errorf("provider should be rejected: %v", err)
+	}
+}
+
+func TestHandshake_IncompatibleClient(t *testing.T) {
+	server := newTestProviderServer(volume.NewOnMemoryVolume(nil))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var hello Hello
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != MessageTypeHello {
+		t.Fatalf("unexpected handshake: %v %v", hello, err)
+	}
+	conn.WriteJSON(map[string]interface{}{"op": "stat", "path": "", "rid": 1})
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseProtocolError || !strings.Contains(closeErr.Text, "incompatible peer") {
+		t.Errorf("legacy client should be rejected: %v", err)
+	}
+}
+
+func TestHandshake_Capabilities(t *testing.T) {
+	defer func(caps []string) { providerCapabilities = caps }(providerCapabilities)
+	providerCapabilities = []string{}
+
+	vol, closer := connectTestVolume(t, volume.NewOnMemoryVolume(map[string][]byte{"a.txt": []byte("Hello")}))
+	defer closer()
+
+	if err := vol.Rename("a.txt", "b.txt"); !errors.Is(err, volume.UnsupportedError) {
+		t.Errorf("Rename should be unsupported: %v", err)
+	}
+	if _, err := vol.Watch(func(volume.FileEvent) {}); !errors.Is(err, volume.UnsupportedError) {
+		t.Errorf("Watch should be unsupported: %v", err)
+	}
+	// Files are read without handles.
+	f, err := vol.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || string(b) != "Hello" {
+		t.Errorf("unexpected content: %q %v", string(b), err)
+	}
+}
+
+func TestHandshake_BlockSize(t *testing.T) {
+	defer func(sz int) { MaxBlockSize = sz }(MaxBlockSize)
+	MaxBlockSize = 1000
+
+	vol, closer := connectTestVolume(t, volume.NewLocalVolume(t.TempDir()))
+	defer closer()
+
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	f, err := vol.OpenFile("test.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.WriteAt(data, 0); err != nil || n != len(data) {
+		t.Fatalf("WriteAt error: %v %v", n, err)
+	}
+	buf := make([]byte, len(data))
+	if n, err := f.ReadAt(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("unexpected content: %v %v", n, err)
+	}
+}
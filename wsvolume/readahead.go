@@ -0,0 +1,197 @@
+package wsvolume
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// MinReadBlockSize is the initial size of read blocks. The size is doubled by sequential reads up to the negotiated max block size.
+var MinReadBlockSize = 32 * 1024
+
+// ReadCacheBlocks is the number of blocks cached by each file handle.
+var ReadCacheBlocks = 8
+
+// DefaultReadAhead is the number of blocks prefetched by sequential reads.
+const DefaultReadAhead = 4
+
+type readBlock struct {
+	off  int64
+	size int // requested size
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+func (b *readBlock) contains(off int64) bool {
+	return off >= b.off && off < b.off+int64(b.size)
+}
+
+// eof returns true if the block is fetched and the file ends in the block.
+func (b *readBlock) eof() bool {
+	select {
+	case <-b.done:
+		return b.err == nil && len(b.data) < b.size
+	default:
+		return false
+	}
+}
+
+// blockReader reads a file by blocks. Sequential reads fetch following blocks in parallel.
+type blockReader struct {
+	fetch     func(ctx context.Context, off int64, size int) ([]byte, error)
+	maxSize   func() int
+	readAhead int
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	lock      sync.Mutex
+	blocks    []*readBlock // LRU. The last one is the most recently used.
+	blockSize int
+	lastPos   int64
+}
+
+func newBlockReader(fetch func(ctx context.Context, off int64, size int) ([]byte, error), maxSize func() int, readAhead int) *blockReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &blockReader{fetch: fetch, maxSize: maxSize, readAhead: readAhead, ctx: ctx, cancel: cancel, blockSize: MinReadBlockSize}
+}
+
+func (r *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		blk := r.block(pos, len(p)-n)
+		<-blk.done
+		if blk.err != nil {
+			r.remove(blk)
+			return n, blk.err
+		}
+		if pos-blk.off >= int64(len(blk.data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], blk.data[pos-blk.off:])
+	}
+	return n, nil
+}
+
+// block returns the block which contains off. Following blocks are fetched if the read is sequential.
+func (r *blockReader) block(off int64, want int) *readBlock {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sequential := off == r.lastPos
+	r.lastPos = off + int64(want)
+
+	blk := r.find(off)
+	if blk == nil {
+		if !sequential {
+			r.blockSize = MinReadBlockSize
+		}
+		size := r.nextSize()
+		if want > size {
+			size = want
+		}
+		if max := r.maxSize(); size > max {
+			size = max
+		}
+		blk = r.start(off, size)
+	}
+	if sequential {
+		next := blk
+		for i := 0; i < r.readAhead && !next.eof(); i++ {
+			end := next.off + int64(next.size)
+			if next = r.find(end); next == nil {
+				next = r.start(end, r.nextSize())
+			}
+		}
+	}
+	r.touch(blk)
+
+	limit := ReadCacheBlocks
+	if limit < r.readAhead+2 {
+		limit = r.readAhead + 2
+	}
+	if len(r.blocks) > limit {
+		r.blocks = append([]*readBlock{}, r.blocks[len(r.blocks)-limit:]...)
+	}
+	return blk
+}
+
+// nextSize returns the size of the next block and grows the size. r.lock must be held.
+func (r *blockReader) nextSize() int {
+	max := r.maxSize()
+	size := r.blockSize
+	if size > max {
+		size = max
+	}
+	if r.blockSize < max {
+		r.blockSize *= 2
+	}
+	return size
+}
+
+func (r *blockReader) find(off int64) *readBlock {
+	for _, b := range r.blocks {
+		if b.contains(off) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (r *blockReader) start(off int64, size int) *readBlock {
+	blk := &readBlock{off: off, size: size, done: make(chan struct{})}
+	r.blocks = append(r.blocks, blk)
+	ctx := r.ctx
+	go func() {
+		blk.data, blk.err = r.fetch(ctx, off, size)
+		close(blk.done)
+	}()
+	return blk
+}
+
+func (r *blockReader) touch(blk *readBlock) {
+	for i, b := range r.blocks {
+		if b == blk {
+			r.blocks = append(append(r.blocks[:i:i], r.blocks[i+1:]...), blk)
+			return
+		}
+	}
+}
+
+// remove removes the failed block. Errors are not cached.
+func (r *blockReader) remove(blk *readBlock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, b := range r.blocks {
+		if b == blk {
+			r.blocks = append(r.blocks[:i:i], r.blocks[i+1:]...)
+			return
+		}
+	}
+}
+
+// invalidate drops the cached blocks. e.g. the file is modified.
+func (r *blockReader) invalidate() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blocks = nil
+}
+
+// invalidateRange drops the blocks which overlap the range.
+func (r *blockReader) invalidateRange(off int64, size int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	blocks := r.blocks[:0:0]
+	for _, b := range r.blocks {
+		if b.off >= off+int64(size) || off >= b.off+int64(b.size) {
+			blocks = append(blocks, b)
+		}
+	}
+	r.blocks = blocks
+}
+
+// close cancels the requests in flight.
+func (r *blockReader) close() {
+	r.cancel()
+	r.invalidate()
+}
@@ -0,0 +1,129 @@
+package wsvolume
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBlockSource struct {
+	data     []byte
+	delay    time.Duration
+	lock     sync.Mutex
+	sizes    []int
+	inflight int
+	maxIn    int
+	err      error
+}
+
+func (s *testBlockSource) fetch(ctx context.Context, off int64, size int) ([]byte, error) {
+	s.lock.Lock()
+	s.sizes = append(s.sizes, size)
+	s.inflight++
+	if s.inflight > s.maxIn {
+		s.maxIn = s.inflight
+	}
+	err := s.err
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.inflight--
+		s.lock.Unlock()
+	}()
+	time.Sleep(s.delay)
+	if err != nil {
+		return nil, err
+	}
+	if off >= int64(len(s.data)) {
+		return []byte{}, nil
+	}
+	end := off + int64(size)
+	if end > int64(len(s.data)) {
+		end = int64(len(s.data))
+	}
+	return append([]byte{}, s.data[off:end]...), nil
+}
+
+func (s *testBlockSource) requests() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int{}, s.sizes...)
+}
+
+func TestBlockReader_Sequential(t *testing.T) {
+	src := &testBlockSource{data: bytes.Repeat([]byte("0123456789abcdef"), 64*1024), delay: 5 * time.Millisecond}
+	r := newBlockReader(src.fetch, func() int { return 256 * 1024 }, 4)
+	defer r.close()
+
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, int64(len(src.data))))
+	if err != nil || !bytes.Equal(b, src.data) {
+		t.Fatalf("unexpected content: %v %v", len(b), err)
+	}
+	min, max := len(src.data), 0
+	for _, sz := range src.requests() {
+		if sz < min {
+			min = sz
+		}
+		if sz > max {
+			max = sz
+		}
+	}
+	if min != MinReadBlockSize || max != 256*1024 {
+		t.Errorf("block size should grow to the max: %v", src.requests())
+	}
+	if src.maxIn < 2 {
+		t.Errorf("blocks should be fetched in parallel: %v", src.maxIn)
+	}
+
+	// EOF
+	buf := make([]byte, 100)
+	if n, err := r.ReadAt(buf, int64(len(src.data))-10); n != 10 || err != io.EOF {
+		t.Errorf("EOF expected: %v %v", n, err)
+	}
+}
+
+func TestBlockReader_Random(t *testing.T) {
+	src := &testBlockSource{data: bytes.Repeat([]byte("0123456789abcdef"), 64*1024)}
+	r := newBlockReader(src.fetch, func() int { return 256 * 1024 }, 4)
+	defer r.close()
+
+	buf := make([]byte, 100)
+	for _, off := range []int64{500000, 100000, 900000, 100050} {
+		if _, err := r.ReadAt(buf, off); err != nil || !bytes.Equal(buf, src.data[off:off+100]) {
+			t.Fatalf("unexpected content at %v: %v", off, err)
+		}
+	}
+	// The last one is cached.
+	if sizes := src.requests(); len(sizes) != 3 || sizes[2] != MinReadBlockSize {
+		t.Errorf("random reads should not prefetch: %v", sizes)
+	}
+
+	r.invalidate()
+	if _, err := r.ReadAt(buf, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := src.requests(); len(sizes) != 4 {
+		t.Errorf("block should be fetched again: %v", sizes)
+	}
+}
+
+func TestBlockReader_Error(t *testing.T) {
+	src := &testBlockSource{data: []byte("Hello"), err: errors.New("test")}
+	r := newBlockReader(src.fetch, func() int { return 1024 }, 0)
+	defer r.close()
+
+	buf := make([]byte, 5)
+	if _, err := r.ReadAt(buf, 0); err == nil {
+		t.Errorf("error expected")
+	}
+	src.lock.Lock()
+	src.err = nil
+	src.lock.Unlock()
+	if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "Hello" {
+		t.Errorf("errors should not be cached: %v", err)
+	}
+}
@@ -8,6 +8,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/binzume/cfs/volume"
@@ -16,15 +21,177 @@ import (
 
 type WebsocketVolumeProvider struct {
 	volume            volume.FS
-	connected         bool
+	sessions          int32
 	reconnectInterval time.Duration
+	readOnly          bool
+	root              string
+	allowedOps        map[string]bool     // nil: all
+	linker            volume.VolumeLinker // nil: symlinks are not supported
 }
 
-func NewWebsocketVolumeProvider(volume volume.FS) *WebsocketVolumeProvider {
-	return &WebsocketVolumeProvider{
-		volume:            volume,
+// ProviderOption configures WebsocketVolumeProvider.
+type ProviderOption func(*WebsocketVolumeProvider)
+
+// ReadOnly rejects the operations which modify the volume.
+func ReadOnly() ProviderOption {
+	return func(wp *WebsocketVolumeProvider) {
+		wp.readOnly = true
+	}
+}
+
+// WithRoot publishes the sub directory of the volume. Symlinks pointing out of the directory are refused.
+func WithRoot(dir string) ProviderOption {
+	return func(wp *WebsocketVolumeProvider) {
+		wp.root = path.Clean("/" + dir)[1:]
+	}
+}
+
+// AllowOps limits the operations. e.g. AllowOps("stat", "files", "open", "read", "write")
+// Other operations are rejected with a permission error. "close" and "unwatch" are always allowed.
+func AllowOps(ops ...string) ProviderOption {
+	return func(wp *WebsocketVolumeProvider) {
+		wp.allowedOps = map[string]bool{}
+		for _, op := range ops {
+			wp.allowedOps[op] = true
+		}
+	}
+}
+
+// providerCapabilities are the features implemented by the provider. Permissions are checked for each operation.
+var providerCapabilities = []string{CapRename, CapWatch, CapHandles, CapCompression}
+
+// MaxHandles is the max number of open handles in a session. Opening more files fails with ErrorNoSpace.
+var MaxHandles = 1024
+
+// readOps are the operations allowed in read-only mode.
+var readOps = map[string]bool{"stat": true, "lstat": true, "readlink": true, "files": true, "open": true, "read": true, "close": true, "watch": true, "unwatch": true}
+
+func NewWebsocketVolumeProvider(v volume.FS, opts ...ProviderOption) *WebsocketVolumeProvider {
+	wp := &WebsocketVolumeProvider{
+		volume:            v,
 		reconnectInterval: time.Second * 3,
 	}
+	wp.linker, _ = volume.UnwrapVolume(v).(volume.VolumeLinker)
+	for _, opt := range opts {
+		opt(wp)
+	}
+	return wp
+}
+
+// capabilities returns the features of the provider. CapSymlink is added if the volume supports symlinks.
+func (wp *WebsocketVolumeProvider) capabilities() []string {
+	caps := append([]string{}, providerCapabilities...)
+	if wp.linker != nil {
+		caps = append(caps, CapSymlink)
+	}
+	return caps
+}
+
+// allowed returns true if the operation is allowed.
+func (wp *WebsocketVolumeProvider) allowed(op string) bool {
+	if op == "close" || op == "unwatch" {
+		return true
+	}
+	if wp.readOnly && !readOps[op] {
+		return false
+	}
+	return wp.allowedOps == nil || wp.allowedOps[op]
+}
+
+// allowedCommand returns true if the command is allowed. Opening files for writing needs "write".
+func (wp *WebsocketVolumeProvider) allowedCommand(cmd *wsCommand) bool {
+	if cmd.Op == "open" && fromWireFlag(cmd.Flag)&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 && !wp.allowed("write") {
+		return false
+	}
+	return wp.allowed(cmd.Op)
+}
+
+// volumePath returns the path in the volume. Paths from clients are cleaned and can't point out of the root.
+func (wp *WebsocketVolumeProvider) volumePath(p string) string {
+	if p == "" {
+		return wp.root
+	}
+	return path.Join(wp.root, path.Clean("/" + p)[1:])
+}
+
+// linkAllowed returns false if the symlink points out of the root.
+func (wp *WebsocketVolumeProvider) linkAllowed(clientPath, target string) bool {
+	if wp.root == "" {
+		return true
+	}
+	p := path.Join(path.Dir(path.Clean("/" + clientPath)[1:]), target)
+	return !path.IsAbs(target) && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// maxSymlinks is the max number of symlinks followed in a path.
+const maxSymlinks = 40
+
+// noFollowOps don't follow the symlink at the last element of the path.
+var noFollowOps = map[string]bool{"lstat": true, "readlink": true, "remove": true, "rename": true, "symlink": true}
+
+// checkRoot resolves symlinks in the client path and refuses it if they point out of the root.
+// Like volume.Confine, the check is not atomic.
+func (wp *WebsocketVolumeProvider) checkRoot(p string, follow bool) error {
+	if wp.root == "" || wp.linker == nil {
+		return nil
+	}
+	var resolved []string
+	rest := strings.Split(p, "/")
+	missing := false
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			if len(resolved) == 0 {
+				return volume.PermissionError
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		if missing || (len(rest) == 0 && !follow) {
+			resolved = append(resolved, name)
+			continue
+		}
+		vp := path.Join(wp.root, path.Join(resolved...), name)
+		st, err := wp.linker.Lstat(vp)
+		if err != nil {
+			// Following elements are checked lexically. The operation will fail anyway.
+			missing = true
+			resolved = append(resolved, name)
+			continue
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return syscall.ELOOP
+		}
+		target, err := wp.linker.Readlink(vp)
+		if err != nil {
+			return err
+		}
+		if path.IsAbs(target) {
+			return volume.PermissionError
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return nil
+}
+
+// clientPath returns the path in the client. ok is false if the path is out of the root.
+func (wp *WebsocketVolumeProvider) clientPath(p string) (string, bool) {
+	if wp.root == "" || p == wp.root {
+		return strings.TrimPrefix(p, wp.root), true
+	}
+	if !strings.HasPrefix(p, wp.root+"/") {
+		return "", false
+	}
+	return p[len(wp.root)+1:], true
 }
 
 func (wp *WebsocketVolumeProvider) StartClient(connector websocketConnector) (<-chan struct{}, error) {
@@ -46,7 +213,7 @@ func (wp *WebsocketVolumeProvider) StartClient(connector websocketConnector) (<-
 
 func (wp *WebsocketVolumeProvider) StartClientWithDefaultConnector(wsurl string) (<-chan struct{}, error) {
 	var connector = func() (*websocket.Conn, error) {
-		c, _, err := websocket.DefaultDialer.Dial(wsurl, nil)
+		c, _, err := WSDialer.Dial(wsurl, nil)
 		return c, err
 	}
 	return wp.StartClient(connector)
@@ -65,20 +232,183 @@ func (v *WebsocketVolumeProvider) HandleRequest(w http.ResponseWriter, r *http.R
 }
 
 func (wp *WebsocketVolumeProvider) HandleSession(conn *websocket.Conn, target string) error {
-	conn.WriteJSON(&map[string]interface{}{})
-	wp.connected = true
-	defer func() { wp.connected = false }()
+	peer, err := providerHandshake(conn, wp.capabilities())
+	if err != nil {
+		log.Println("handshake error:", err)
+		return err
+	}
+	conn.EnableWriteCompression(peer.Has(CapCompression))
+	// Messages contain a block and a small header.
+	conn.SetReadLimit(int64(peer.blockSize()) + 64*1024)
+	atomic.AddInt32(&wp.sessions, 1)
+	defer atomic.AddInt32(&wp.sessions, -1)
 
 	log.Println("connect", target)
-	c := &wsVolumeProviderConn{v: wp.volume, conn: conn}
+	c := &wsVolumeProviderConn{v: wp.volume, conn: conn, peer: peer, provider: wp}
 	c.handleFileCommands()
+	c.unwatch()
+	c.closeHandles()
 	log.Println("disconnect")
 	return nil
 }
 
 type wsVolumeProviderConn struct {
-	v    volume.FS
-	conn *websocket.Conn
+	v         volume.FS
+	conn      *websocket.Conn
+	wlock     sync.Mutex
+	watcher   io.Closer
+	handles   map[uint32]*providerHandle
+	handleSeq uint32
+	peer      *Hello
+	provider  *WebsocketVolumeProvider
+}
+
+type providerHandle struct {
+	f    volume.File
+	flag int
+}
+
+// stat returns the FileInfo. "lstat" doesn't follow the symlink if the volume supports symlinks.
+func (c *wsVolumeProviderConn) stat(op, path string) (*volume.FileInfo, error) {
+	if op == "lstat" && c.provider.linker != nil {
+		return c.provider.linker.Lstat(path)
+	}
+	return c.v.Stat(path)
+}
+
+// checkRoot checks the paths of the command. Symlinks must not point out of the root.
+func (c *wsVolumeProviderConn) checkRoot(cmd *wsCommand) error {
+	follow := !noFollowOps[cmd.Op]
+	if cmd.Path != "" {
+		if err := c.provider.checkRoot(path.Clean("/" + cmd.Path)[1:], follow); err != nil {
+			return err
+		}
+	}
+	if cmd.NewPath != "" {
+		return c.provider.checkRoot(path.Clean("/" + cmd.NewPath)[1:], follow)
+	}
+	return nil
+}
+
+func (c *wsVolumeProviderConn) readlink(path string) (string, error) {
+	if c.provider.linker == nil {
+		return "", volume.UnsupportedError
+	}
+	return c.provider.linker.Readlink(path)
+}
+
+func (c *wsVolumeProviderConn) symlink(target, path, clientPath string) error {
+	if c.provider.linker == nil {
+		return volume.UnsupportedError
+	}
+	if !c.provider.linkAllowed(clientPath, target) {
+		return volume.PermissionError
+	}
+	return c.provider.linker.Symlink(target, path)
+}
+
+func (c *wsVolumeProviderConn) openHandle(path string, flag int, perm os.FileMode) (uint32, error) {
+	if len(c.handles) >= MaxHandles {
+		return 0, &os.PathError{Op: "open", Path: path, Err: syscall.ENOSPC}
+	}
+	f, err := c.v.OpenFile(path, flag, perm)
+	if err != nil {
+		return 0, err
+	}
+	if c.handles == nil {
+		c.handles = map[uint32]*providerHandle{}
+	}
+	c.handleSeq++
+	c.handles[c.handleSeq] = &providerHandle{f: f, flag: flag}
+	return c.handleSeq, nil
+}
+
+func (c *wsVolumeProviderConn) getHandle(h uint32) (*providerHandle, error) {
+	if f, ok := c.handles[h]; ok {
+		return f, nil
+	}
+	return nil, os.ErrClosed
+}
+
+func (c *wsVolumeProviderConn) closeHandle(h uint32) error {
+	f, err := c.getHandle(h)
+	if err != nil {
+		return err
+	}
+	delete(c.handles, h)
+	return f.f.Close()
+}
+
+// closeHandles closes all handles opened in the session.
+func (c *wsVolumeProviderConn) closeHandles() {
+	for h, f := range c.handles {
+		f.f.Close()
+		delete(c.handles, h)
+	}
+}
+
+func (c *wsVolumeProviderConn) readHandle(h uint32, dst []byte, offset int64) (int, error) {
+	f, err := c.getHandle(h)
+	if err != nil {
+		return 0, err
+	}
+	return f.f.ReadAt(dst, offset)
+}
+
+// writeHandle writes the data. The offset is ignored if the file is opened with O_APPEND.
+func (c *wsVolumeProviderConn) writeHandle(h uint32, data []byte, offset int64) (int, error) {
+	f, err := c.getHandle(h)
+	if err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return f.f.Write(data)
+	}
+	return f.f.WriteAt(data, offset)
+}
+
+func (c *wsVolumeProviderConn) writeJSON(v interface{}) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+func (c *wsVolumeProviderConn) writeMessage(messageType int, data []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// watch sends events of the volume to the client until unwatch is called.
+func (c *wsVolumeProviderConn) watch() error {
+	if c.watcher != nil {
+		return nil
+	}
+	w, err := c.v.Watch(func(ev volume.FileEvent) {
+		p, ok := c.provider.clientPath(ev.Path)
+		if !ok {
+			return
+		}
+		stat := ev.OptionalFileInfo
+		if stat != nil && p != ev.Path {
+			st := *stat
+			st.Path = p
+			stat = &st
+		}
+		c.writeJSON(&map[string]interface{}{"type": MessageTypeNotify, "data": &wsFileEvent{Type: ev.Type, Path: p, Stat: stat}})
+	})
+	if err != nil {
+		return err
+	}
+	c.watcher = w
+	return nil
+}
+
+func (c *wsVolumeProviderConn) unwatch() {
+	if c.watcher != nil {
+		c.watcher.Close()
+		c.watcher = nil
+	}
 }
 
 func (c *wsVolumeProviderConn) readBlock(path string, dst []byte, offset int64) (int, error) {
@@ -105,41 +435,62 @@ func (c *wsVolumeProviderConn) writeBlock(path string, data []byte, offset int64
 	return 0, err
 }
 
-func (c *wsVolumeProviderConn) response(rid interface{}, data interface{}) error {
+func (c *wsVolumeProviderConn) response(rid uint32, data interface{}) error {
 	if data == nil {
-		return c.conn.WriteJSON(&map[string]interface{}{"rid": rid})
+		return c.writeJSON(&map[string]interface{}{"rid": rid})
 	}
-	return c.conn.WriteJSON(&map[string]interface{}{"rid": rid, "data": data})
+	return c.writeJSON(&map[string]interface{}{"rid": rid, "data": data})
 }
 
-func (c *wsVolumeProviderConn) errorResponse(rid interface{}, err error, op string) error {
-	var msg string
-	if os.IsNotExist(err) {
-		msg = "noent"
-	} else {
-		msg = op + " error"
+// errorResponse sends the error code. Messages are not sent because they may contain local paths.
+func (c *wsVolumeProviderConn) errorResponse(rid uint32, err error, op string) error {
+	code, ok := errorCodeOf(err)
+	if !ok {
+		code = ErrorCode(op + " error")
 	}
-	return c.conn.WriteJSON(&map[string]interface{}{"error": msg, "rid": rid})
+	return c.writeJSON(&map[string]interface{}{"error": code, "rid": rid})
+}
+
+type wsCommand struct {
+	Op      string      `json:"op"`
+	RID     uint32      `json:"rid"`
+	Path    string      `json:"path"`
+	NewPath string      `json:"newpath"`
+	P       int64       `json:"p"`
+	L       int64       `json:"l"`
+	Mode    os.FileMode `json:"mode"`
+	ATime   time.Time   `json:"atime"`
+	MTime   time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Flag    int         `json:"flag"`
+	H       uint32      `json:"h"`      // file handle
+	Target  string      `json:"target"` // symlink target
 }
 
-func (c *wsVolumeProviderConn) readCommand() (map[string]json.Number, []byte, error) {
+func (c *wsVolumeProviderConn) readCommand() (*wsCommand, []byte, error) {
 	mt, msg, err := c.conn.ReadMessage()
 	if err != nil {
 		return nil, nil, err
 	}
-	var op map[string]json.Number
+	var cmd wsCommand
 	switch mt {
 	case websocket.TextMessage:
-		if err := json.Unmarshal(msg, &op); err != nil {
+		if err := json.Unmarshal(msg, &cmd); err != nil {
 			return nil, nil, err
 		}
-		return op, nil, err
+		return &cmd, nil, err
 	case websocket.BinaryMessage:
+		if len(msg) < 8 {
+			return nil, nil, fmt.Errorf("invalid binary message")
+		}
 		sz := binary.LittleEndian.Uint32(msg[4:])
-		if err := json.Unmarshal(msg[8:8+sz], &op); err != nil {
+		if uint32(len(msg)-8) < sz {
+			return nil, nil, fmt.Errorf("invalid binary message")
+		}
+		if err := json.Unmarshal(msg[8:8+sz], &cmd); err != nil {
 			return nil, nil, err
 		}
-		return op, msg[8+sz:], err
+		return &cmd, msg[8+sz:], err
 	default:
 		return nil, nil, fmt.Errorf("invalid message type")
 	}
@@ -151,61 +502,165 @@ func (c *wsVolumeProviderConn) handleFileCommands() {
 		if err != nil {
 			return
 		}
-		log.Print("op:", cmd["op"], cmd["path"])
-		rid := cmd["rid"]
-		op := cmd["op"].String()
+		log.Print("op:", cmd.Op, cmd.Path)
+		rid := cmd.RID
+		op := cmd.Op
+		if !c.provider.allowedCommand(cmd) {
+			c.errorResponse(rid, volume.PermissionError, op)
+			continue
+		}
+		if strings.ContainsRune(cmd.Path+cmd.NewPath+cmd.Target, 0) {
+			c.errorResponse(rid, os.ErrInvalid, op)
+			continue
+		}
+		clientPath := cmd.Path
+		if err := c.checkRoot(cmd); err != nil {
+			c.errorResponse(rid, err, op)
+			continue
+		}
+		cmd.Path = c.provider.volumePath(cmd.Path)
+		cmd.NewPath = c.provider.volumePath(cmd.NewPath)
 		switch op {
-		case "stat":
-			st, err := c.v.Stat(cmd["path"].String())
+		case "stat", "lstat":
+			st, err := c.stat(op, cmd.Path)
 			if err != nil {
 				c.errorResponse(rid, err, op)
 			} else {
+				if clientPath != cmd.Path {
+					stat := *st
+					stat.Path = clientPath
+					st = &stat
+				}
 				c.response(rid, st)
 			}
+		case "readlink":
+			target, err := c.readlink(cmd.Path)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, target)
+			}
+		case "symlink":
+			err := c.symlink(cmd.Target, cmd.Path, clientPath)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "open":
+			h, err := c.openHandle(cmd.Path, fromWireFlag(cmd.Flag), cmd.Mode)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, h)
+			}
+		case "close":
+			err := c.closeHandle(cmd.H)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
 		case "read":
-			l, _ := cmd["l"].Int64()
-			p, _ := cmd["p"].Int64()
-			b := make([]byte, l+8)
-			ridint, _ := rid.Int64()
+			if max := int64(c.peer.blockSize()); cmd.L > max {
+				cmd.L = max
+			}
+			if cmd.L < 0 {
+				cmd.L = 0
+			}
+			b := make([]byte, cmd.L+8)
 
-			len, err := c.readBlock(cmd["path"].String(), b[8:], p)
-			if err != nil && len == 0 {
+			var len int
+			var err error
+			if cmd.H != 0 {
+				len, err = c.readHandle(cmd.H, b[8:], cmd.P)
+			} else {
+				len, err = c.readBlock(cmd.Path, b[8:], cmd.P)
+			}
+			if err != nil && err != io.EOF && len == 0 {
 				c.errorResponse(rid, err, op)
 			} else {
-				binary.LittleEndian.PutUint32(b[4:], uint32(ridint))
-				c.conn.WriteMessage(websocket.BinaryMessage, b[:(8+len)])
+				binary.LittleEndian.PutUint32(b[4:], rid)
+				c.writeMessage(websocket.BinaryMessage, b[:(8+len)])
 			}
 		case "write":
-			p, _ := cmd["p"].Int64()
-			len, err := c.writeBlock(cmd["path"].String(), data, p)
+			var len int
+			var err error
+			if cmd.H != 0 {
+				len, err = c.writeHandle(cmd.H, data, cmd.P)
+			} else {
+				len, err = c.writeBlock(cmd.Path, data, cmd.P)
+			}
 			if err != nil {
 				c.errorResponse(rid, err, "write")
 			} else {
 				c.response(rid, len)
 			}
 		case "remove":
-			err := c.v.Remove(cmd["path"].String())
+			err := c.v.Remove(cmd.Path)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "rename":
+			err := c.v.Rename(cmd.Path, cmd.NewPath)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "chmod":
+			err := c.v.Chmod(cmd.Path, cmd.Mode&os.ModePerm)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "chtimes":
+			err := c.v.Chtimes(cmd.Path, cmd.ATime, cmd.MTime)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "truncate":
+			err := c.v.Truncate(cmd.Path, cmd.Size)
 			if err != nil {
 				c.errorResponse(rid, err, op)
 			} else {
 				c.response(rid, nil)
 			}
 		case "files":
-			files, err := c.v.ReadDir(cmd["path"].String())
+			files, err := c.v.ReadDir(cmd.Path)
 			if err != nil {
 				c.errorResponse(rid, err, op)
 			} else {
 				c.response(rid, files)
 			}
 		case "mkdir":
-			err := c.v.Mkdir(cmd["path"].String(), 0)
+			mode := cmd.Mode & os.ModePerm
+			if mode == 0 {
+				mode = 0755 // old clients don't send the mode.
+			}
+			err := c.v.Mkdir(cmd.Path, mode)
+			if err != nil {
+				c.errorResponse(rid, err, op)
+			} else {
+				c.response(rid, nil)
+			}
+		case "watch":
+			err := c.watch()
 			if err != nil {
 				c.errorResponse(rid, err, op)
 			} else {
 				c.response(rid, nil)
 			}
+		case "unwatch":
+			c.unwatch()
+			c.response(rid, nil)
 		default:
-			c.errorResponse(rid, nil, "unknown operation")
+			c.errorResponse(rid, volume.UnsupportedError, op)
 		}
 	}
 }
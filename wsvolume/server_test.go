@@ -0,0 +1,300 @@
+package wsvolume
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/binzume/cfs/volume"
+)
+
+func TestProvider_ReadOnly(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"a.txt": []byte("Hello")})
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(mem, ReadOnly()))
+	defer closer()
+
+	if _, err := vol.Stat("a.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+	f, err := vol.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "Hello" {
+		t.Errorf("unexpected content: %q %v", string(b), err)
+	}
+	f.Close()
+
+	check := func(err error) {
+		t.Helper()
+		if !errors.Is(err, os.ErrPermission) {
+			t.Errorf("permission error expected: %v", err)
+		}
+	}
+	_, err = vol.Create("b.txt")
+	check(err)
+	_, err = vol.OpenFile("a.txt", os.O_RDONLY|os.O_TRUNC, 0)
+	check(err)
+	check(vol.Remove("a.txt"))
+	check(vol.Rename("a.txt", "b.txt"))
+	check(vol.Mkdir("dir", 0755))
+	check(vol.Chmod("a.txt", 0600))
+	check(vol.Truncate("a.txt", 0))
+	if _, err := mem.Stat("a.txt"); err != nil {
+		t.Errorf("file should not be removed: %v", err)
+	}
+}
+
+func TestProvider_AllowOps(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"a.txt": []byte("Hello")})
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(mem, AllowOps("stat", "files", "open", "read", "write", "mkdir")))
+	defer closer()
+
+	w, err := vol.Create("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("World"))
+	if err := w.Close(); err != nil {
+		t.Errorf("Close error: %v", err)
+	}
+	if err := vol.Mkdir("dir", 0755); err != nil {
+		t.Errorf("Mkdir error: %v", err)
+	}
+	if err := vol.Remove("a.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("permission error expected: %v", err)
+	}
+	if _, err := vol.Watch(func(volume.FileEvent) {}); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("permission error expected: %v", err)
+	}
+}
+
+func TestProvider_Root(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"secret.txt": []byte("secret"), "pub/a.txt": []byte("Hello")})
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(mem, WithRoot("pub")))
+	defer closer()
+
+	files, err := vol.ReadDir("")
+	if err != nil || len(files) != 1 || files[0].Name() != "a.txt" {
+		t.Errorf("unexpected files: %v %v", files, err)
+	}
+	for _, p := range []string{"../secret.txt", "/../secret.txt", "a/../../secret.txt"} {
+		if _, err := vol.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%v should not be accessible: %v", p, err)
+		}
+	}
+	if err := vol.Rename("a.txt", "../b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("pub/b.txt"); err != nil {
+		t.Errorf("file should be renamed in the root: %v", err)
+	}
+
+	events := make(chan volume.FileEvent, 10)
+	watcher, err := vol.Watch(func(ev volume.FileEvent) { events <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	time.Sleep(50 * time.Millisecond)
+	mem.Mkdir("other", 0755)
+	mem.Mkdir("pub/dir", 0755)
+	select {
+	case ev := <-events:
+		if ev.Path != "dir" {
+			t.Errorf("unexpected event: %v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("timeout")
+	}
+}
+
+func TestProvider_RootSymlink(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "pub", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "pub", "a.txt"), []byte("Hello"), 0644)
+	if err := os.Symlink("../secret.txt", filepath.Join(dir, "pub", "out")); err != nil {
+		t.Skipf("symlink is not supported: %v", err)
+	}
+	os.Symlink("..", filepath.Join(dir, "pub", "up"))
+	os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(dir, "pub", "abs"))
+	os.Symlink("../../secret.txt", filepath.Join(dir, "pub", "sub", "out"))
+	os.Symlink("../a.txt", filepath.Join(dir, "pub", "sub", "in"))
+
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(volume.NewLocalVolume(dir), WithRoot("pub")))
+	defer closer()
+
+	for _, p := range []string{"out", "up/secret.txt", "abs", "sub/out", "up/pub/a.txt"} {
+		if _, err := vol.Stat(p); !os.IsPermission(err) {
+			t.Errorf("Stat(%q) should be refused: %v", p, err)
+		}
+		if f, err := vol.Open(p); err == nil {
+			data, _ := io.ReadAll(f)
+			f.Close()
+			t.Errorf("Open(%q) should fail: %q", p, data)
+		}
+	}
+	if _, err := vol.ReadDir("up"); !os.IsPermission(err) {
+		t.Errorf("ReadDir should be refused: %v", err)
+	}
+	if w, err := vol.Create("up/new.txt"); err == nil {
+		w.Close()
+		t.Errorf("Create should fail")
+	}
+	if err := vol.Rename("a.txt", "up/a.txt"); !os.IsPermission(err) {
+		t.Errorf("Rename should be refused: %v", err)
+	}
+
+	if stat, err := vol.Stat("sub/in"); err != nil || stat.Size() != 5 {
+		t.Errorf("symlink in the root should be followed: %v %v", stat, err)
+	}
+	if stat, err := vol.Lstat("out"); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if err := vol.Remove("out"); err != nil {
+		t.Errorf("symlink should be removable: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "secret.txt")); err != nil || string(data) != "secret" {
+		t.Errorf("outside file is modified: %q %v", data, err)
+	}
+}
+
+func TestProvider_HostilePaths(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(base, 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(base, "a.txt"), []byte("Hello"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	if err := os.Symlink("../outside", filepath.Join(base, "out")); err != nil {
+		t.Skipf("symlink is not supported: %v", err)
+	}
+	os.Symlink(outside, filepath.Join(base, "outabs"))
+
+	local := volume.NewLocalVolume(base, volume.Confine(), volume.RejectSpecialFiles())
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(local))
+	defer closer()
+
+	if _, err := vol.Stat("a.txt"); err != nil {
+		t.Errorf("Stat error: %v", err)
+	}
+	hostile := []string{
+		"../outside/secret.txt",
+		"/../../outside/secret.txt",
+		"out/secret.txt",
+		"outabs/secret.txt",
+		"out/../out/secret.txt",
+		"a.txt\x00/../out/secret.txt",
+	}
+	for _, p := range hostile {
+		if _, err := vol.Stat(p); err == nil {
+			t.Errorf("Stat(%q) should fail", p)
+		}
+		if f, err := vol.Open(p); err == nil {
+			data, _ := io.ReadAll(f)
+			f.Close()
+			t.Errorf("Open(%q) should fail: %q", p, data)
+		}
+		if err := vol.Remove(p); err == nil {
+			t.Errorf("Remove(%q) should fail", p)
+		}
+	}
+	if _, err := vol.Stat("out/secret.txt"); !os.IsPermission(err) {
+		t.Errorf("escaping symlink should be refused: %v", err)
+	}
+	if _, err := vol.Stat("a.txt\x00"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("NUL should be invalid: %v", err)
+	}
+	if w, err := vol.Create("out/new.txt"); err == nil {
+		w.Close()
+		t.Errorf("Create should fail")
+	}
+	if err := vol.Rename("a.txt", "outabs/a.txt"); err == nil {
+		t.Errorf("Rename should fail")
+	}
+	if err := vol.Chmod("a.txt", os.ModeSetuid|os.ModeSetgid|0600); err != nil {
+		t.Errorf("Chmod error: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(base, "a.txt")); err != nil || fi.Mode() != 0600 {
+		t.Errorf("only permission bits should be changed: %v %v", fi.Mode(), err)
+	}
+	if err := vol.Mkdir("dir", os.ModeSetgid|0700); err != nil {
+		t.Errorf("Mkdir error: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(base, "dir")); err != nil || fi.Mode() != os.ModeDir|0700 {
+		t.Errorf("unexpected mode: %v %v", fi.Mode(), err)
+	}
+	files, _ := ioutil.ReadDir(outside)
+	if len(files) != 1 {
+		t.Errorf("outside directory is modified: %v", files)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(outside, "secret.txt")); err != nil || string(data) != "secret" {
+		t.Errorf("outside file is modified: %q %v", data, err)
+	}
+}
+
+func TestProvider_Symlink(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"secret.txt": []byte("secret"), "pub/a.txt": []byte("Hello")})
+
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(mem, ReadOnly()))
+	defer closer()
+	if err := vol.Symlink("a.txt", "link"); !os.IsPermission(err) {
+		t.Errorf("Symlink should be refused in read-only mode: %v", err)
+	}
+
+	vol, closer = connectTestProvider(t, NewWebsocketVolumeProvider(mem, WithRoot("pub")))
+	defer closer()
+	for _, target := range []string{"../secret.txt", "/secret.txt", "dir/../../secret.txt"} {
+		if err := vol.Symlink(target, "link"); !os.IsPermission(err) {
+			t.Errorf("Symlink(%q) out of the root should be refused: %v", target, err)
+		}
+	}
+	if err := vol.Symlink("a.txt", "link"); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	if stat, err := vol.Lstat("link"); err != nil || stat.Mode()&os.ModeSymlink == 0 || stat.Path != "link" {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if target, err := mem.Readlink("pub/link"); err != nil || target != "a.txt" {
+		t.Errorf("symlink should be created in the root: %q %v", target, err)
+	}
+}
+
+func TestProvider_MaxHandles(t *testing.T) {
+	saved := MaxHandles
+	MaxHandles = 2
+	defer func() { MaxHandles = saved }()
+
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"a.txt": []byte("Hello")})
+	vol, closer := connectTestProvider(t, NewWebsocketVolumeProvider(mem))
+	defer closer()
+
+	f1, err := vol.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := vol.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if f, err := vol.Open("a.txt"); !errors.Is(err, syscall.ENOSPC) {
+		if err == nil {
+			f.Close()
+		}
+		t.Errorf("too many handles should be refused: %v", err)
+	}
+	f1.Close()
+	f3, err := vol.Open("a.txt")
+	if err != nil {
+		t.Fatalf("handle should be available after Close: %v", err)
+	}
+	f3.Close()
+}
@@ -0,0 +1,114 @@
+package wsvolume
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultWriteBehind is the recommended number of write blocks in flight. (see WebsocketVolume.WriteBehind)
+const DefaultWriteBehind = 4
+
+// blockWriter coalesces sequential writes into blocks and sends them without waiting for the responses.
+type blockWriter struct {
+	// send sends the block and returns a function which waits for the number of bytes written.
+	send    func(off int64, data []byte) (wait func() (int, error))
+	maxSize func() int
+	sem     chan struct{}
+
+	lock sync.Mutex // guards buf and the order of requests.
+	buf  []byte
+	off  int64
+
+	state    sync.Mutex
+	done     *sync.Cond
+	inflight int
+	err      error
+}
+
+func newBlockWriter(send func(off int64, data []byte) func() (int, error), maxSize func() int, writeBehind int) *blockWriter {
+	w := &blockWriter{send: send, maxSize: maxSize, sem: make(chan struct{}, writeBehind)}
+	w.done = sync.NewCond(&w.state)
+	return w
+}
+
+// WriteAt buffers the data and returns len(p).
+// Errors of the buffered data are returned by the following WriteAt or Flush.
+func (w *blockWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.error(); err != nil {
+		return 0, err
+	}
+	if len(w.buf) > 0 && off != w.off+int64(len(w.buf)) {
+		w.flush()
+	}
+	n := 0
+	for n < len(p) {
+		max := w.maxSize()
+		if len(w.buf) >= max {
+			w.flush()
+		}
+		if len(w.buf) == 0 {
+			w.off = off + int64(n)
+			w.buf = make([]byte, 0, max)
+		}
+		c := len(p) - n
+		if c > max-len(w.buf) {
+			c = max - len(w.buf)
+		}
+		w.buf = append(w.buf, p[n:n+c]...)
+		n += c
+	}
+	if len(w.buf) >= w.maxSize() {
+		w.flush()
+	}
+	return n, nil
+}
+
+// flush sends the buffered data. w.lock must be held.
+func (w *blockWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	data, off := w.buf, w.off
+	w.buf = nil
+	w.sem <- struct{}{}
+	w.state.Lock()
+	w.inflight++
+	w.state.Unlock()
+	wait := w.send(off, data)
+	go func() {
+		n, err := wait()
+		if err == nil && n < len(data) {
+			err = io.ErrShortWrite
+		}
+		<-w.sem
+		w.state.Lock()
+		defer w.state.Unlock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.inflight--
+		w.done.Broadcast()
+	}()
+}
+
+// Flush sends the buffered data and waits for the responses.
+func (w *blockWriter) Flush() error {
+	w.lock.Lock()
+	w.flush()
+	w.lock.Unlock()
+
+	w.state.Lock()
+	defer w.state.Unlock()
+	for w.inflight > 0 {
+		w.done.Wait()
+	}
+	return w.err
+}
+
+func (w *blockWriter) error() error {
+	w.state.Lock()
+	defer w.state.Unlock()
+	return w.err
+}
@@ -0,0 +1,93 @@
+package wsvolume
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testBlockSink struct {
+	lock     sync.Mutex
+	data     []byte
+	sizes    []int
+	inflight int
+	maxIn    int
+	err      error
+}
+
+func (s *testBlockSink) send(off int64, data []byte) func() (int, error) {
+	s.lock.Lock()
+	s.sizes = append(s.sizes, len(data))
+	s.inflight++
+	if s.inflight > s.maxIn {
+		s.maxIn = s.inflight
+	}
+	if end := int(off) + len(data); end > len(s.data) {
+		s.data = append(s.data, make([]byte, end-len(s.data))...)
+	}
+	copy(s.data[off:], data)
+	err := s.err
+	s.lock.Unlock()
+	return func() (int, error) {
+		time.Sleep(time.Millisecond)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.inflight--
+		if err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+}
+
+func TestBlockWriter(t *testing.T) {
+	sink := &testBlockSink{}
+	w := newBlockWriter(sink.send, func() int { return 10000 }, 2)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4000)
+	for i := 0; i < len(data); i += 100 {
+		if n, err := w.WriteAt(data[i:i+100], int64(i)); n != 100 || err != nil {
+			t.Fatalf("WriteAt error: %v %v", n, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sink.data, data) {
+		t.Errorf("unexpected data")
+	}
+	if len(sink.sizes) != 7 || sink.sizes[0] != 10000 {
+		t.Errorf("writes should be coalesced: %v", sink.sizes)
+	}
+	if sink.maxIn > 2 {
+		t.Errorf("too many requests in flight: %v", sink.maxIn)
+	}
+
+	// Non-sequential writes are sent separately.
+	w.WriteAt([]byte("XX"), 0)
+	w.WriteAt([]byte("YY"), 100)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if string(sink.data[:2]) != "XX" || string(sink.data[100:102]) != "YY" || len(sink.sizes) != 9 {
+		t.Errorf("unexpected writes: %v", sink.sizes)
+	}
+}
+
+func TestBlockWriter_Error(t *testing.T) {
+	sink := &testBlockSink{err: syscall.ENOSPC}
+	w := newBlockWriter(sink.send, func() int { return 10 }, 2)
+
+	if n, err := w.WriteAt([]byte("Hello"), 0); n != 5 || err != nil {
+		t.Errorf("data should be buffered: %v %v", n, err)
+	}
+	if err := w.Flush(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Flush should return the error: %v", err)
+	}
+	if _, err := w.WriteAt([]byte("Hello"), 5); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("WriteAt should return the error: %v", err)
+	}
+}
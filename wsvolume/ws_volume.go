@@ -2,6 +2,7 @@ package wsvolume
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,14 +26,16 @@ type rmsg struct {
 	data   []byte
 	binary bool
 	err    error
+	conn   *wsVolumeConn // connection which received the message
 }
 
 type ReqData map[string]interface{}
 type Cmd struct {
-	req      ReqData
-	bindata  []byte
-	resCh    chan<- *rmsg
-	canceled bool
+	req     ReqData
+	bindata []byte
+	resCh   chan<- *rmsg
+	ctx     context.Context
+	replay  int
 }
 
 const (
@@ -46,20 +50,116 @@ type ResponseJson struct {
 	Data  json.RawMessage `json:"data"`
 }
 
+// Open flags in the protocol. os.O_* values are platform dependent.
+const (
+	flagRead   = 0x0
+	flagWrite  = 0x1
+	flagRW     = 0x2
+	flagAppend = 0x10
+	flagCreate = 0x20
+	flagExcl   = 0x40
+	flagTrunc  = 0x80
+	flagSync   = 0x100
+)
+
+var wireFlags = []struct{ os, wire int }{
+	{os.O_APPEND, flagAppend},
+	{os.O_CREATE, flagCreate},
+	{os.O_EXCL, flagExcl},
+	{os.O_TRUNC, flagTrunc},
+	{os.O_SYNC, flagSync},
+}
+
+func toWireFlag(flag int) int {
+	w := flagRead
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		w = flagWrite
+	case os.O_RDWR:
+		w = flagRW
+	}
+	for _, f := range wireFlags {
+		if flag&f.os != 0 {
+			w |= f.wire
+		}
+	}
+	return w
+}
+
+func fromWireFlag(w int) int {
+	flag := os.O_RDONLY
+	switch w & 0x3 {
+	case flagWrite:
+		flag = os.O_WRONLY
+	case flagRW:
+		flag = os.O_RDWR
+	}
+	for _, f := range wireFlags {
+		if w&f.wire != 0 {
+			flag |= f.os
+		}
+	}
+	return flag
+}
+
 type RemoteError string
 
 func (e *RemoteError) Error() string {
 	return string(*e)
 }
 
+// ConnState is the state of the connections of WebsocketVolume.
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting             // reconnecting
+	StateConnected              // one or more connections are available
+	StateClosed                 // terminated
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
 // WebsocketVolume ...
 type WebsocketVolume struct {
-	Name           string
+	Name string
+	// PoolSize is the number of connections. Requests are sent through any available connection. (0: 1)
+	PoolSize int
+	// OnStateChange is called when the state is changed. It must not call Terminate.
+	OnStateChange func(state ConnState)
+	// ReadAhead is the number of blocks prefetched by sequential reads. (0: DefaultReadAhead, <0: disabled)
+	ReadAhead int
+	// WriteBehind is the number of write blocks in flight. (0: disabled)
+	// If it is enabled, WriteAt returns len(p) when the data is buffered.
+	// Written data is confirmed by the provider only when Flush or Close succeeds.
+	WriteBehind int
+
 	lock           sync.Mutex
-	conn           io.Closer // TODO: multiple conns
+	conns          []*wsVolumeConn
+	connector      websocketConnector
+	quit           chan struct{}
+	closed         bool
+	state          ConnState
+	stateLock      sync.Mutex
 	wch            chan *Cmd
 	statCache      statCache
 	notifyCallback func(data []byte)
+	watchers       map[*wsWatcher]struct{}
+	watchConn      *wsVolumeConn // connection which receives events
+	watchLock      sync.Mutex
+	peer           *Hello // handshake message of the provider
 }
 
 type statCache struct {
@@ -75,21 +175,48 @@ type websocketConnector func() (*websocket.Conn, error)
 
 // NewWebsocketVolume returns a new volume.
 func NewWebsocketVolume(name string) *WebsocketVolume {
-	return &WebsocketVolume{
+	v := &WebsocketVolume{
 		Name:      name,
+		quit:      make(chan struct{}),
 		wch:       make(chan *Cmd),
 		statCache: statCache{c: map[string]*statCacheE{}},
+		watchers:  map[*wsWatcher]struct{}{},
 	}
+	v.notifyCallback = v.handleNotify
+	return v
 }
 
 // WSUpgrader for upgrading http request in handle request
 var WSUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+}
+
+// WSDialer is used by StartClientWithDefaultConnector.
+var WSDialer = &websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
 }
 
+var clientCapabilities = []string{CapCompression}
+
 var statCacheExpireTime = time.Second * 5
 
+// Reconnection intervals. The interval is doubled on each failure.
+var (
+	ReconnectMinInterval = 500 * time.Millisecond
+	ReconnectMaxInterval = 30 * time.Second
+)
+
+// MaxReplay is the max number of times a request is sent again after its connection is lost.
+// Only requests without side effects are sent again. (e.g. stat, read)
+var MaxReplay = 3
+
+// ReconnectWait is the max time that requests wait for reconnection while no connection is live.
+var ReconnectWait = 3 * time.Second
+
 func (c *statCache) set(path string, stat *volume.FileInfo) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -111,6 +238,28 @@ func (c *statCache) delete(path string) {
 	defer c.lock.Unlock()
 	delete(c.c, path)
 }
+
+// invalidate deletes the path, its parent and its descendants.
+func (c *statCache) invalidate(p string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	parent := path.Dir(p)
+	if parent == "." {
+		delete(c.c, "")
+	}
+	delete(c.c, parent)
+	delete(c.c, p)
+	for k := range c.c {
+		if strings.HasPrefix(k, p+"/") {
+			delete(c.c, k)
+		}
+	}
+}
+func (c *statCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.c = map[string]*statCacheE{}
+}
 func (c *statCache) checkAll() {
 	now := time.Now()
 	c.lock.Lock()
@@ -122,22 +271,101 @@ func (c *statCache) checkAll() {
 	}
 }
 
-// Start volume backend.
+// Start volume backend. Lost connections are reconnected with the connector until Terminate is called.
+// The returned channel is closed after the volume is terminated.
 func (v *WebsocketVolume) StartClient(connector websocketConnector) (<-chan struct{}, error) {
+	v.lock.Lock()
+	if v.connector != nil {
+		v.lock.Unlock()
+		return nil, fmt.Errorf("Already connected")
+	}
+	v.reopen()
+	v.connector = connector
+	quit := v.quit
+	v.lock.Unlock()
+	v.updateState()
+
 	conn, err := connector()
+	var connDone <-chan struct{}
+	if err == nil {
+		connDone, err = v.bind(conn, 0)
+	}
 	if err != nil {
 		log.Println("failed to connect: ", err)
+		v.lock.Lock()
+		v.connector = nil
+		v.lock.Unlock()
+		v.updateState()
 		return nil, err
 	}
 
 	log.Println("start volume.", v.Name)
 
-	return v.BindConnection(conn)
+	n := v.PoolSize
+	if n <= 0 {
+		n = 1
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(n)
+	backoff := &backoff{min: ReconnectMinInterval, max: ReconnectMaxInterval}
+	go v.keepConnection(connector, connDone, quit, backoff, &wg)
+	for i := 1; i < n; i++ {
+		go v.keepConnection(connector, nil, quit, backoff, &wg)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done, nil
+}
+
+type backoff struct {
+	min, max time.Duration
+}
+
+// keepConnection reconnects when the connection is closed.
+func (v *WebsocketVolume) keepConnection(connector websocketConnector, connDone <-chan struct{}, quit <-chan struct{}, b *backoff, wg *sync.WaitGroup) {
+	defer wg.Done()
+	interval := b.min
+	for {
+		if connDone == nil {
+			conn, err := connector()
+			if err == nil {
+				connDone, err = v.bind(conn, 0)
+			}
+			if err != nil {
+				log.Println("failed to connect: ", err)
+				select {
+				case <-time.After(interval):
+				case <-quit:
+					return
+				}
+				if interval *= 2; interval > b.max {
+					interval = b.max
+				}
+				continue
+			}
+			interval = b.min
+		}
+		select {
+		case <-connDone:
+		case <-quit:
+			return
+		}
+		connDone = nil
+		log.Println("reconnecting volume.", v.Name)
+		select {
+		case <-time.After(b.min):
+		case <-quit:
+			return
+		}
+	}
 }
 
 func (v *WebsocketVolume) StartClientWithDefaultConnector(wsurl string) (<-chan struct{}, error) {
 	var connector = func() (*websocket.Conn, error) {
-		c, _, err := websocket.DefaultDialer.Dial(wsurl, nil)
+		c, _, err := WSDialer.Dial(wsurl, nil)
 		return c, err
 	}
 	return v.StartClient(connector)
@@ -155,17 +383,30 @@ type wsVolumeConn struct {
 	conn     *websocket.Conn
 	cmds     map[uint32]*Cmd
 	cmdsLock sync.Mutex
+	closed   bool
+	wlock    sync.Mutex
 	ridSeq   uint32
 }
 
+var errConnClosed = errors.New("connection closed")
+
 func (c *wsVolumeConn) sendCommand(cmd *Cmd) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
 	c.ridSeq++
-	cmd.req["rid"] = c.ridSeq
+	rid := c.ridSeq
+	cmd.req["rid"] = rid
+	c.cmdsLock.Lock()
+	if c.closed {
+		c.cmdsLock.Unlock()
+		return errConnClosed
+	}
+	c.cmds[rid] = cmd
+	c.cmdsLock.Unlock()
+
+	var err error
 	if cmd.bindata == nil {
-		err := c.conn.WriteJSON(cmd.req)
-		if err != nil {
-			return err
-		}
+		err = c.conn.WriteJSON(cmd.req)
 	} else {
 		buf := new(bytes.Buffer)
 		j, _ := json.Marshal(cmd.req)
@@ -173,15 +414,17 @@ func (c *wsVolumeConn) sendCommand(cmd *Cmd) error {
 		binary.Write(buf, binary.LittleEndian, uint32(len(j)))
 		buf.Write(j)
 		buf.Write(cmd.bindata)
-		err := c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
-		if err != nil {
-			return err
+		err = c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	}
+	if err != nil {
+		c.cmdsLock.Lock()
+		if _, ok := c.cmds[rid]; !ok {
+			err = nil // already taken by Close.
 		}
+		delete(c.cmds, rid)
+		c.cmdsLock.Unlock()
 	}
-	c.cmdsLock.Lock()
-	c.cmds[c.ridSeq] = cmd
-	c.cmdsLock.Unlock()
-	return nil
+	return err
 }
 
 func (c *wsVolumeConn) readMessage() (*rmsg, uint32, error) {
@@ -198,14 +441,14 @@ func (c *wsVolumeConn) readMessage() (*rmsg, uint32, error) {
 		if res.Error != nil {
 			err = (*RemoteError)(res.Error)
 		}
-		return &rmsg{res.Type, res.Data, false, err}, res.RID, nil
+		return &rmsg{typ: res.Type, data: res.Data, err: err}, res.RID, nil
 	case websocket.BinaryMessage:
 		if len(msg) < 8 {
 			return nil, 0, fmt.Errorf("invalid binary response")
 		}
 		typ := binary.LittleEndian.Uint32(msg[0:])
 		rid := binary.LittleEndian.Uint32(msg[4:])
-		return &rmsg{int(typ), msg[8:], true, nil}, rid, nil
+		return &rmsg{typ: int(typ), data: msg[8:], binary: true}, rid, nil
 	default:
 		return nil, 0, fmt.Errorf("invalid message type")
 	}
@@ -216,54 +459,86 @@ func (c *wsVolumeConn) setResult(rid uint32, result *rmsg) {
 	defer c.cmdsLock.Unlock()
 	if cmd, ok := c.cmds[rid]; ok {
 		delete(c.cmds, rid)
-		if !cmd.canceled {
-			cmd.resCh <- result
-		}
+		result.conn = c
+		cmd.resCh <- result // resCh is buffered.
 		close(cmd.resCh)
 	}
 }
 
-func (c *wsVolumeConn) Close() error {
-	// cancel commands
+// Close closes the connection and returns the commands in flight.
+func (c *wsVolumeConn) Close() ([]*Cmd, error) {
 	c.cmdsLock.Lock()
+	c.closed = true
+	var pending []*Cmd
 	for _, cmd := range c.cmds {
-		close(cmd.resCh)
+		pending = append(pending, cmd)
 	}
+	c.cmds = map[uint32]*Cmd{}
 	c.cmdsLock.Unlock()
-	return c.conn.Close()
+	return pending, c.conn.Close()
 }
 
+// BindConnection adds the connection to the pool. It fails if the pool is full.
 func (v *WebsocketVolume) BindConnection(conn *websocket.Conn) (<-chan struct{}, error) {
+	n := v.PoolSize
+	if n <= 0 {
+		n = 1
+	}
 	v.lock.Lock()
-	defer v.lock.Unlock()
+	v.reopen()
+	v.lock.Unlock()
+	return v.bind(conn, n)
+}
 
-	if v.conn != nil {
-		return nil, fmt.Errorf("Already connected")
+// reopen resets the terminated volume. v.lock must be held.
+func (v *WebsocketVolume) reopen() {
+	if v.closed {
+		v.quit = make(chan struct{})
+		v.closed = false
 	}
+}
+
+// bind starts to handle the connection. maxConns = 0 : unlimited
+func (v *WebsocketVolume) bind(conn *websocket.Conn, maxConns int) (<-chan struct{}, error) {
+	peer, err := clientHandshake(conn, clientCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	conn.EnableWriteCompression(peer.Has(CapCompression))
 
 	c := &wsVolumeConn{conn: conn, cmds: map[uint32]*Cmd{}}
+	v.lock.Lock()
+	if v.closed || maxConns > 0 && len(v.conns) >= maxConns {
+		v.lock.Unlock()
+		return nil, fmt.Errorf("Already connected")
+	}
+	v.conns = append(v.conns, c)
+	v.peer = peer
+	quit := v.quit
+	v.lock.Unlock()
+	v.updateState()
+	go v.subscribe()
 
-	v.conn = c
 	done := make(chan struct{})
-	var data = map[string]string{}
-	conn.ReadJSON(data) // wait to establish.
-
 	go func() {
-		defer v.Terminate()
 		for {
 			select {
 			case cmd := <-v.wch:
 				if err := c.sendCommand(cmd); err != nil {
-					close(cmd.resCh)
+					v.replay(cmd)
+					c.conn.Close()
+					return
 				}
 			case <-done:
 				return
+			case <-quit:
+				return
 			}
 		}
 	}()
 
 	go func() {
-		defer v.Terminate()
+		defer v.unbind(c)
 		defer close(done)
 		for {
 			msg, rid, err := c.readMessage()
@@ -283,55 +558,222 @@ func (v *WebsocketVolume) BindConnection(conn *websocket.Conn) (<-chan struct{},
 	return done, nil
 }
 
+// unbind removes the connection from the pool and replays its commands in flight.
+func (v *WebsocketVolume) unbind(c *wsVolumeConn) {
+	pending, _ := c.Close()
+	v.lock.Lock()
+	for i, conn := range v.conns {
+		if conn == c {
+			v.conns = append(v.conns[:i], v.conns[i+1:]...)
+			break
+		}
+	}
+	resubscribe := v.watchConn == c
+	if resubscribe {
+		v.watchConn = nil
+	}
+	v.lock.Unlock()
+	for _, cmd := range pending {
+		v.replay(cmd)
+	}
+	v.updateState()
+	if resubscribe {
+		go v.subscribe()
+	}
+}
+
+// replayableOps are the operations which have no side effect. Other requests may have been applied by the provider
+// before the connection is lost, so they fail instead of being sent again.
+var replayableOps = map[string]bool{"stat": true, "lstat": true, "files": true, "read": true, "readlink": true}
+
+func replayable(r ReqData) bool {
+	op, _ := r["op"].(string)
+	if op == "open" {
+		flag, _ := r["flag"].(int)
+		return flag == flagRead
+	}
+	return replayableOps[op]
+}
+
+// replay sends the command again through another connection.
+func (v *WebsocketVolume) replay(cmd *Cmd) {
+	v.lock.Lock()
+	quit := v.quit
+	v.lock.Unlock()
+	cmd.replay++
+	if cmd.replay > MaxReplay || !replayable(cmd.req) {
+		close(cmd.resCh)
+		return
+	}
+	go func() {
+		wait, stop := v.reconnectTimer()
+		defer stop()
+		select {
+		case v.wch <- cmd:
+		case <-cmd.ctx.Done():
+			close(cmd.resCh)
+		case <-quit:
+			close(cmd.resCh)
+		case <-wait:
+			close(cmd.resCh)
+		}
+	}()
+}
+
+// reconnectTimer returns a channel which fires after ReconnectWait if no connection is live. Otherwise it returns nil.
+func (v *WebsocketVolume) reconnectTimer() (<-chan time.Time, func()) {
+	v.lock.Lock()
+	live := len(v.conns) > 0
+	v.lock.Unlock()
+	if live {
+		return nil, func() {}
+	}
+	t := time.NewTimer(ReconnectWait)
+	return t.C, func() { t.Stop() }
+}
+
+func (v *WebsocketVolume) updateState() {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
+	v.lock.Lock()
+	state := StateDisconnected
+	if v.closed {
+		state = StateClosed
+	} else if len(v.conns) > 0 {
+		state = StateConnected
+	} else if v.connector != nil {
+		state = StateConnecting
+	}
+	changed := state != v.state
+	v.state = state
+	callback := v.OnStateChange
+	v.lock.Unlock()
+	if changed && callback != nil {
+		callback(state)
+	}
+}
+
+// State returns the current state of the connections.
+func (v *WebsocketVolume) State() ConnState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.state
+}
+
 // Stop volume backend.
 func (v *WebsocketVolume) Terminate() {
 	v.lock.Lock()
-	defer v.lock.Unlock()
+	if !v.closed {
+		close(v.quit)
+		v.closed = true
+	}
+	conns := append([]*wsVolumeConn{}, v.conns...)
+	v.connector = nil
+	v.lock.Unlock()
 
-	if v.conn != nil {
-		v.conn.Close()
-		v.conn = nil
+	for _, c := range conns {
+		c.conn.Close()
 	}
+	v.updateState()
 	log.Println("terminate volume.", v.Name)
 }
 
-func (v *WebsocketVolume) requestRaw(r ReqData, bindata []byte) (*rmsg, error) {
-	if v.conn == nil {
-		return nil, fmt.Errorf("connection closed")
+// RequestTimeout is used for requests without deadline.
+var RequestTimeout = 15 * time.Second
+
+func (v *WebsocketVolume) requestRaw(ctx context.Context, r ReqData, bindata []byte) (*rmsg, error) {
+	if !v.Available() {
+		return nil, errConnClosed
 	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RequestTimeout)
+		defer cancel()
+	}
+	v.lock.Lock()
+	quit := v.quit
+	v.lock.Unlock()
 	rch := make(chan *rmsg, 1)
 	cmd := &Cmd{
 		req:     r,
 		bindata: bindata,
 		resCh:   rch,
+		ctx:     ctx,
+	}
+	wait, stop := v.reconnectTimer()
+	defer stop()
+	select {
+	case v.wch <- cmd:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-quit:
+		return nil, errConnClosed
+	case <-wait:
+		return nil, errConnClosed
 	}
-	v.wch <- cmd
 	select {
 	case res := <-rch:
 		if res == nil {
-			return nil, fmt.Errorf("connection closed")
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errConnClosed
 		}
 		return res, res.err
-	case <-time.After(15 * time.Second):
-		cmd.canceled = true
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return nil, fmt.Errorf("timeout")
 }
 
-func (v *WebsocketVolume) request(r ReqData, result interface{}) error {
-	rmsg, err := v.requestRaw(r, nil)
+// requestConn sends the request through the connection. The request is not replayed.
+func (v *WebsocketVolume) requestConn(ctx context.Context, c *wsVolumeConn, r ReqData, bindata []byte) (*rmsg, error) {
+	wait, err := v.startRequest(ctx, c, r, bindata)
 	if err != nil {
-		if err.Error() == "noent" {
-			path := r["path"].(string)
-			op := r["op"].(string)
-			v.statCache.set(path, nil)
-			return &os.PathError{
-				Op:   op,
-				Path: path,
-				Err:  volume.NoentError,
+		return nil, err
+	}
+	return wait()
+}
+
+// startRequest sends the request through the connection and returns a function which waits for the response.
+func (v *WebsocketVolume) startRequest(ctx context.Context, c *wsVolumeConn, r ReqData, bindata []byte) (func() (*rmsg, error), error) {
+	cancel := context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		ctx, cancel = context.WithTimeout(ctx, RequestTimeout)
+	}
+	rch := make(chan *rmsg, 1)
+	cmd := &Cmd{req: r, bindata: bindata, resCh: rch, ctx: ctx, replay: MaxReplay}
+	if err := c.sendCommand(cmd); err != nil {
+		cancel()
+		c.conn.Close() // unbind the connection.
+		return nil, errConnClosed
+	}
+	return func() (*rmsg, error) {
+		defer cancel()
+		select {
+		case res := <-rch:
+			if res == nil {
+				return nil, errConnClosed
 			}
+			return res, res.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		return err
+	}, nil
+}
+
+// sendTo sends the request through the connection. The request is not replayed.
+func (v *WebsocketVolume) sendTo(ctx context.Context, c *wsVolumeConn, r ReqData) error {
+	_, err := v.requestConn(ctx, c, r, nil)
+	return err
+}
+
+func (v *WebsocketVolume) request(ctx context.Context, r ReqData, result interface{}) error {
+	// r may be modified by replays after the request is cancelled.
+	op, _ := r["op"].(string)
+	path, _ := r["path"].(string)
+	rmsg, err := v.requestRaw(ctx, r, nil)
+	if err != nil {
+		return v.remoteError(op, path, err)
 	}
 	if result != nil {
 		return json.Unmarshal(rmsg.data, result)
@@ -339,11 +781,48 @@ func (v *WebsocketVolume) request(r ReqData, result interface{}) error {
 	return nil
 }
 
+// remoteError wraps the error returned by the provider in *os.PathError.
+func (v *WebsocketVolume) remoteError(op, path string, err error) error {
+	err = pathError(op, path, err)
+	if errors.Is(err, os.ErrNotExist) {
+		v.statCache.set(path, nil)
+	}
+	return err
+}
+
+// Peer returns the handshake message of the provider. nil if the volume has never been connected.
+func (v *WebsocketVolume) Peer() *Hello {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.peer
+}
+
+// supports returns false if the provider doesn't support the capability.
+func (v *WebsocketVolume) supports(capability string) bool {
+	peer := v.Peer()
+	return peer == nil || peer.Has(capability)
+}
+
+func (v *WebsocketVolume) blockSize() int {
+	if peer := v.Peer(); peer != nil {
+		return peer.blockSize()
+	}
+	return MaxBlockSize
+}
+
+// Available returns true if the volume is connected or reconnecting.
+// While reconnecting, requests fail if no connection is established in ReconnectWait.
 func (v *WebsocketVolume) Available() bool {
-	return v.conn != nil
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return !v.closed && (len(v.conns) > 0 || v.connector != nil)
 }
 
 func (v *WebsocketVolume) Stat(path string) (*volume.FileInfo, error) {
+	return v.StatContext(context.Background(), path)
+}
+
+func (v *WebsocketVolume) StatContext(ctx context.Context, path string) (*volume.FileInfo, error) {
 	if s, ok := v.statCache.get(path); ok {
 		if s == nil {
 			return nil, &os.PathError{
@@ -357,7 +836,7 @@ func (v *WebsocketVolume) Stat(path string) (*volume.FileInfo, error) {
 		return &stat, nil
 	}
 	var stat volume.FileInfo
-	err := v.request(ReqData{"op": "stat", "path": path}, &stat)
+	err := v.request(ctx, ReqData{"op": "stat", "path": path}, &stat)
 	if err != nil {
 		return nil, err
 	}
@@ -366,57 +845,216 @@ func (v *WebsocketVolume) Stat(path string) (*volume.FileInfo, error) {
 }
 
 type fileHandle struct {
-	volume           *WebsocketVolume
-	path             string
-	lastReadPos      int64
-	seqReadCount     int
-	readBufferOffset int64
-	readBuffer       []byte
+	volume *WebsocketVolume
+	path   string
+	flag   int
+	perm   os.FileMode
+	reader *blockReader
+	writer *blockWriter // nil: write-through
+
+	lock   sync.Mutex
+	h      uint32 // handle id in the provider
+	conn   *wsVolumeConn
+	closed bool
 }
 
-func (f *fileHandle) ReadAt(b []byte, offset int64) (int, error) {
-	// if offset >= f.readBufferOffset && offset+int64(len(b)) <= f.readBufferOffset+int64(len(f.readBuffer)) {
-	if offset >= f.readBufferOffset && offset < f.readBufferOffset+int64(len(f.readBuffer)) {
-		return copy(b, f.readBuffer[offset-f.readBufferOffset:]), nil
+// open opens the file in the provider. f.lock must be held.
+func (f *fileHandle) open(ctx context.Context, flag int) error {
+	v := f.volume
+	r := ReqData{"op": "open", "path": f.path, "flag": toWireFlag(flag), "mode": f.perm}
+	msg, err := v.requestRaw(ctx, r, nil)
+	if err != nil {
+		return v.remoteError("open", f.path, err)
 	}
+	var h uint32
+	if err := json.Unmarshal(msg.data, &h); err != nil {
+		return err
+	}
+	f.h, f.conn = h, msg.conn
+	return nil
+}
+
+// reopen opens the file again if the connection of the handle is lost.
+func (f *fileHandle) reopen(ctx context.Context, lost *wsVolumeConn) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "open", Path: f.path, Err: os.ErrClosed}
+	}
+	if f.conn != lost {
+		return nil // already reopened.
+	}
+	return f.open(ctx, f.flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC))
+}
 
-	sz := len(b)
-	if offset == f.lastReadPos {
-		f.seqReadCount++
-		if f.seqReadCount > 2 && sz < 32768 && sz > 0 {
-			sz *= (32768 / sz)
+// requestRaw sends the request with the handle.
+// Note that a write may be applied twice if the connection is lost before the response.
+// Writes on O_APPEND handles are not replayed because the data would be appended twice.
+func (f *fileHandle) requestRaw(ctx context.Context, r ReqData, bindata []byte) (*rmsg, error) {
+	op := r["op"].(string)
+	for retry := 0; ; retry++ {
+		f.lock.Lock()
+		h, c, closed := f.h, f.conn, f.closed
+		f.lock.Unlock()
+		if closed {
+			return nil, &os.PathError{Op: op, Path: f.path, Err: os.ErrClosed}
+		}
+		if c == nil {
+			// The provider doesn't support handles.
+			r["path"] = f.path
+			msg, err := f.volume.requestRaw(ctx, r, bindata)
+			return msg, f.volume.remoteError(op, f.path, err)
+		}
+		r["h"] = h
+		msg, err := f.volume.requestConn(ctx, c, r, bindata)
+		if err == nil {
+			return msg, nil
+		}
+		if err != errConnClosed || retry >= MaxReplay {
+			return nil, pathError(op, f.path, err)
+		}
+		if op == "write" && f.flag&os.O_APPEND != 0 {
+			f.reopen(ctx, c) // for the following requests.
+			return nil, pathError(op, f.path, err)
+		}
+		if err := f.reopen(ctx, c); err != nil {
+			return nil, err
 		}
 	}
-	v := f.volume
-	msg, err := v.requestRaw(ReqData{"op": "read", "path": f.path, "p": offset, "l": sz}, nil)
-	if err != nil {
+}
+
+func (f *fileHandle) ReadAt(b []byte, offset int64) (int, error) {
+	if err := f.Flush(); err != nil {
 		return 0, err
 	}
-	if !msg.binary {
-		return 0, fmt.Errorf("invalid msgType")
+	return f.reader.ReadAt(b, offset)
+}
+
+func (f *fileHandle) readBlock(ctx context.Context, offset int64, size int) ([]byte, error) {
+	msg, err := f.requestRaw(ctx, ReqData{"op": "read", "p": offset, "l": size}, nil)
+	if err != nil {
+		return nil, err
 	}
-	if len(msg.data) == 0 {
-		return 0, io.EOF
+	if !msg.binary {
+		return nil, fmt.Errorf("invalid msgType")
 	}
-	l := copy(b, msg.data)
-	f.lastReadPos = offset + int64(l)
-	f.readBufferOffset = offset
-	f.readBuffer = msg.data
-	return l, nil
+	return msg.data, nil
 }
 
+// WriteAt writes the data. Large data is split into blocks.
+// If write-behind is enabled, the data is buffered and errors are returned by the following WriteAt, Flush or Close.
+// Otherwise, it returns the number of bytes written by the provider.
 func (f *fileHandle) WriteAt(b []byte, offset int64) (int, error) {
-	f.seqReadCount = 0
-	f.readBuffer = nil
+	f.lock.Lock()
+	closed := f.closed
+	f.lock.Unlock()
+	if closed {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: os.ErrClosed}
+	}
+	f.reader.invalidateRange(offset, len(b))
 	v := f.volume
-	var len int
+	if f.writer != nil {
+		return f.writer.WriteAt(b, offset)
+	}
+	defer v.statCache.delete(f.path)
 
-	_, err := v.requestRaw(ReqData{"op": "write", "path": f.path, "p": offset}, b)
+	written := 0
+	for written < len(b) {
+		block := b[written:]
+		if max := v.blockSize(); len(block) > max {
+			block = block[:max]
+		}
+		n, err := f.writeBlock(offset+int64(written), block)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < len(block) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (f *fileHandle) writeBlock(offset int64, data []byte) (int, error) {
+	msg, err := f.requestRaw(context.Background(), ReqData{"op": "write", "p": offset}, data)
 	if err != nil {
 		return 0, err
 	}
-	v.statCache.delete(f.path)
-	return len, nil
+	var n int
+	if err := json.Unmarshal(msg.data, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// sendBlock sends the write request without waiting for the response, so that the requests are sent in order.
+func (f *fileHandle) sendBlock(offset int64, data []byte) func() (int, error) {
+	wait := f.startBlock(offset, data)
+	return func() (int, error) {
+		n, err := wait()
+		// The cached size is invalidated after the block is written.
+		f.volume.statCache.delete(f.path)
+		return n, err
+	}
+}
+
+func (f *fileHandle) startBlock(offset int64, data []byte) func() (int, error) {
+	f.lock.Lock()
+	h, c, closed := f.h, f.conn, f.closed
+	f.lock.Unlock()
+	if closed || c == nil {
+		return func() (int, error) { return f.writeBlock(offset, data) }
+	}
+	wait, err := f.volume.startRequest(context.Background(), c, ReqData{"op": "write", "p": offset, "h": h}, data)
+	if err != nil {
+		return func() (int, error) { return f.writeBlock(offset, data) }
+	}
+	return func() (int, error) {
+		msg, err := wait()
+		if err == errConnClosed {
+			return f.writeBlock(offset, data) // the file is opened again.
+		} else if err != nil {
+			return 0, pathError("write", f.path, err)
+		}
+		var n int
+		if err := json.Unmarshal(msg.data, &n); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+}
+
+// Flush sends the buffered data and waits for the responses.
+func (f *fileHandle) Flush() error {
+	if f.writer == nil {
+		return nil
+	}
+	return f.writer.Flush()
+}
+
+// Close flushes the data and closes the handle in the provider.
+func (f *fileHandle) Close() error {
+	ferr := f.Flush()
+	f.lock.Lock()
+	h, c, closed := f.h, f.conn, f.closed
+	f.closed = true
+	f.lock.Unlock()
+	if closed {
+		return &os.PathError{Op: "close", Path: f.path, Err: os.ErrClosed}
+	}
+	f.reader.close()
+	if ferr != nil {
+		return ferr
+	}
+	if c == nil {
+		return nil
+	}
+	_, err := f.volume.requestConn(context.Background(), c, ReqData{"op": "close", "h": h}, nil)
+	if err == nil || err == errConnClosed {
+		return nil // handles are closed by the provider at the end of the session.
+	}
+	return pathError("close", f.path, err)
 }
 
 type fileReadWriter struct {
@@ -447,40 +1085,228 @@ func (f *fileReadWriter) Seek(offset int64, whence int) (int64, error) {
 	return f.pos, nil
 }
 
-func (*fileReadWriter) Close() error {
-	return nil
+func (v *WebsocketVolume) Open(path string) (volume.FileReadCloser, error) {
+	return v.OpenContext(context.Background(), path)
 }
 
-func (v *WebsocketVolume) Open(path string) (volume.FileReadCloser, error) {
-	return &fileReadWriter{&fileHandle{volume: v, path: path}, 0}, nil
+func (v *WebsocketVolume) OpenContext(ctx context.Context, path string) (volume.FileReadCloser, error) {
+	return v.OpenFileContext(ctx, path, os.O_RDONLY, 0)
 }
 
 func (v *WebsocketVolume) Create(path string) (volume.FileWriteCloser, error) {
-	v.statCache.delete(path)
-	return &fileReadWriter{&fileHandle{volume: v, path: path}, 0}, nil
+	return v.OpenFileContext(context.Background(), path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
 func (v *WebsocketVolume) OpenFile(path string, flag int, perm os.FileMode) (volume.File, error) {
-	return &fileReadWriter{&fileHandle{volume: v, path: path}, 0}, nil
+	return v.OpenFileContext(context.Background(), path, flag, perm)
+}
+
+// OpenFileContext opens the file in the provider. O_APPEND, O_CREATE, O_EXCL and O_TRUNC are handled by the provider.
+func (v *WebsocketVolume) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (volume.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		v.statCache.delete(path)
+	}
+	f := &fileHandle{volume: v, path: path, flag: flag, perm: perm}
+	readAhead := v.ReadAhead
+	if readAhead == 0 {
+		readAhead = DefaultReadAhead
+	} else if readAhead < 0 {
+		readAhead = 0
+	}
+	f.reader = newBlockReader(f.readBlock, v.blockSize, readAhead)
+	if !v.supports(CapHandles) {
+		// Each request opens the file in the provider. The flags are ignored.
+		return &fileReadWriter{f, 0}, nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.open(ctx, flag); err != nil {
+		f.reader.close()
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && v.WriteBehind > 0 {
+		f.writer = newBlockWriter(f.sendBlock, v.blockSize, v.WriteBehind)
+	}
+	return &fileReadWriter{f, 0}, nil
 }
 
 func (v *WebsocketVolume) Remove(path string) error {
+	return v.RemoveContext(context.Background(), path)
+}
+
+func (v *WebsocketVolume) RemoveContext(ctx context.Context, path string) error {
+	v.statCache.delete(path)
+	return v.request(ctx, map[string]interface{}{"op": "remove", "path": path}, nil)
+}
+
+func (v *WebsocketVolume) Rename(oldpath, newpath string) error {
+	if !v.supports(CapRename) {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: volume.UnsupportedError}
+	}
+	v.statCache.delete(oldpath)
+	v.statCache.delete(newpath)
+	return v.request(context.Background(), map[string]interface{}{"op": "rename", "path": oldpath, "newpath": newpath}, nil)
+}
+
+// Lstat returns the FileInfo without following the symlink. It is same as Stat if the provider doesn't support symlinks.
+func (v *WebsocketVolume) Lstat(path string) (*volume.FileInfo, error) {
+	if !v.supports(CapSymlink) {
+		return v.Stat(path)
+	}
+	var stat volume.FileInfo
+	err := v.request(context.Background(), map[string]interface{}{"op": "lstat", "path": path}, &stat)
+	if err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+func (v *WebsocketVolume) Readlink(path string) (string, error) {
+	if !v.supports(CapSymlink) {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: volume.UnsupportedError}
+	}
+	var target string
+	err := v.request(context.Background(), map[string]interface{}{"op": "readlink", "path": path}, &target)
+	return target, err
+}
+
+func (v *WebsocketVolume) Symlink(oldname, newname string) error {
+	if !v.supports(CapSymlink) {
+		return &os.PathError{Op: "symlink", Path: newname, Err: volume.UnsupportedError}
+	}
+	v.statCache.delete(newname)
+	return v.request(context.Background(), map[string]interface{}{"op": "symlink", "path": newname, "target": oldname}, nil)
+}
+
+func (v *WebsocketVolume) Chmod(path string, mode os.FileMode) error {
+	v.statCache.delete(path)
+	return v.request(context.Background(), map[string]interface{}{"op": "chmod", "path": path, "mode": mode}, nil)
+}
+
+func (v *WebsocketVolume) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	v.statCache.delete(path)
+	return v.request(context.Background(), map[string]interface{}{"op": "chtimes", "path": path, "atime": atime, "mtime": mtime}, nil)
+}
+
+func (v *WebsocketVolume) Truncate(path string, size int64) error {
 	v.statCache.delete(path)
-	return v.request(map[string]interface{}{"op": "remove", "path": path}, nil)
+	return v.request(context.Background(), map[string]interface{}{"op": "truncate", "path": path, "size": size}, nil)
 }
 
 func (v *WebsocketVolume) ReadDir(fpath string) ([]*volume.FileInfo, error) {
+	return v.ReadDirContext(context.Background(), fpath)
+}
+
+func (v *WebsocketVolume) ReadDirContext(ctx context.Context, fpath string) ([]*volume.FileInfo, error) {
 	files := []*volume.FileInfo{}
-	err := v.request(map[string]interface{}{"op": "files", "path": fpath}, &files)
+	err := v.request(ctx, map[string]interface{}{"op": "files", "path": fpath}, &files)
 	if err != nil {
 		return nil, err
 	}
 	for _, f := range files {
-		v.statCache.set(path.Join(fpath, f.Path), f)
+		if f.Mode()&os.ModeSymlink == 0 { // Stat follows symlinks.
+			v.statCache.set(path.Join(fpath, f.Path), f)
+		}
 	}
 	return files, nil
 }
 
 func (v *WebsocketVolume) Mkdir(path string, mode os.FileMode) error {
-	return v.request(map[string]interface{}{"op": "mkdir", "path": path}, nil)
+	return v.MkdirContext(context.Background(), path, mode)
+}
+
+func (v *WebsocketVolume) MkdirContext(ctx context.Context, path string, mode os.FileMode) error {
+	return v.request(ctx, map[string]interface{}{"op": "mkdir", "path": path, "mode": mode}, nil)
+}
+
+type wsFileEvent struct {
+	Type volume.EventType `json:"type"`
+	Path string           `json:"path"`
+	Stat *volume.FileInfo `json:"stat,omitempty"`
+}
+
+type wsWatcher struct {
+	v        *WebsocketVolume
+	callback func(volume.FileEvent)
+}
+
+func (w *wsWatcher) Close() error {
+	v := w.v
+	v.lock.Lock()
+	delete(v.watchers, w)
+	var c *wsVolumeConn
+	if len(v.watchers) == 0 {
+		c = v.watchConn
+		v.watchConn = nil
+	}
+	v.lock.Unlock()
+	if c != nil {
+		return v.sendTo(context.Background(), c, ReqData{"op": "unwatch"})
+	}
+	return nil
+}
+
+// Watch implements volume.VolumeWatcher. Cached stats are invalidated by the events.
+func (v *WebsocketVolume) Watch(callback func(volume.FileEvent)) (io.Closer, error) {
+	if !v.Available() {
+		return nil, errConnClosed
+	}
+	if !v.supports(CapWatch) {
+		return nil, volume.UnsupportedError
+	}
+	w := &wsWatcher{v: v, callback: callback}
+	v.lock.Lock()
+	v.watchers[w] = struct{}{}
+	v.lock.Unlock()
+	if err := v.subscribe(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// subscribe requests events through one of the connections if there are watchers.
+func (v *WebsocketVolume) subscribe() error {
+	v.watchLock.Lock()
+	defer v.watchLock.Unlock()
+	v.lock.Lock()
+	if len(v.watchers) == 0 || v.watchConn != nil || len(v.conns) == 0 || !v.peer.Has(CapWatch) {
+		v.lock.Unlock()
+		return nil
+	}
+	c := v.conns[0]
+	v.watchConn = c
+	v.lock.Unlock()
+
+	if err := v.sendTo(context.Background(), c, ReqData{"op": "watch"}); err != nil {
+		v.lock.Lock()
+		if v.watchConn == c {
+			v.watchConn = nil
+		}
+		v.lock.Unlock()
+		return pathError("watch", "", err)
+	}
+	// Events may be lost while no connection is subscribed.
+	v.statCache.clear()
+	return nil
+}
+
+func (v *WebsocketVolume) handleNotify(data []byte) {
+	var ev wsFileEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return
+	}
+	v.statCache.invalidate(ev.Path)
+	v.lock.Lock()
+	watchers := make([]*wsWatcher, 0, len(v.watchers))
+	for w := range v.watchers {
+		watchers = append(watchers, w)
+	}
+	v.lock.Unlock()
+	for _, w := range watchers {
+		w.callback(volume.FileEvent{Type: ev.Type, Path: ev.Path, OptionalFileInfo: ev.Stat})
+	}
 }
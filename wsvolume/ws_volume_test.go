@@ -1,14 +1,22 @@
 package wsvolume
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
 	"github.com/binzume/cfs/volume"
 )
 
@@ -175,9 +183,635 @@ func TestWsVolume_Connect2(t *testing.T) {
 	if err != nil {
 		t.Errorf("error: %v", err)
 	}
-	err = vol.Remove("created.txt")
+	err = vol.Truncate("created.txt", 2)
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+	err = vol.Chmod("created.txt", 0600)
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = vol.Chtimes("created.txt", mtime, mtime)
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+	stat, err = vol.Stat("created.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if stat.Size() != 2 || stat.Mode().Perm() != 0600 || !stat.ModTime().Equal(mtime) {
+		t.Errorf("unexpected stat: %v", stat)
+	}
+	err = vol.Rename("created.txt", "renamed.txt")
 	if err != nil {
 		t.Errorf("error: %v", err)
 	}
+	_, err = vol.Stat("created.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("invalid error: %v", err)
+	}
+	err = vol.Remove("renamed.txt")
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+
+}
+
+func connectTestVolume(t *testing.T, fs volume.FS) (*WebsocketVolume, func()) {
+	return connectTestProvider(t, NewWebsocketVolumeProvider(fs))
+}
+
+func connectTestProvider(t *testing.T, provider *WebsocketVolumeProvider) (*WebsocketVolume, func()) {
+	vol := NewWebsocketVolume("hoge")
+
+	connected := make(chan struct{})
+	once := sync.Once{}
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider.HandleRequest(w, r, nil)
+		once.Do(func() { close(connected) })
+	})
+	testServer := httptest.NewServer(testHandler)
+
+	wsurl := "ws" + strings.TrimPrefix(testServer.URL, "http")
+	_, err := vol.StartClientWithDefaultConnector(wsurl)
+	if err != nil {
+		testServer.Close()
+		t.Fatalf("Start error: %v", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout")
+	}
+	return vol, func() {
+		vol.Terminate()
+		testServer.Close()
+	}
+}
+
+type slowVolume struct {
+	volume.FS
+	delay time.Duration
+}
+
+func (v *slowVolume) Stat(path string) (*volume.FileInfo, error) {
+	time.Sleep(v.delay)
+	return v.FS.Stat(path)
+}
+
+func (v *slowVolume) Mkdir(path string, perm os.FileMode) error {
+	time.Sleep(v.delay)
+	return v.FS.Mkdir(path, perm)
+}
+
+func TestWsVolume_Context(t *testing.T) {
+	vol, closer := connectTestVolume(t, &slowVolume{volume.NewLocalVolume("../volume/testdata"), 300 * time.Millisecond})
+	defer closer()
+	var _ volume.ContextVolume = vol
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := vol.StatContext(ctx, "test.txt")
+	if err != context.Canceled {
+		t.Errorf("StatContext should return context.Canceled: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = vol.StatContext(ctx, "test.txt")
+	if err != context.DeadlineExceeded {
+		t.Errorf("StatContext should return context.DeadlineExceeded: %v", err)
+	}
+
+	stat, err := vol.StatContext(context.Background(), "test.txt")
+	if err != nil {
+		t.Errorf("StatContext error: %v", err)
+	} else if stat.Size() == 0 {
+		t.Errorf("size error: %v", stat.Size())
+	}
+}
+
+// testProviderServer serves the volume and keeps the server-side connections, so that tests can drop them.
+type testProviderServer struct {
+	*httptest.Server
+	lock  sync.Mutex
+	conns []*websocket.Conn
+}
+
+func newTestProviderServer(fs volume.FS) *testProviderServer {
+	provider := NewWebsocketVolumeProvider(fs)
+	s := &testProviderServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns = append(s.conns, conn)
+		s.lock.Unlock()
+		go provider.HandleSession(conn, "file")
+	}))
+	return s
+}
+
+func (s *testProviderServer) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testProviderServer) connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+func waitState(t *testing.T, ch <-chan ConnState, state ConnState) {
+	t.Helper()
+	for {
+		select {
+		case s := <-ch:
+			if s == state {
+				return
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout: %v", state)
+		}
+	}
+}
+
+func TestWsVolume_Reconnect(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	ReconnectMinInterval = 10 * time.Millisecond
+
+	server := newTestProviderServer(volume.NewLocalVolume("../volume/testdata"))
+	defer server.Close()
+
+	states := make(chan ConnState, 100)
+	vol := NewWebsocketVolume("hoge")
+	vol.PoolSize = 3
+	vol.OnStateChange = func(state ConnState) { states <- state }
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, states, StateConnected)
+	for i := 0; server.connections() < 3; i++ {
+		if i > 100 {
+			t.Fatalf("pool is not filled: %v", server.connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.dropConnections()
+	waitState(t, states, StateConnecting)
+	waitState(t, states, StateConnected)
+	if !vol.Available() {
+		t.Errorf("volume should be available")
+	}
+	if _, err := vol.Stat("test.txt"); err != nil {
+		t.Errorf("Stat error after reconnection: %v", err)
+	}
+
+	vol.Terminate()
+	waitState(t, states, StateClosed)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("done should be closed")
+	}
+	if vol.Available() {
+		t.Errorf("volume should not be available")
+	}
+}
+
+func TestWsVolume_ReconnectWait(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	defer func(d time.Duration) { ReconnectWait = d }(ReconnectWait)
+	ReconnectMinInterval = 10 * time.Millisecond
+	ReconnectWait = 100 * time.Millisecond
+
+	server := newTestProviderServer(volume.NewLocalVolume("../volume/testdata"))
+	states := make(chan ConnState, 100)
+	vol := NewWebsocketVolume("hoge")
+	vol.OnStateChange = func(state ConnState) { states <- state }
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vol.Terminate()
+		<-done
+	}()
+	waitState(t, states, StateConnected)
+
+	server.Close()
+	server.dropConnections()
+	waitState(t, states, StateConnecting)
+	if !vol.Available() {
+		t.Errorf("volume should be available while reconnecting")
+	}
+	start := time.Now()
+	if _, err := vol.Stat("test.txt"); err == nil {
+		t.Errorf("Stat should fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request should fail without a live connection: %v", d)
+	}
+}
+
+func TestWsVolume_Replay(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	ReconnectMinInterval = 10 * time.Millisecond
+
+	server := newTestProviderServer(&slowVolume{volume.NewLocalVolume("../volume/testdata"), 200 * time.Millisecond})
+	defer server.Close()
+	vol := NewWebsocketVolume("hoge")
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vol.Terminate()
+		<-done
+	}()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.dropConnections()
+	}()
+	stat, err := vol.Stat("test.txt")
+	if err != nil {
+		t.Fatalf("request in flight should be replayed: %v", err)
+	}
+	if stat.Size() == 0 {
+		t.Errorf("size error: %v", stat.Size())
+	}
+}
+
+func TestWsVolume_NoReplay(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	ReconnectMinInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	server := newTestProviderServer(&slowVolume{volume.NewLocalVolume(dir), 200 * time.Millisecond})
+	defer server.Close()
+	vol := NewWebsocketVolume("hoge")
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vol.Terminate()
+		<-done
+	}()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.dropConnections()
+	}()
+	err = vol.Mkdir("dir", 0755)
+	if err == nil || os.IsExist(err) {
+		t.Errorf("Mkdir should fail with the connection error: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := os.Stat(path.Join(dir, "dir")); err != nil {
+		t.Errorf("dir should be created by the first request: %v", err)
+	}
+}
+
+func TestWsVolume_Watch(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"dir/a.txt": []byte("Hello")})
+	vol, closer := connectTestVolume(t, mem)
+	defer closer()
+	var _ volume.VolumeWatcher = vol
+
+	stat, err := vol.Stat("dir/a.txt")
+	if err != nil || stat.Size() != 5 {
+		t.Fatalf("unexpected stat: %v %v", stat, err)
+	}
+
+	events := make(chan volume.FileEvent, 10)
+	w, err := vol.Watch(func(ev volume.FileEvent) { events <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent := func(typ volume.EventType, path string) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.Path != path {
+				t.Errorf("unexpected event: %v", ev)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	if err := mem.Truncate("dir/a.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(volume.UpdateEvent, "dir/a.txt")
+	stat, err = vol.Stat("dir/a.txt")
+	if err != nil || stat.Size() != 2 {
+		t.Errorf("stat cache should be invalidated: %v %v", stat, err)
+	}
 
+	if err := mem.Remove("dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(volume.RemoveEvent, "dir/a.txt")
+	if _, err := vol.Stat("dir/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("removed file should not exist: %v", err)
+	}
+
+	w.Close()
+	mem.Mkdir("dir2", 0755)
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event after Close: %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWsVolume_Handle(t *testing.T) {
+	dir := t.TempDir()
+	vol, closer := connectTestVolume(t, volume.NewLocalVolume(dir))
+	defer closer()
+
+	if _, err := vol.Open("notfound.txt"); !os.IsNotExist(err) {
+		t.Errorf("Open should fail: %v", err)
+	}
+
+	f, err := vol.OpenFile("test.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("Hello, world")); err != nil {
+		t.Errorf("Write error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close error: %v", err)
+	}
+	if _, err := f.Write([]byte("Hello")); err == nil {
+		t.Errorf("Write after Close should fail")
+	}
+	if _, err := vol.OpenFile("test.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		t.Errorf("O_EXCL should fail")
+	}
+
+	writeFile := func(flag int, data string) {
+		t.Helper()
+		f, err := vol.OpenFile("test.txt", flag, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if n, err := f.Write([]byte(data)); err != nil || n != len(data) {
+			t.Errorf("Write error: %v %v", n, err)
+		}
+	}
+	writeFile(os.O_WRONLY|os.O_TRUNC, "Hi")
+	writeFile(os.O_WRONLY|os.O_APPEND, " there")
+	if b, _ := os.ReadFile(path.Join(dir, "test.txt")); string(b) != "Hi there" {
+		t.Errorf("unexpected content: %q", string(b))
+	}
+
+	// The handle keeps the file open.
+	r, err := vol.Open("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := os.Rename(path.Join(dir, "test.txt"), path.Join(dir, "renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil || string(b) != "Hi there" {
+		t.Errorf("unexpected content: %q %v", string(b), err)
+	}
+}
+
+func TestWsVolume_HandleReopen(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	ReconnectMinInterval = 10 * time.Millisecond
+
+	server := newTestProviderServer(volume.NewLocalVolume("../volume/testdata"))
+	defer server.Close()
+	vol := NewWebsocketVolume("hoge")
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vol.Terminate()
+		<-done
+	}()
+
+	f, err := vol.Open("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	server.dropConnections()
+
+	buf := make([]byte, 4)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("file should be opened again: %v", err)
+	}
+}
+
+func TestWsVolume_AppendNotReplayed(t *testing.T) {
+	defer func(d time.Duration) { ReconnectMinInterval = d }(ReconnectMinInterval)
+	ReconnectMinInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	server := newTestProviderServer(volume.NewLocalVolume(dir))
+	defer server.Close()
+	vol := NewWebsocketVolume("hoge")
+	done, err := vol.StartClientWithDefaultConnector("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vol.Terminate()
+		<-done
+	}()
+
+	f, err := vol.OpenFile("log.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	server.dropConnections()
+
+	if _, err := f.WriteAt([]byte("b"), 0); err == nil {
+		t.Errorf("append should not be replayed")
+	}
+	if _, err := f.WriteAt([]byte("c"), 0); err != nil {
+		t.Errorf("file should be opened again: %v", err)
+	}
+	if b, _ := os.ReadFile(path.Join(dir, "log.txt")); string(b) != "ac" {
+		t.Errorf("unexpected content: %q", b)
+	}
+}
+
+type noSpaceVolume struct {
+	volume.FS
+}
+
+type noSpaceFile struct {
+	volume.File
+}
+
+func (v *noSpaceVolume) OpenFile(path string, flag int, perm os.FileMode) (volume.File, error) {
+	f, err := v.FS.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &noSpaceFile{f}, nil
+}
+
+func (f *noSpaceFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+func TestWsVolume_WriteBehind(t *testing.T) {
+	dir := t.TempDir()
+	vol, closer := connectTestVolume(t, volume.NewLocalVolume(dir))
+	defer closer()
+	vol.WriteBehind = DefaultWriteBehind
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 200*1024)
+	w, err := vol.Create("large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 4096 {
+		if n, err := w.Write(data[i : i+4096]); n != 4096 || err != nil {
+			t.Fatalf("Write error: %v %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path.Join(dir, "large.bin")); !bytes.Equal(b, data) {
+		t.Errorf("unexpected content: %v", len(b))
+	}
+
+	// Buffered data can be read.
+	f, err := vol.OpenFile("large.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	f.ReadAt(buf, 0)
+	f.WriteAt([]byte("Hello"), 0)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "Hello" {
+		t.Errorf("unexpected content: %q %v", string(buf), err)
+	}
+
+	// Stat before the flush doesn't keep the old size.
+	s, err := vol.OpenFile("small.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.WriteAt([]byte("Hello"), 0)
+	vol.Stat("small.txt")
+	if err := s.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := vol.Stat("small.txt"); err != nil || stat.Size() != 5 {
+		t.Errorf("unexpected stat: %v %v", stat, err)
+	}
+}
+
+func TestWsVolume_WriteBehindError(t *testing.T) {
+	vol, closer := connectTestVolume(t, &noSpaceVolume{volume.NewLocalVolume(t.TempDir())})
+	defer closer()
+	vol.WriteBehind = DefaultWriteBehind
+
+	f, err := vol.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("Hello")); err != nil {
+		t.Errorf("data should be buffered: %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Close should return the error: %v", err)
+	}
+
+	vol.WriteBehind = 0
+	f, err = vol.Create("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.Write([]byte("Hello")); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Write should return the error: %v %v", n, err)
+	}
+}
+
+func TestWsVolume_Symlink(t *testing.T) {
+	mem := volume.NewOnMemoryVolume(map[string][]byte{"dir/a.txt": []byte("Hello")})
+	vol, closer := connectTestVolume(t, mem)
+	defer closer()
+	var _ volume.VolumeLinker = vol
+
+	if !vol.Peer().Has(CapSymlink) {
+		t.Fatalf("symlink should be supported: %v", vol.Peer().Capabilities)
+	}
+	if err := vol.Symlink("dir/a.txt", "link.txt"); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	if err := vol.Symlink("dir", "link.txt"); !os.IsExist(err) {
+		t.Errorf("Symlink should return ErrExist: %v", err)
+	}
+	files, err := vol.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() == "link.txt" && f.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("ReadDir should not follow symlinks: %v", f.Mode())
+		}
+	}
+	if stat, err := vol.Stat("link.txt"); err != nil || stat.Size() != 5 || stat.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("Stat should follow the symlink: %v %v", stat, err)
+	}
+	if stat, err := vol.Lstat("link.txt"); err != nil || stat.Mode()&os.ModeSymlink == 0 || stat.Path != "link.txt" {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if target, err := vol.Readlink("link.txt"); err != nil || target != "dir/a.txt" {
+		t.Errorf("Readlink: %q %v", target, err)
+	}
+	if _, err := vol.Readlink("dir/a.txt"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Readlink of a regular file should return ErrInvalid: %v", err)
+	}
+
+	// The volume doesn't implement VolumeLinker.
+	vol2, closer2 := connectTestVolume(t, struct{ volume.FS }{mem})
+	defer closer2()
+	if vol2.Peer().Has(CapSymlink) {
+		t.Errorf("symlink should not be supported")
+	}
+	if _, err := vol2.Readlink("link.txt"); !errors.Is(err, volume.UnsupportedError) {
+		t.Errorf("Readlink should be unsupported: %v", err)
+	}
+	if err := vol2.Symlink("dir", "link2"); !errors.Is(err, volume.UnsupportedError) {
+		t.Errorf("Symlink should be unsupported: %v", err)
+	}
+	if stat, err := vol2.Lstat("link.txt"); err != nil || stat.Size() != 5 {
+		t.Errorf("Lstat should be same as Stat: %v %v", stat, err)
+	}
 }
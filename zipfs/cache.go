@@ -0,0 +1,55 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/binzume/cfs/internal/arcache"
+)
+
+// Limits of the parsed index cache. Archives with more entries than CacheMaxEntries are not cached.
+// Unused archives are closed after CacheIdleTimeout, so that the files can be removed or renamed. (0: never)
+var (
+	CacheMaxArchives = 16
+	CacheMaxEntries  = 200000
+	CacheIdleTimeout = 30 * time.Second
+)
+
+var archiveCache = arcache.New()
+
+// Purge closes and removes all unused archives from the cache.
+func Purge() {
+	archiveCache.Purge()
+}
+
+func loadArchive(fsys fs.FS, path string, stat fs.FileInfo, charset string) (*arcache.Archive, error) {
+	var fr fs.File
+	var err error
+	if fsys != nil {
+		fr, err = fsys.Open(path)
+	} else {
+		fr, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readerAt, ok := fr.(io.ReaderAt)
+	if !ok {
+		fr.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("ReaderAt not implemented")}
+	}
+
+	r, err := zip.NewReader(readerAt, stat.Size())
+	if err != nil {
+		fr.Close()
+		return nil, err
+	}
+	idx := newZipIndex(r, stat.ModTime(), charset)
+	idx.reader = readerAt
+	return &arcache.Archive{Index: idx, Entries: len(idx.entries), Closer: fr}, nil
+}
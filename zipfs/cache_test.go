@@ -0,0 +1,116 @@
+package zipfs
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type countingFS struct {
+	fs.FS
+	opened int
+}
+
+func (f *countingFS) Open(name string) (fs.File, error) {
+	f.opened++
+	return f.FS.Open(name)
+}
+
+func (f *countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(f.FS, name)
+}
+
+func TestZipFS_Cache(t *testing.T) {
+	path := createTestZip(t, []testZipEntry{{"a/b.txt", "Hello"}})
+	fsys := &countingFS{FS: os.DirFS(filepath.Dir(path))}
+	vol := NewFS("test.zip", fsys)
+	defer Purge()
+
+	r, err := vol.Open("a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := vol.Stat("a/b.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadDir(vol, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fsys.opened != 1 {
+		t.Errorf("archive opened %d times", fsys.opened)
+	}
+
+	// open files are still readable after the cache is purged.
+	Purge()
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "Hello" {
+		t.Errorf("unexpected data: %q %v", b, err)
+	}
+	r.Close()
+
+	// modified archive is reloaded.
+	os.Remove(path)
+	os.Rename(createTestZip(t, []testZipEntry{{"a/c.txt", "World!"}}), path)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	if _, err := vol.Stat("a/b.txt"); err == nil {
+		t.Errorf("a/b.txt should be removed")
+	}
+	b, err = fs.ReadFile(vol, "a/c.txt")
+	if err != nil || string(b) != "World!" {
+		t.Errorf("unexpected data: %q %v", b, err)
+	}
+}
+
+func TestZipFS_CacheLimit(t *testing.T) {
+	saved := CacheMaxEntries
+	CacheMaxEntries = 2
+	defer func() { CacheMaxEntries = saved }()
+
+	path := createTestZip(t, []testZipEntry{{"a/b.txt", "Hello"}, {"c.txt", "World"}})
+	fsys := &countingFS{FS: os.DirFS(filepath.Dir(path))}
+	vol := NewFS("test.zip", fsys)
+
+	for i := 0; i < 2; i++ {
+		b, err := fs.ReadFile(vol, "a/b.txt")
+		if err != nil || string(b) != "Hello" {
+			t.Errorf("unexpected data: %q %v", b, err)
+		}
+	}
+	if fsys.opened != 2 {
+		t.Errorf("large archive should not be cached: opened %d times", fsys.opened)
+	}
+	if archiveCache.Entries() > CacheMaxEntries {
+		t.Errorf("too many entries: %d", archiveCache.Entries())
+	}
+}
+
+func TestZipFS_CacheIdle(t *testing.T) {
+	saved := CacheIdleTimeout
+	CacheIdleTimeout = 50 * time.Millisecond
+	defer func() { CacheIdleTimeout = saved }()
+	defer Purge()
+
+	path := createTestZip(t, []testZipEntry{{"a/b.txt", "Hello"}})
+	// os.DirFS is not a pointer but comparable.
+	vol := NewFS("test.zip", os.DirFS(filepath.Dir(path)))
+
+	if _, err := vol.Stat("a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if archiveCache.Entries() == 0 {
+		t.Errorf("archive should be cached")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := archiveCache.Entries(); n != 0 {
+		t.Errorf("idle archive should be closed: %d entries", n)
+	}
+	if _, err := vol.Stat("a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
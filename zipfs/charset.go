@@ -0,0 +1,124 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// Charsets of entry names which are not encoded in UTF-8.
+const (
+	CharsetShiftJIS = "shift_jis"
+	CharsetCP437    = "cp437"
+	CharsetEUCKR    = "euc-kr"
+	CharsetGBK      = "gbk"
+	// CharsetAuto guesses the charset from the names in the archive.
+	CharsetAuto = "auto"
+)
+
+var charsets = map[string]encoding.Encoding{
+	CharsetShiftJIS: japanese.ShiftJIS,
+	CharsetCP437:    charmap.CodePage437,
+	CharsetEUCKR:    korean.EUCKR,
+	CharsetGBK:      simplifiedchinese.GBK,
+}
+
+// Option configures ZipFS.
+type Option func(*ZipFS)
+
+// WithCharset sets the charset of entry names without the UTF-8 flag.
+// Names which are valid UTF-8 are not decoded. Unknown charsets are ignored.
+func WithCharset(charset string) Option {
+	return func(v *ZipFS) {
+		v.charset = strings.ToLower(charset)
+	}
+}
+
+// nameDecoder returns a function which decodes the entry names of r, or nil if names are used as is.
+func nameDecoder(r *zip.Reader, charset string) func(*zip.File) string {
+	var names []string
+	for _, f := range r.File {
+		if isLegacyName(f) {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	enc := charsets[charset]
+	if charset == CharsetAuto {
+		enc = detectCharset(names)
+	}
+	if enc == nil {
+		return nil
+	}
+	return func(f *zip.File) string {
+		if !isLegacyName(f) {
+			return f.Name
+		}
+		if s, err := enc.NewDecoder().String(f.Name); err == nil {
+			return s
+		}
+		return f.Name
+	}
+}
+
+func isLegacyName(f *zip.File) bool {
+	return f.Flags&0x800 == 0 && !utf8.ValidString(f.Name)
+}
+
+// detectCharset returns the charset which decodes the names to the most plausible text.
+// CP437 is used if no CJK charset can decode all names.
+func detectCharset(names []string) encoding.Encoding {
+	candidates := []struct {
+		enc   encoding.Encoding
+		score func(r rune) int
+	}{
+		{japanese.ShiftJIS, func(r rune) int {
+			if r >= 0x3040 && r <= 0x30ff { // hiragana and katakana (not half-width)
+				return 2
+			} else if unicode.Is(unicode.Han, r) {
+				return 1
+			}
+			return 0
+		}},
+		{korean.EUCKR, func(r rune) int {
+			if unicode.Is(unicode.Hangul, r) {
+				return 2
+			}
+			return 0
+		}},
+		{simplifiedchinese.GBK, func(r rune) int {
+			if unicode.Is(unicode.Han, r) {
+				return 1
+			}
+			return 0
+		}},
+	}
+	var best encoding.Encoding = charmap.CodePage437
+	bestScore := 0
+	for _, c := range candidates {
+		score := 0
+		for _, name := range names {
+			s, err := c.enc.NewDecoder().String(name)
+			if err != nil || strings.ContainsRune(s, utf8.RuneError) {
+				score = -1
+				break
+			}
+			for _, r := range s {
+				score += c.score(r)
+			}
+		}
+		if score > bestScore {
+			best, bestScore = c.enc, score
+		}
+	}
+	return best
+}
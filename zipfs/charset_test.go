@@ -0,0 +1,86 @@
+package zipfs
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+)
+
+func encodeTestNames(t *testing.T, enc encoding.Encoding, entries []testZipEntry) []testZipEntry {
+	t.Helper()
+	var encoded []testZipEntry
+	for _, e := range entries {
+		name, err := enc.NewEncoder().String(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, testZipEntry{name, e.data})
+	}
+	return encoded
+}
+
+func TestZipFS_Charset(t *testing.T) {
+	// "表" is encoded as 0x95 0x5C in Shift_JIS.
+	path := createTestZip(t, encodeTestNames(t, japanese.ShiftJIS, []testZipEntry{
+		{"日本語/表示.txt", "Hello"},
+		{"ascii.txt", "World"},
+	}))
+
+	for _, charset := range []string{CharsetShiftJIS, "Shift_JIS", CharsetAuto} {
+		vol := NewFS(path, nil, WithCharset(charset))
+		stat, err := vol.Stat("日本語/表示.txt")
+		if err != nil {
+			t.Fatalf("%s: %v", charset, err)
+		}
+		if stat.Name() != "表示.txt" {
+			t.Errorf("%s: unexpected name: %v", charset, stat.Name())
+		}
+		files, err := fs.ReadDir(vol, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 || files[0].Name() != "ascii.txt" || files[1].Name() != "日本語" {
+			t.Errorf("%s: unexpected entries: %v", charset, files)
+		}
+		b, err := fs.ReadFile(vol, "日本語/表示.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "Hello" {
+			t.Errorf("%s: unexpected content: %v", charset, string(b))
+		}
+	}
+
+	// Raw names without charset.
+	if _, err := NewFS(path, nil).Stat("日本語/表示.txt"); err == nil {
+		t.Errorf("names should not be decoded")
+	}
+}
+
+func TestZipFS_CharsetAuto(t *testing.T) {
+	path := createTestZip(t, encodeTestNames(t, korean.EUCKR, []testZipEntry{
+		{"한국어.txt", "Hello"},
+	}))
+	vol := NewFS(path, nil, WithCharset(CharsetAuto))
+	f, err := vol.Open("한국어.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Hello" {
+		t.Errorf("unexpected content: %v", string(b))
+	}
+
+	path = createTestZip(t, []testZipEntry{{"caf\x82.txt", "!"}})
+	if _, err := NewFS(path, nil, WithCharset(CharsetAuto)).Stat("café.txt"); err != nil {
+		t.Errorf("CP437 should be used: %v", err)
+	}
+}
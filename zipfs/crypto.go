@@ -0,0 +1,260 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/binzume/cfs/internal/seekable"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// MetadataEncrypted is the key of Sys() map of encrypted entries.
+const MetadataEncrypted = "encrypted"
+
+var (
+	ErrPasswordRequired = errors.New("password required")
+	ErrWrongPassword    = errors.New("wrong password")
+	ErrAuthentication   = errors.New("authentication failed")
+)
+
+// PasswordFunc returns the password of the entry in the archive. ok is false if the password is unknown.
+type PasswordFunc func(archive, name string) (password string, ok bool)
+
+// WithPassword sets the password provider for encrypted entries. (ZipCrypto and WinZip AES)
+func WithPassword(fn PasswordFunc) Option {
+	return func(v *ZipFS) {
+		v.password = fn
+	}
+}
+
+const (
+	methodAES     = 99
+	aesExtraID    = 0x9901
+	aesMACSize    = 10
+	zipCryptoSize = 12 // size of the ZipCrypto header
+)
+
+func isEncrypted(f *zip.File) bool {
+	return f.Flags&0x1 != 0
+}
+
+// aesExtra is the WinZip AES extra field.
+type aesExtra struct {
+	version  uint16 // 1: AE-1, 2: AE-2 (CRC is not stored)
+	strength byte   // 1: AES-128, 2: AES-192, 3: AES-256
+	method   uint16 // actual compression method
+}
+
+func parseAESExtra(extra []byte) (*aesExtra, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == aesExtraID && size >= 7 {
+			e := &aesExtra{version: binary.LittleEndian.Uint16(extra), strength: extra[4], method: binary.LittleEndian.Uint16(extra[5:])}
+			return e, e.strength >= 1 && e.strength <= 3
+		}
+		extra = extra[size:]
+	}
+	return nil, false
+}
+
+// encryptedReader returns a ReaderAt of the decrypted and uncompressed content.
+// checkCRC is false if the entry has no CRC. (AE-2)
+func (idx *zipIndex) encryptedReader(f *zip.File, password string) (r io.ReaderAt, checkCRC bool, err error) {
+	off, err := f.DataOffset()
+	if err != nil {
+		return nil, false, err
+	}
+	csize := int64(f.CompressedSize64)
+	size := int64(f.UncompressedSize64)
+	if f.Method != methodAES {
+		if f.Method != zip.Store && f.Method != zip.Deflate {
+			return nil, false, zip.ErrAlgorithm
+		}
+		if csize < zipCryptoSize {
+			return nil, false, zip.ErrFormat
+		}
+		var hdr [zipCryptoSize]byte
+		if _, err := idx.reader.ReadAt(hdr[:], off); err != nil {
+			return nil, false, err
+		}
+		keys := newZipCryptoKeys(password)
+		keys.decrypt(hdr[:])
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&0x8 != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if hdr[zipCryptoSize-1] != check {
+			return nil, false, ErrWrongPassword
+		}
+		return seekable.NewStreamReader(func() (io.ReadCloser, error) {
+			k := *keys
+			var r io.Reader = &zipCryptoReader{r: io.NewSectionReader(idx.reader, off+zipCryptoSize, csize-zipCryptoSize), keys: &k}
+			if f.Method == zip.Deflate {
+				return flate.NewReader(r), nil
+			}
+			return io.NopCloser(r), nil
+		}, size), true, nil
+	}
+
+	ae, ok := parseAESExtra(f.Extra)
+	if !ok {
+		return nil, false, zip.ErrFormat
+	}
+	if ae.method != zip.Store && ae.method != zip.Deflate {
+		return nil, false, zip.ErrAlgorithm
+	}
+	keyLen := 8 + int(ae.strength)*8
+	saltLen := keyLen / 2
+	dataLen := csize - int64(saltLen) - 2 - aesMACSize
+	if dataLen < 0 {
+		return nil, false, zip.ErrFormat
+	}
+	hdr := make([]byte, saltLen+2)
+	if _, err := idx.reader.ReadAt(hdr, off); err != nil {
+		return nil, false, err
+	}
+	key := pbkdf2.Key([]byte(password), hdr[:saltLen], 1000, keyLen*2+2, sha1.New)
+	if !bytes.Equal(key[keyLen*2:], hdr[saltLen:]) {
+		return nil, false, ErrWrongPassword
+	}
+	block, err := aes.NewCipher(key[:keyLen])
+	if err != nil {
+		return nil, false, err
+	}
+	dataOff := off + int64(saltLen) + 2
+	ctr := &aesCTRReader{src: idx.reader, off: dataOff, size: dataLen, block: block, mac: hmac.New(sha1.New, key[keyLen:keyLen*2])}
+	if ae.method == zip.Store {
+		return ctr, ae.version != 2, nil
+	}
+	return seekable.NewDeflateReader(ctr, 0, dataLen, size), ae.version != 2, nil
+}
+
+// zipCryptoKeys is the state of the traditional PKWARE encryption.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i := range p {
+		t := k[2] | 2
+		p[i] ^= byte((t * (t ^ 1)) >> 8)
+		k.update(p[i])
+	}
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.keys.decrypt(p[:n])
+	return n, err
+}
+
+// aesCTRReader decrypts WinZip AES data at any offset.
+// The authentication code is verified when the data is read sequentially to the end.
+type aesCTRReader struct {
+	src   io.ReaderAt
+	off   int64
+	size  int64
+	block cipher.Block
+
+	lock   sync.Mutex
+	mac    hash.Hash
+	macPos int64
+}
+
+func (r *aesCTRReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+	}
+	n, err := r.src.ReadAt(p, r.off+off)
+	if err == io.EOF && off+int64(n) < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if n > 0 {
+		if verr := r.verify(p[:n], off); verr != nil {
+			return n, verr
+		}
+	}
+	r.xor(p[:n], off)
+	if err == nil && off+int64(n) >= r.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// verify updates the MAC with the encrypted data.
+func (r *aesCTRReader) verify(p []byte, off int64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off > r.macPos || off+int64(len(p)) <= r.macPos {
+		return nil
+	}
+	r.mac.Write(p[r.macPos-off:])
+	r.macPos = off + int64(len(p))
+	if r.macPos < r.size {
+		return nil
+	}
+	var code [aesMACSize]byte
+	if _, err := r.src.ReadAt(code[:], r.off+r.size); err != nil {
+		return err
+	}
+	if !hmac.Equal(r.mac.Sum(nil)[:aesMACSize], code[:]) {
+		return ErrAuthentication
+	}
+	return nil
+}
+
+// xor decrypts p with the key stream. The counter is little-endian and starts at 1.
+func (r *aesCTRReader) xor(p []byte, off int64) {
+	var ctr, ks [aes.BlockSize]byte
+	for len(p) > 0 {
+		blk := off / aes.BlockSize
+		binary.LittleEndian.PutUint64(ctr[:], uint64(blk+1))
+		r.block.Encrypt(ks[:], ctr[:])
+		n := 0
+		for s := int(off % aes.BlockSize); n < len(p) && s+n < aes.BlockSize; n++ {
+			p[n] ^= ks[s+n]
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+}
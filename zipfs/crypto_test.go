@@ -0,0 +1,175 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type testEncryptedEntry struct {
+	name     string
+	data     string
+	method   uint16
+	strength byte // 0: ZipCrypto
+}
+
+func deflateTestData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func createEncryptedZip(t *testing.T, password string, entries []testEncryptedEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "encrypted.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, e := range entries {
+		data := []byte(e.data)
+		payload := data
+		if e.method == zip.Deflate {
+			payload = deflateTestData(t, data)
+		}
+		hdr := &zip.FileHeader{Name: e.name, Flags: 0x1, Method: e.method, CRC32: crc32.ChecksumIEEE(data), UncompressedSize64: uint64(len(data))}
+		var raw []byte
+		if e.strength == 0 {
+			keys := newZipCryptoKeys(password)
+			plain := append([]byte("0123456789a"), byte(hdr.CRC32>>24))
+			plain = append(plain, payload...)
+			for _, b := range plain {
+				k := keys[2] | 2
+				raw = append(raw, b^byte((k*(k^1))>>8))
+				keys.update(b)
+			}
+		} else {
+			keyLen := 8 + int(e.strength)*8
+			salt := bytes.Repeat([]byte{0x5a}, keyLen/2)
+			key := pbkdf2.Key([]byte(password), salt, 1000, keyLen*2+2, sha1.New)
+			block, _ := aes.NewCipher(key[:keyLen])
+			ct := append([]byte{}, payload...)
+			(&aesCTRReader{block: block}).xor(ct, 0)
+			mac := hmac.New(sha1.New, key[keyLen:keyLen*2])
+			mac.Write(ct)
+			raw = append(append(append(salt, key[keyLen*2:]...), ct...), mac.Sum(nil)[:aesMACSize]...)
+			extra := make([]byte, 11)
+			binary.LittleEndian.PutUint16(extra, aesExtraID)
+			binary.LittleEndian.PutUint16(extra[2:], 7)
+			binary.LittleEndian.PutUint16(extra[4:], 2)
+			copy(extra[6:], "AE")
+			extra[8] = e.strength
+			binary.LittleEndian.PutUint16(extra[9:], e.method)
+			hdr.Extra, hdr.Method, hdr.CRC32 = extra, methodAES, 0
+		}
+		hdr.CompressedSize64 = uint64(len(raw))
+		fw, err := w.CreateRaw(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(raw)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZipFS_Encrypted(t *testing.T) {
+	content := strings.Repeat("Hello, encrypted world! ", 1000)
+	path := createEncryptedZip(t, "secret", []testEncryptedEntry{
+		{"zipcrypto-store.txt", content, zip.Store, 0},
+		{"zipcrypto-deflate.txt", content, zip.Deflate, 0},
+		{"aes128-store.txt", content, zip.Store, 1},
+		{"aes192-deflate.txt", content, zip.Deflate, 2},
+		{"aes256-deflate.txt", content, zip.Deflate, 3},
+	})
+	names := []string{"zipcrypto-store.txt", "zipcrypto-deflate.txt", "aes128-store.txt", "aes192-deflate.txt", "aes256-deflate.txt"}
+
+	var requested []string
+	vol := NewFS(path, nil, WithPassword(func(archive, name string) (string, bool) {
+		requested = append(requested, name)
+		return "secret", true
+	}))
+	for _, name := range names {
+		stat, err := vol.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta, _ := stat.Sys().(map[string]interface{}); meta[MetadataEncrypted] != true {
+			t.Errorf("%s: should be encrypted: %v", name, stat.Sys())
+		}
+		b, err := fs.ReadFile(vol, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(b) != content {
+			t.Errorf("%s: unexpected content", name)
+		}
+
+		f, err := vol.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10)
+		if _, err := f.(interface {
+			ReadAt([]byte, int64) (int, error)
+		}).ReadAt(buf, 12345); err != nil {
+			t.Errorf("%s: ReadAt error: %v", name, err)
+		}
+		if string(buf) != content[12345:12355] {
+			t.Errorf("%s: unexpected content: %q", name, string(buf))
+		}
+		f.Close()
+	}
+	if len(requested) != len(names)*2 || requested[0] != names[0] {
+		t.Errorf("unexpected password requests: %v", requested)
+	}
+
+	wrong := NewFS(path, nil, WithPassword(func(archive, name string) (string, bool) { return "wrong", true }))
+	for _, name := range names {
+		if _, err := wrong.Open(name); !errors.Is(err, ErrWrongPassword) {
+			t.Errorf("%s: ErrWrongPassword expected: %v", name, err)
+		}
+	}
+	if _, err := NewFS(path, nil).Open(names[0]); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("ErrPasswordRequired expected: %v", err)
+	}
+}
+
+func TestZipFS_EncryptedAuthentication(t *testing.T) {
+	path := createEncryptedZip(t, "secret", []testEncryptedEntry{{"a.txt", "Hello", zip.Store, 3}})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the first byte of the encrypted data.
+	pos := bytes.Index(b, []byte("a.txt")) + len("a.txt") + 11 + 16 + 2
+	b[pos] ^= 1
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	vol := NewFS(path, nil, WithPassword(func(archive, name string) (string, bool) { return "secret", true }))
+	if _, err := fs.ReadFile(vol, "a.txt"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("ErrAuthentication expected: %v", err)
+	}
+}
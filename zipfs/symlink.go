@@ -0,0 +1,119 @@
+package zipfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// maxSymlinks is the max number of symlinks followed in a path.
+const maxSymlinks = 40
+
+// maxLinkSize is the max size of symlink targets.
+const maxLinkSize = 4096
+
+func (e *zipEntry) isSymlink() bool {
+	return !e.dir && e.file != nil && e.file.Mode()&fs.ModeSymlink != 0
+}
+
+// readLink returns the target of the symlink entry. The target is stored as the content of the entry.
+func (idx *zipIndex) readLink(e *zipEntry) (string, error) {
+	if !e.isSymlink() || isEncrypted(e.file) || e.Size() > maxLinkSize {
+		return "", fs.ErrInvalid
+	}
+	r, err := idx.contentReader(e.file)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, e.Size())
+	if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// lookup returns the entry. Symlinks are followed in the archive. The symlink of the last element is followed if follow is true.
+// Symlinks to absolute paths or paths out of the archive are treated as broken links.
+func (idx *zipIndex) lookup(name string, follow bool) (*zipEntry, bool) {
+	resolved := ""
+	rest := strings.Split(name, "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		p := path.Join(resolved, name)
+		e, ok := idx.entries[p]
+		if !ok {
+			return nil, false
+		}
+		if e.isSymlink() && (len(rest) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return nil, false
+			}
+			target, err := idx.readLink(e)
+			if err != nil || path.IsAbs(target) {
+				return nil, false
+			}
+			target = path.Join(resolved, target)
+			if target == ".." || strings.HasPrefix(target, "../") {
+				return nil, false
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+			resolved = ""
+			continue
+		}
+		resolved = p
+	}
+	e, ok := idx.entries[resolved]
+	return e, ok
+}
+
+func baseName(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Lstat returns the FileInfo of the entry without following the symlink of the last element.
+func (v *ZipFS) Lstat(path string) (fs.FileInfo, error) {
+	name, err := entryPath("lstat", path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return v.Stat(path)
+	}
+	closer, idx, err := v.openZip()
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	if e, ok := idx.lookup(name, false); ok {
+		return &fileEntry{FileInfo: e, rawName: baseName(name)}, nil
+	}
+	return nil, &fs.PathError{Op: "lstat", Path: path, Err: fs.ErrNotExist}
+}
+
+// ReadLink returns the target of the symlink entry.
+func (v *ZipFS) ReadLink(path string) (string, error) {
+	name, err := entryPath("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	closer, idx, err := v.openZip()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	e, ok := idx.lookup(name, false)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: fs.ErrNotExist}
+	}
+	target, err := idx.readLink(e)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	return target, nil
+}
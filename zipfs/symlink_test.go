@@ -0,0 +1,99 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createTestZipLinks creates a zip file which contains files and symlinks. (name -> target)
+func createTestZipLinks(t *testing.T, files, links map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, data := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+	}
+	for name, target := range links {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		h.SetMode(fs.ModeSymlink | 0777)
+		fw, err := w.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(target))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZipFS_Symlink(t *testing.T) {
+	vol := NewFS(createTestZipLinks(t,
+		map[string]string{"dir/a.txt": "Hello", "b.txt": "World"},
+		map[string]string{
+			"link.txt":     "dir/a.txt",
+			"dir/up.txt":   "../b.txt",
+			"dirlink":      "dir",
+			"chain":        "link.txt",
+			"abs":          "/etc/passwd",
+			"escape":       "../../etc/passwd",
+			"broken":       "not_existing",
+			"loop":         "loop",
+			"dir/self.txt": "./a.txt",
+		}), nil).(*ZipFS)
+
+	for name, expected := range map[string]string{
+		"link.txt":      "Hello",
+		"dir/up.txt":    "World",
+		"dirlink/a.txt": "Hello",
+		"chain":         "Hello",
+		"dir/self.txt":  "Hello",
+	} {
+		b, err := fs.ReadFile(vol, name)
+		if err != nil || string(b) != expected {
+			t.Errorf("ReadFile(%q): %q %v, want %q", name, b, err, expected)
+		}
+	}
+	if stat, err := vol.Stat("dirlink"); err != nil || !stat.IsDir() || stat.Name() != "dirlink" {
+		t.Errorf("Stat(dirlink) should be a directory: %v %v", stat, err)
+	}
+	if files, err := fs.ReadDir(vol, "dirlink"); err != nil || len(files) != 3 {
+		t.Errorf("ReadDir(dirlink): %v %v", files, err)
+	}
+	for _, name := range []string{"abs", "escape", "broken", "loop"} {
+		if _, err := vol.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%q) should return ErrNotExist: %v", name, err)
+		}
+		if _, err := vol.Lstat(name); err != nil {
+			t.Errorf("Lstat(%q) error: %v", name, err)
+		}
+	}
+
+	stat, err := vol.Lstat("link.txt")
+	if err != nil || stat.Mode()&fs.ModeSymlink == 0 || stat.Name() != "link.txt" {
+		t.Errorf("Lstat should return the symlink: %v %v", stat, err)
+	}
+	if target, err := vol.ReadLink("abs"); err != nil || target != "/etc/passwd" {
+		t.Errorf("ReadLink: %q %v", target, err)
+	}
+	if target, err := vol.ReadLink("dirlink/up.txt"); err != nil || target != "../b.txt" {
+		t.Errorf("ReadLink: %q %v", target, err)
+	}
+	if _, err := vol.ReadLink("b.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("ReadLink of a regular file should return ErrInvalid: %v", err)
+	}
+}
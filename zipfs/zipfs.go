@@ -2,43 +2,58 @@ package zipfs
 
 import (
 	"archive/zip"
-	"bytes"
 	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/binzume/cfs/internal/arcache"
+	"github.com/binzume/cfs/internal/seekable"
+	"github.com/binzume/cfs/tarfs"
 )
 
 type ZipFS struct {
-	fsys fs.FS
-	path string
+	fsys     fs.FS
+	path     string
+	charset  string
+	password PasswordFunc
 }
 
 // NewFS returns a new FS. (fsys = nil : native path)
-func NewFS(path string, fsys fs.FS) fs.StatFS {
-	return &ZipFS{fsys: fsys, path: path}
+func NewFS(path string, fsys fs.FS, opts ...Option) fs.StatFS {
+	v := &ZipFS{fsys: fsys, path: path}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
 }
 
 type zipFileReader struct {
-	opener       func() (io.ReadCloser, error)
+	reader       io.ReaderAt
 	parentCloser io.Closer
 	size         int64
-	reader       io.ReadCloser
 	readPos      int64
-	byteReader   *bytes.Reader
+	crc          hash.Hash32
+	crcPos       int64
+	crc32        uint32
 	stat         fs.FileInfo
 }
 
 func (zfr *zipFileReader) Read(p []byte) (n int, err error) {
-	if zfr.reader == nil {
-		zfr.reader, err = zfr.opener()
-		if err != nil {
-			return
+	n, err = zfr.ReadAt(p, zfr.readPos)
+	if zfr.crc != nil && zfr.crcPos == zfr.readPos {
+		zfr.crc.Write(p[:n])
+		zfr.crcPos += int64(n)
+		if zfr.crcPos == zfr.size && zfr.crc.Sum32() != zfr.crc32 {
+			return n, zip.ErrChecksum
 		}
 	}
-	n, err = zfr.reader.Read(p)
 	zfr.readPos += int64(n)
 	return
 }
@@ -48,94 +63,247 @@ func (zfr *zipFileReader) Stat() (fs.FileInfo, error) {
 }
 
 func (zfr *zipFileReader) Close() error {
-	if zfr.reader != nil {
-		zfr.reader.Close()
+	if c, ok := zfr.reader.(io.Closer); ok {
+		c.Close()
 	}
 	return zfr.parentCloser.Close()
 }
 
 func (zfr *zipFileReader) ReadAt(p []byte, off int64) (n int, err error) {
-	if zfr.byteReader == nil {
-		if off == zfr.readPos {
-			return zfr.Read(p)
-		}
+	return zfr.reader.ReadAt(p, off)
+}
 
-		// load all
-		// log.Printf("UNZIP READ ALL requested range: %v-%v size:(%v)", off, off+int64(len(p)), len(p))
-		r, err := zfr.opener()
+// contentReader returns a ReaderAt of the uncompressed content.
+// Stored entries are read directly from the archive, and deflated entries are decompressed with checkpoints.
+func (idx *zipIndex) contentReader(f *zip.File) (io.ReaderAt, error) {
+	size := int64(f.UncompressedSize64)
+	if f.Method == zip.Store || f.Method == zip.Deflate {
+		off, err := f.DataOffset()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		defer r.Close()
-		buf, err := ioutil.ReadAll(r)
-		if err != nil {
-			return 0, err
+		if f.Method == zip.Store {
+			return io.NewSectionReader(idx.reader, off, size), nil
+		}
+		return seekable.NewDeflateReader(idx.reader, off, int64(f.CompressedSize64), size), nil
+	}
+	return seekable.NewStreamReader(f.Open, size), nil
+}
+
+// zipDir is an opened directory in the archive.
+type zipDir struct {
+	entry   *zipEntry
+	entries []fs.DirEntry
+}
+
+func (d *zipDir) Stat() (fs.FileInfo, error) {
+	return d.entry, nil
+}
+
+func (d *zipDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.path, Err: errors.New("is a directory")}
+}
+
+func (d *zipDir) Close() error {
+	return nil
+}
+
+func (d *zipDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// zipIndex is a directory tree of the archive.
+type zipIndex struct {
+	entries map[string]*zipEntry
+	modTime time.Time
+	reader  io.ReaderAt
+}
+
+type zipEntry struct {
+	path     string
+	file     *zip.File
+	dir      bool
+	children []*zipEntry
+	modTime  time.Time
+}
+
+func newZipIndex(r *zip.Reader, modTime time.Time, charset string) *zipIndex {
+	idx := &zipIndex{entries: map[string]*zipEntry{}, modTime: modTime}
+	idx.entries[""] = &zipEntry{path: "", dir: true, modTime: modTime}
+	decode := nameDecoder(r, charset)
+	for _, f := range r.File {
+		// Names are decoded before normalization because 0x5C (backslash) can be the second byte of multibyte characters.
+		rawName := f.Name
+		if decode != nil {
+			rawName = decode(f)
+		}
+		name := normalizeName(rawName)
+		if name == "" {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			d := idx.dir(name)
+			d.file = f
+			d.modTime = f.FileInfo().ModTime()
+		} else if _, exists := idx.entries[name]; !exists {
+			e := &zipEntry{path: name, file: f, modTime: f.FileInfo().ModTime()}
+			idx.entries[name] = e
+			parent := idx.dir(parentDir(name))
+			parent.children = append(parent.children, e)
+		}
+	}
+	for _, e := range idx.entries {
+		sort.Slice(e.children, func(i, j int) bool { return e.children[i].path < e.children[j].path })
+	}
+	return idx
+}
+
+// dir returns the directory entry. Missing parent directories are synthesized.
+func (idx *zipIndex) dir(name string) *zipEntry {
+	if e, ok := idx.entries[name]; ok {
+		e.dir = true
+		return e
+	}
+	e := &zipEntry{path: name, dir: true, modTime: idx.modTime}
+	idx.entries[name] = e
+	parent := idx.dir(parentDir(name))
+	parent.children = append(parent.children, e)
+	return e
+}
+
+// CacheKey implements arcache.Keyer, so archives in this archive are cached.
+func (v *ZipFS) CacheKey() (interface{}, bool) {
+	k, ok := arcache.KeyOf(v.fsys)
+	return arcache.Key{FS: k, Path: v.path, Opt: v.charset}, ok
+}
+
+// normalizeName returns the slash-separated path of the entry name without leading "/" or "./".
+// Backslashes in names written by Windows archivers are treated as separators.
+// ".." elements can not go above the root.
+func normalizeName(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimPrefix(name, "/")
+}
+
+func parentDir(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func (e *zipEntry) Name() string {
+	if e.path == "" {
+		return "."
+	}
+	return path.Base(e.path)
+}
+
+func (e *zipEntry) Size() int64 {
+	if e.dir || e.file == nil {
+		return 0
+	}
+	return int64(e.file.UncompressedSize64)
+}
+
+func (e *zipEntry) Mode() fs.FileMode {
+	if e.dir {
+		if e.file != nil && e.file.Mode().IsDir() {
+			return e.file.Mode()
 		}
-		zfr.byteReader = bytes.NewReader(buf)
+		return fs.ModeDir | 0555
+	}
+	return e.file.Mode()
+}
+
+func (e *zipEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *zipEntry) IsDir() bool {
+	return e.dir
+}
+
+// Sys returns the metadata of the entry.
+func (e *zipEntry) Sys() interface{} {
+	if e.file != nil && isEncrypted(e.file) {
+		return map[string]interface{}{MetadataEncrypted: true}
 	}
-	return zfr.byteReader.ReadAt(p, off)
+	return nil
 }
 
 func (v *ZipFS) Available() bool {
 	return true
 }
 
-func (v *ZipFS) openZip() (io.Closer, *zip.Reader, error) {
-	var fr fs.File
-	var err error
-	var stat fs.FileInfo
-
+func (v *ZipFS) statZip() (fs.FileInfo, error) {
 	if v.fsys != nil {
-		stat, err = fs.Stat(v.fsys, v.path)
-	} else {
-		stat, err = os.Stat(v.path)
+		return fs.Stat(v.fsys, v.path)
 	}
+	return os.Stat(v.path)
+}
+
+// openZip returns the index of the archive. The returned closer must be closed after use.
+func (v *ZipFS) openZip() (io.Closer, *zipIndex, error) {
+	stat, err := v.statZip()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if v.fsys != nil {
-		fr, err = v.fsys.Open(v.path)
-	} else {
-		fr, err = os.Open(v.path)
-	}
+	ref, err := archiveCache.Open(v.fsys, v.path, v.charset, stat, CacheMaxArchives, CacheMaxEntries, CacheIdleTimeout, func() (*arcache.Archive, error) {
+		return loadArchive(v.fsys, v.path, stat, v.charset)
+	})
 	if err != nil {
 		return nil, nil, err
 	}
+	return ref, ref.Index.(*zipIndex), nil
+}
 
-	readerAt, ok := fr.(io.ReaderAt)
-	if !ok {
-		return nil, nil, &fs.PathError{Op: "open", Path: v.path, Err: errors.New("ReaderAt not implemented")}
+// entryPath validates the path. "" is also accepted as the root.
+func entryPath(op, path string) (string, error) {
+	if path == "" || path == "." {
+		return "", nil
 	}
-
-	r, err := zip.NewReader(readerAt, stat.Size())
-	if err != nil {
-		fr.Close()
-		return nil, nil, err
+	if !fs.ValidPath(path) {
+		return "", &fs.PathError{Op: op, Path: path, Err: fs.ErrInvalid}
 	}
-	return fr, r, err
+	return path, nil
 }
 
 func (v *ZipFS) Stat(path string) (fs.FileInfo, error) {
+	path, err := entryPath("stat", path)
+	if err != nil {
+		return nil, err
+	}
 	if path == "" {
-		stat, err := fs.Stat(v.fsys, v.path)
+		stat, err := v.statZip()
 		if stat != nil {
 			stat = &modeDirOverride{stat}
 		}
 		return stat, err
 	}
-	closer, r, err := v.openZip()
+	closer, idx, err := v.openZip()
 	if err != nil {
 		return nil, err
 	}
 	defer closer.Close()
-	for _, f := range r.File {
-		if !strings.HasSuffix("/"+f.Name, "/"+path) {
-			continue
-		}
-		return &fileEntry{FileInfo: f.FileInfo(), rawName: f.Name}, nil
+	if e, ok := idx.lookup(path, true); ok {
+		return &fileEntry{FileInfo: e, rawName: baseName(path)}, nil
 	}
-	return nil, fs.ErrNotExist
+	return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
 }
 
 type fileEntry struct {
@@ -163,6 +331,10 @@ func (f *modeDirOverride) IsDir() bool {
 	return true
 }
 
+func (f *modeDirOverride) Mode() fs.FileMode {
+	return f.FileInfo.Mode() | fs.ModeDir
+}
+
 type modeDirOverrideDirEnt struct {
 	fs.DirEntry
 }
@@ -171,6 +343,10 @@ func (f *modeDirOverrideDirEnt) IsDir() bool {
 	return true
 }
 
+func (f *modeDirOverrideDirEnt) Type() fs.FileMode {
+	return fs.ModeDir
+}
+
 func (f *modeDirOverrideDirEnt) Info() (fs.FileInfo, error) {
 	info, err := f.DirEntry.Info()
 	if info != nil {
@@ -180,59 +356,200 @@ func (f *modeDirOverrideDirEnt) Info() (fs.FileInfo, error) {
 }
 
 func (v *ZipFS) ReadDir(path string) ([]fs.DirEntry, error) {
-	closer, r, err := v.openZip()
+	name, err := entryPath("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	closer, idx, err := v.openZip()
 	if err != nil {
 		return nil, err
 	}
 	defer closer.Close()
 
+	e, ok := idx.lookup(name, true)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: fs.ErrNotExist}
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: errors.New("not a directory")}
+	}
+	return e.dirEntries(), nil
+}
+
+func (e *zipEntry) dirEntries() []fs.DirEntry {
 	files := []fs.DirEntry{}
-	for _, f := range r.File {
-		fi := f.FileInfo()
-		if fi.IsDir() {
-			continue
-		}
-		fe := &fileEntry{
-			rawName:  f.Name,
-			FileInfo: fi,
-		}
-		files = append(files, fe)
+	for _, c := range e.children {
+		files = append(files, &fileEntry{rawName: c.Name(), FileInfo: c})
 	}
-	return files, nil
+	return files
 }
 
 func (v *ZipFS) Open(path string) (reader fs.File, err error) {
-	closer, r, err := v.openZip()
+	path, err = entryPath("open", path)
+	if err != nil {
+		return nil, err
+	}
+	closer, idx, err := v.openZip()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, f := range r.File {
-		fi := f.FileInfo()
-		if fi.IsDir() || !strings.HasSuffix("/"+f.Name, "/"+path) {
-			continue
+	e, ok := idx.lookup(path, true)
+	if !ok {
+		closer.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	if e.dir {
+		closer.Close()
+		return &zipDir{entry: e, entries: e.dirEntries()}, nil
+	}
+	var r io.ReaderAt
+	checkCRC := true
+	if isEncrypted(e.file) {
+		password, ok := "", false
+		if v.password != nil {
+			password, ok = v.password(v.path, path)
 		}
-		opener := func() (io.ReadCloser, error) {
-			return f.Open()
+		if !ok {
+			closer.Close()
+			return nil, &fs.PathError{Op: "open", Path: path, Err: ErrPasswordRequired}
 		}
-		return &zipFileReader{opener: opener, parentCloser: closer, size: fi.Size(), stat: fi}, nil
+		r, checkCRC, err = idx.encryptedReader(e.file, password)
+	} else {
+		r, err = idx.contentReader(e.file)
+	}
+	if err != nil {
+		closer.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	zfr := &zipFileReader{reader: r, parentCloser: closer, size: e.Size(), crc32: e.file.CRC32, stat: e}
+	if checkCRC {
+		zfr.crc = crc32.NewIEEE()
 	}
-	closer.Close()
-	return nil, fs.ErrNotExist
+	return zfr, nil
 }
 
+// Default limits of nested archives.
+const (
+	DefaultMaxDepth       = 4
+	DefaultMaxArchiveSize = 1 << 30
+)
+
+var (
+	ErrTooDeep  = errors.New("too deeply nested archive")
+	ErrTooLarge = errors.New("nested archive is too large")
+)
+
+// DefaultSeparator separates the path of an archive and the path in the archive. e.g. "a.zip/:/b.txt"
+const DefaultSeparator = ":"
+
+// DefaultZipExtensions are the extensions of zip files used by AutoUnzipFS.
+var DefaultZipExtensions = []string{".zip"}
+
 type AutoUnzipFS struct {
 	fs.FS
-	ModeDir   bool
-	zipPrefix string
+	ModeDir bool
+	// MaxDepth is the max nesting level of archives. (0: DefaultMaxDepth)
+	MaxDepth int
+	// MaxArchiveSize is the max size of archives in archives. (0: DefaultMaxArchiveSize)
+	MaxArchiveSize int64
+	// Charset of non UTF-8 names in zip files. (see WithCharset)
+	Charset string
+	// Password provides passwords of encrypted zip files. (see WithPassword)
+	Password PasswordFunc
+	// Separator of archive paths. (empty: DefaultSeparator)
+	Separator string
+	// Extensions of zip files. They are matched case-insensitively. (nil: DefaultZipExtensions)
+	Extensions []string
+	// SniffContent enables detection of zip files by their content. e.g. ".jar", ".epub", ".docx"
+	SniffContent bool
+	depth        int
 }
 
 func NewAutoUnzipFS(fsys fs.FS) fs.FS {
-	return &AutoUnzipFS{FS: fsys, ModeDir: true, zipPrefix: ":/"}
+	return &AutoUnzipFS{FS: fsys, ModeDir: true, MaxDepth: DefaultMaxDepth, MaxArchiveSize: DefaultMaxArchiveSize}
+}
+
+// HasExtension returns true if the name ends with one of the extensions. Case is ignored.
+func HasExtension(name string, extensions []string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsZipSignature returns true if b starts with the signature of a zip file.
+func IsZipSignature(b []byte) bool {
+	return len(b) >= 4 && b[0] == 'P' && b[1] == 'K' &&
+		(b[2] == 3 && b[3] == 4 || b[2] == 5 && b[3] == 6) // local file header or end of central directory (empty archive)
+}
+
+func (v *AutoUnzipFS) zipPrefix() string {
+	if v.Separator == "" {
+		return DefaultSeparator + "/"
+	}
+	return v.Separator + "/"
 }
 
 func (v *AutoUnzipFS) IsZipFile(path string) bool {
-	return strings.HasSuffix(path, ".zip") || strings.HasSuffix(path, ".ZIP")
+	extensions := v.Extensions
+	if extensions == nil {
+		extensions = DefaultZipExtensions
+	}
+	return HasExtension(path, extensions) || v.SniffContent && v.sniffZip(path)
+}
+
+func (v *AutoUnzipFS) sniffZip(path string) bool {
+	f, err := v.FS.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var b [4]byte
+	_, err = io.ReadFull(f, b[:])
+	return err == nil && IsZipSignature(b[:])
+}
+
+// IsArchiveFile returns true if the path is a zip or tar file.
+func (v *AutoUnzipFS) IsArchiveFile(path string) bool {
+	return tarfs.IsTarFile(path) || v.IsZipFile(path)
+}
+
+// archiveFS returns the FS of the archive. path must be an archive file.
+func (v *AutoUnzipFS) archiveFS(path string) fs.StatFS {
+	if tarfs.IsTarFile(path) {
+		return tarfs.NewFS(path, v.FS)
+	}
+	return &ZipFS{fsys: v.FS, path: path, charset: strings.ToLower(v.Charset), password: v.Password}
+}
+
+// openArchive returns an AutoUnzipFS for the contents of the archive, so that nested archives can be opened.
+func (v *AutoUnzipFS) openArchive(op, path string) (*AutoUnzipFS, error) {
+	maxDepth, maxSize := v.MaxDepth, v.MaxArchiveSize
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxArchiveSize
+	}
+	if v.depth >= maxDepth {
+		return nil, &fs.PathError{Op: op, Path: path, Err: ErrTooDeep}
+	}
+	if v.depth > 0 {
+		stat, err := fs.Stat(v.FS, path)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() > maxSize {
+			return nil, &fs.PathError{Op: op, Path: path, Err: ErrTooLarge}
+		}
+	}
+	return &AutoUnzipFS{FS: v.archiveFS(path), ModeDir: v.ModeDir, MaxDepth: v.MaxDepth, MaxArchiveSize: v.MaxArchiveSize,
+		Charset: v.Charset, Password: v.Password, Separator: v.Separator, Extensions: v.Extensions, SniffContent: v.SniffContent,
+		depth: v.depth + 1}, nil
 }
 
 func (v *AutoUnzipFS) Open(path string) (reader fs.File, err error) {
@@ -240,10 +557,13 @@ func (v *AutoUnzipFS) Open(path string) (reader fs.File, err error) {
 	if err == nil {
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+v.zipPrefix, 2)
-	if len(pathAndName) == 2 && v.IsZipFile(pathAndName[0]) {
-		zv := &ZipFS{v.FS, pathAndName[0]}
-		return zv.Open(pathAndName[1])
+	pathAndName := strings.SplitN(path, "/"+v.zipPrefix(), 2)
+	if len(pathAndName) == 2 && v.IsArchiveFile(pathAndName[0]) {
+		afs, err := v.openArchive("open", pathAndName[0])
+		if err != nil {
+			return nil, err
+		}
+		return afs.Open(normalizeName(pathAndName[1]))
 	}
 	return nil, err
 }
@@ -251,19 +571,18 @@ func (v *AutoUnzipFS) Open(path string) (reader fs.File, err error) {
 func (v *AutoUnzipFS) Stat(path string) (stat fs.FileInfo, err error) {
 	stat, err = fs.Stat(v.FS, path)
 	if err == nil {
-		if v.ModeDir && !stat.IsDir() && v.IsZipFile(stat.Name()) {
+		if v.ModeDir && !stat.IsDir() && v.IsArchiveFile(path) {
 			stat = &modeDirOverride{stat}
 		}
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+v.zipPrefix, 2)
-	if len(pathAndName) == 2 && v.IsZipFile(pathAndName[0]) {
-		zv := &ZipFS{v.FS, pathAndName[0]}
-		stat, err := zv.Stat(pathAndName[1])
-		if stat, ok := stat.(*fileEntry); ok {
-			stat.rawName = v.zipPrefix + stat.rawName
+	pathAndName := strings.SplitN(path, "/"+v.zipPrefix(), 2)
+	if len(pathAndName) == 2 && v.IsArchiveFile(pathAndName[0]) {
+		afs, err := v.openArchive("stat", pathAndName[0])
+		if err != nil {
+			return nil, err
 		}
-		return stat, err
+		return afs.Stat(normalizeName(pathAndName[1]))
 	}
 	return nil, err
 }
@@ -273,26 +592,55 @@ func (v *AutoUnzipFS) ReadDir(path string) (files []fs.DirEntry, err error) {
 	if err == nil {
 		if v.ModeDir {
 			for i := range files {
-				if !files[i].IsDir() && v.IsZipFile(files[i].Name()) {
+				if !files[i].IsDir() && v.IsArchiveFile(joinPath(path, files[i].Name())) {
 					files[i] = &modeDirOverrideDirEnt{files[i]}
 				}
 			}
 		}
 		return
 	}
-	pathAndName := strings.SplitN(path, "/"+v.zipPrefix, 2)
-	if !v.IsZipFile(pathAndName[0]) {
+	pathAndName := strings.SplitN(path, "/"+v.zipPrefix(), 2)
+	if !v.IsArchiveFile(pathAndName[0]) {
 		return
 	}
 	fi, err2 := fs.Stat(v.FS, pathAndName[0])
 	if err2 == nil && !fi.IsDir() {
-		zv := &ZipFS{v.FS, pathAndName[0]}
-		files, err = zv.ReadDir("")
-		for _, fi := range files {
-			if fi, ok := fi.(*fileEntry); ok {
-				fi.rawName = v.zipPrefix + fi.rawName
-			}
+		afs, err := v.openArchive("readdir", pathAndName[0])
+		if err != nil {
+			return nil, err
 		}
+		if len(pathAndName) == 2 {
+			return afs.ReadDir(normalizeName(pathAndName[1]))
+		}
+		files, err = afs.ReadDir("")
+		for i := range files {
+			files[i] = &prefixedDirEntry{DirEntry: files[i], prefix: v.zipPrefix()}
+		}
+		return files, err
 	}
 	return
 }
+
+func joinPath(dir, name string) string {
+	if dir == "" || dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+type prefixedDirEntry struct {
+	fs.DirEntry
+	prefix string
+}
+
+func (e *prefixedDirEntry) Name() string {
+	return e.prefix + e.DirEntry.Name()
+}
+
+func (e *prefixedDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if info != nil {
+		info = &fileEntry{FileInfo: info, rawName: e.Name()}
+	}
+	return info, err
+}
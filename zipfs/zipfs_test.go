@@ -1,12 +1,20 @@
 package zipfs
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestZipVolume_Open(t *testing.T) {
@@ -101,3 +109,254 @@ func TestHttpVolume_ReadAt(t *testing.T) {
 		}
 	}
 }
+
+type testZipEntry struct {
+	name string
+	data string
+}
+
+func createTestZip(t *testing.T, entries []testZipEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, e := range entries {
+		fw, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(e.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZipFS_ReadDir(t *testing.T) {
+	var vol = NewFS(createTestZip(t, []testZipEntry{
+		{"a/b/c.txt", "Hello"},
+		{"a/b/d/", ""},
+		{"a/e.txt", "World"},
+		{"f.txt", "!"},
+	}), nil)
+
+	if err := fstest.TestFS(vol, "a/b/c.txt", "a/e.txt", "f.txt", "a/b/d"); err != nil {
+		t.Error(err)
+	}
+
+	files, err := fs.ReadDir(vol, "a/b")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, ",") != "c.txt,d" {
+		t.Errorf("unexpected files: %v", names)
+	}
+
+	stat, err := vol.Stat("a")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if !stat.IsDir() || stat.Mode()&fs.ModeDir == 0 || stat.Name() != "a" {
+		t.Errorf("unexpected stat: %v %v", stat.Name(), stat.Mode())
+	}
+
+	if _, err := fs.ReadDir(vol, "not_existing"); !os.IsNotExist(err) {
+		t.Errorf("ReadDir should return ErrNotExist: %v", err)
+	}
+}
+
+func TestZipFS_ExactPath(t *testing.T) {
+	var vol = NewFS(createTestZip(t, []testZipEntry{
+		{"docs/old/readme.txt", "old"},
+		{"./docs/readme.txt", "docs"},
+		{"/root.txt", "root"},
+		{"win\\dir\\file.txt", "win"},
+	}), nil)
+
+	for name, expected := range map[string]string{
+		"docs/old/readme.txt": "old",
+		"docs/readme.txt":     "docs",
+		"root.txt":            "root",
+		"win/dir/file.txt":    "win",
+	} {
+		b, err := fs.ReadFile(vol, name)
+		if err != nil {
+			t.Errorf("ReadFile(%q) error: %v", name, err)
+		} else if string(b) != expected {
+			t.Errorf("ReadFile(%q): %q, want %q", name, b, expected)
+		}
+	}
+
+	for _, name := range []string{"readme.txt", "old/readme.txt", "file.txt", "dir/file.txt"} {
+		if _, err := vol.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%q) should return ErrNotExist: %v", name, err)
+		}
+		if _, err := vol.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) should return ErrNotExist: %v", name, err)
+		}
+	}
+
+	if err := fstest.TestFS(vol, "docs/old/readme.txt", "docs/readme.txt", "root.txt", "win/dir/file.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestZipFS_ReadAt(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i*7 + i/1000)
+	}
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: fmt.Sprint("file", method), Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	w.Close()
+	f.Close()
+
+	vol := NewFS(path, nil)
+	for _, name := range []string{"file0", "file8"} {
+		r, err := vol.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra := r.(io.ReaderAt)
+		for _, off := range []int64{500000, 10, 900000, 0, int64(len(data)) - 100} {
+			b := make([]byte, 1000)
+			n, err := ra.ReadAt(b, off)
+			if err != nil && err != io.EOF {
+				t.Fatalf("%v: ReadAt(%v) error: %v", name, off, err)
+			}
+			if !bytes.Equal(b[:n], data[off:off+int64(n)]) {
+				t.Errorf("%v: ReadAt(%v) unexpected data", name, off)
+			}
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%v: Read error: %v", name, err)
+		}
+		r.Close()
+	}
+}
+
+func TestAutoUnzipFS_Tar(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "test.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tar.NewWriter(f)
+	w.WriteHeader(&tar.Header{Name: "a/b.txt", Mode: 0644, Size: 5})
+	w.Write([]byte("Hello"))
+	w.Close()
+	f.Close()
+
+	vol := NewAutoUnzipFS(os.DirFS(dir))
+	stat, err := fs.Stat(vol, "test.tar")
+	if err != nil || !stat.IsDir() {
+		t.Errorf("test.tar should be a directory: %v", err)
+	}
+	files, err := fs.ReadDir(vol, "test.tar")
+	if err != nil || len(files) != 1 || files[0].Name() != ":/a" || !files[0].IsDir() {
+		t.Errorf("unexpected files: %v %v", files, err)
+	}
+	b, err := fs.ReadFile(vol, "test.tar/:/a/b.txt")
+	if err != nil || string(b) != "Hello" {
+		t.Errorf("unexpected data: %q %v", b, err)
+	}
+}
+
+func TestAutoUnzipFS_Nested(t *testing.T) {
+	inner := createTestZip(t, []testZipEntry{{"c.txt", "Hello"}})
+	innerData, _ := os.ReadFile(inner)
+	outer := createTestZip(t, []testZipEntry{{"a/b.zip", string(innerData)}})
+
+	vol := NewAutoUnzipFS(os.DirFS(filepath.Dir(outer)))
+	for i := 0; i < 2; i++ {
+		b, err := fs.ReadFile(vol, "test.zip/:/a/b.zip/:/c.txt")
+		if err != nil || string(b) != "Hello" {
+			t.Errorf("unexpected data: %q %v", b, err)
+		}
+	}
+	stat, err := fs.Stat(vol, "test.zip/:/a/b.zip")
+	if err != nil || !stat.IsDir() {
+		t.Errorf("nested zip should be a directory: %v", err)
+	}
+	files, err := fs.ReadDir(vol, "test.zip/:/a/b.zip")
+	if err != nil || len(files) != 1 || files[0].Name() != ":/c.txt" {
+		t.Errorf("unexpected files: %v %v", files, err)
+	}
+
+	vol.(*AutoUnzipFS).MaxDepth = 1
+	if _, err := vol.Open("test.zip/:/a/b.zip/:/c.txt"); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("Open should return ErrTooDeep: %v", err)
+	}
+	vol.(*AutoUnzipFS).MaxDepth = 0
+	vol.(*AutoUnzipFS).MaxArchiveSize = 10
+	if _, err := vol.Open("test.zip/:/a/b.zip/:/c.txt"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Open should return ErrTooLarge: %v", err)
+	}
+}
+
+func TestAutoUnzipFS_Detection(t *testing.T) {
+	data, err := os.ReadFile(createTestZip(t, []testZipEntry{{"META-INF/MANIFEST.MF", "Manifest-Version: 1.0"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"a.JAR", "b.epub", "c.txt"} {
+		content := data
+		if name == "c.txt" {
+			content = []byte("PK")
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vol := &AutoUnzipFS{FS: os.DirFS(dir), ModeDir: true, Separator: "!", Extensions: []string{".jar"}}
+	if b, err := fs.ReadFile(vol, "a.JAR/!/META-INF/MANIFEST.MF"); err != nil || string(b) != "Manifest-Version: 1.0" {
+		t.Errorf("unexpected data: %q %v", b, err)
+	}
+	if _, err := fs.ReadFile(vol, "a.JAR/:/META-INF/MANIFEST.MF"); err == nil {
+		t.Errorf("default separator should not be used")
+	}
+	if _, err := fs.Stat(vol, "b.epub/!/META-INF"); err == nil {
+		t.Errorf("b.epub should not be an archive without sniffing")
+	}
+	files, err := fs.ReadDir(vol, "a.JAR")
+	if err != nil || len(files) != 1 || files[0].Name() != "!/META-INF" {
+		t.Errorf("unexpected files: %v %v", files, err)
+	}
+
+	vol.SniffContent = true
+	if stat, err := fs.Stat(vol, "b.epub/!/META-INF"); err != nil || !stat.IsDir() {
+		t.Errorf("b.epub should be detected by content: %v", err)
+	}
+	files, err = fs.ReadDir(vol, ".")
+	if err != nil || len(files) != 3 {
+		t.Fatalf("unexpected files: %v %v", files, err)
+	}
+	for _, f := range files {
+		if f.IsDir() != (f.Name() != "c.txt") {
+			t.Errorf("unexpected IsDir: %v %v", f.Name(), f.IsDir())
+		}
+	}
+}